@@ -0,0 +1,106 @@
+// Package audit records what happened to authentication and signing orders in
+// a tamper-evident log: every record is hash-chained to the previous one, so
+// edited or deleted records are found by Verify.
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"time"
+)
+
+// Receives audit events, Write has to return once the event is stored
+type AuditSink interface {
+	Write(ctx context.Context, event Event) error
+	Close() error
+}
+
+type Config struct {
+	// JSON-lines file records are appended to
+	File string `yaml:"file"`
+	// Optional key making the chain an HMAC chain, so records cannot be
+	// rewritten without it
+	Key string `yaml:"key"`
+	// Writes personal numbers and names as they are. By default personal
+	// numbers are replaced by their HMAC keyed with Key, and names left out.
+	PersonalData bool `yaml:"personalData"`
+}
+
+type EventType string
+
+const (
+	ORDER_STARTED      EventType = "order.started"
+	ORDER_START_FAILED EventType = "order.startFailed"
+	// The hint code of a pending order changed
+	ORDER_HINT         EventType = "order.hint"
+	ORDER_COMPLETED    EventType = "order.completed"
+	ORDER_FAILED       EventType = "order.failed"
+	ORDER_CANCELLED    EventType = "order.cancelled"
+	DEVICE_IP_MISMATCH EventType = "order.deviceIpMismatch"
+)
+
+type Event struct {
+	Time          time.Time `json:"time"`
+	Type          EventType `json:"type"`
+	Provider      string    `json:"provider"`
+	TransactionID string    `json:"transactionId,omitempty"`
+	OrderType     string    `json:"orderType,omitempty"`
+	Flow          string    `json:"flow,omitempty"`
+	// IP of the client that started the order
+	UserIp string `json:"userIp,omitempty"`
+	// IP of the device the order was completed on, as seen by the provider
+	DeviceIp            string   `json:"deviceIp,omitempty"`
+	CertificatePolicies []string `json:"certificatePolicies,omitempty"`
+	PersonalNumber      string   `json:"personalNumber,omitempty"`
+	// Written instead of the personal number, see HashPersonalNumber
+	PersonalNumberHash string `json:"personalNumberHash,omitempty"`
+	Name               string `json:"name,omitempty"`
+	Status             string `json:"status,omitempty"`
+	HintCode           string `json:"hintCode,omitempty"`
+	Reason             string `json:"reason,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+// Line of the log: the event with its place in the chain
+type Record struct {
+	Sequence uint64 `json:"seq"`
+	Event
+	// Hash of the previous record, empty for the first one
+	PrevHash string `json:"prevHash"`
+	// Hash of this record without this field
+	Hash string `json:"hash,omitempty"`
+}
+
+// HMAC-SHA256 of the personal number keyed with the key of the log, to find
+// the records of a person without the log holding their personal number
+func HashPersonalNumber(key, personalNumber string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(personalNumber))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type chain struct {
+	key []byte
+}
+
+func (c chain) newHash() hash.Hash {
+	if len(c.key) > 0 {
+		return hmac.New(sha256.New, c.key)
+	}
+	return sha256.New()
+}
+
+func (c chain) sum(record Record) (string, error) {
+	record.Hash = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	h := c.newHash()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lines longer than this are not records
+const MAX_RECORD_SIZE = 1024 * 1024
+
+// Appends records to a JSON-lines file, one per line
+type FileSink struct {
+	file         *os.File
+	chain        chain
+	key          string
+	personalData bool
+	mutex        sync.Mutex
+	last         Record
+}
+
+// Opens the log, or creates it, and continues the chain of its last record
+func NewFileSink(config *Config) (*FileSink, error) {
+	if config.File == "" {
+		return nil, errors.New("audit: no 'file' configured")
+	}
+	file, err := os.OpenFile(config.File, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit: could not open %s: %w", config.File, err)
+	}
+	last, err := lastRecord(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("audit: could not read %s: %w", config.File, err)
+	}
+	return &FileSink{
+		file:         file,
+		chain:        chain{key: []byte(config.Key)},
+		key:          config.Key,
+		personalData: config.PersonalData,
+		last:         last,
+	}, nil
+}
+
+func lastRecord(r io.Reader) (Record, error) {
+	var last Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_RECORD_SIZE)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			return Record{}, fmt.Errorf("invalid record after sequence %d: %w", last.Sequence, err)
+		}
+	}
+	return last, scanner.Err()
+}
+
+func (s *FileSink) Write(ctx context.Context, event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	// Only UTC survives encoding and decoding unchanged
+	event.Time = event.Time.UTC()
+	if !s.personalData {
+		event = s.redact(event)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := Record{
+		Sequence: s.last.Sequence + 1,
+		Event:    event,
+		PrevHash: s.last.Hash,
+	}
+	var err error
+	record.Hash, err = s.chain.sum(record)
+	if err != nil {
+		return fmt.Errorf("audit: could not hash record: %w", err)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("audit: could not encode record: %w", err)
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("audit: could not write record: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("audit: could not write record: %w", err)
+	}
+	s.last = record
+	return nil
+}
+
+// Leaves out names and personal numbers, which are only written as their
+// HMAC when the log has a key: without one the hash could be reversed by
+// trying every personal number
+func (s *FileSink) redact(event Event) Event {
+	if event.PersonalNumber != "" && s.key != "" {
+		event.PersonalNumberHash = HashPersonalNumber(s.key, event.PersonalNumber)
+	}
+	event.PersonalNumber = ""
+	event.Name = ""
+	return event
+}
+
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const personalNumber = "199001012385"
+
+// Writes a completed order to a new log and returns the log
+func writeCompleted(t *testing.T, config Config) string {
+	t.Helper()
+	config.File = filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileSink(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Write(context.Background(), Event{
+		Type:           ORDER_COMPLETED,
+		Provider:       "bankid",
+		PersonalNumber: personalNumber,
+		Name:           "Anna Andersson",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.ReadFile(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(strings.NewReader(string(log)), []byte(config.Key), ""); err != nil {
+		t.Errorf("log does not verify: %v", err)
+	}
+	return string(log)
+}
+
+func TestPersonalData(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		hash   bool
+		plain  bool
+	}{
+		{name: "hashed with the key", config: Config{Key: "secret"}, hash: true},
+		{name: "left out without a key", config: Config{}},
+		{name: "kept when asked for", config: Config{Key: "secret", PersonalData: true}, plain: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := writeCompleted(t, test.config)
+			if got := strings.Contains(log, personalNumber); got != test.plain {
+				t.Errorf("personal number written: %v, want %v", got, test.plain)
+			}
+			if got := strings.Contains(log, "Anna Andersson"); got != test.plain {
+				t.Errorf("name written: %v, want %v", got, test.plain)
+			}
+			hash := `"personalNumberHash":"` + HashPersonalNumber("secret", personalNumber) + `"`
+			if got := strings.Contains(log, hash); got != test.hash {
+				t.Errorf("personal number hash written: %v, want %v", got, test.hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Last record of a valid log, its hash can be kept elsewhere to also detect
+// records removed from the end later on
+type VerifyResult struct {
+	Records  int
+	Sequence uint64
+	Hash     string
+}
+
+// Checks that every record is unchanged and follows the previous one, with
+// the key the log was written with if any. When given, head is the hash of a
+// record seen before, which has to still be in the log
+func Verify(r io.Reader, key []byte, head string) (VerifyResult, error) {
+	var result VerifyResult
+	headFound := head == ""
+	c := chain{key: key}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_RECORD_SIZE)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		var record Record
+		if err := decoder.Decode(&record); err != nil {
+			return result, fmt.Errorf("line %d: not a valid record: %w", line, err)
+		}
+		if record.Sequence <= result.Sequence {
+			return result, fmt.Errorf("line %d: record %d is duplicated or out of order", line, record.Sequence)
+		}
+		if record.Sequence == result.Sequence+2 {
+			return result, fmt.Errorf("line %d: record %d is missing", line, result.Sequence+1)
+		}
+		if record.Sequence != result.Sequence+1 {
+			return result, fmt.Errorf("line %d: records %d to %d are missing", line, result.Sequence+1, record.Sequence-1)
+		}
+		if record.PrevHash != result.Hash {
+			return result, fmt.Errorf("line %d: record %d does not follow record %d, which was edited or replaced", line, record.Sequence, result.Sequence)
+		}
+		sum, err := c.sum(record)
+		if err != nil {
+			return result, fmt.Errorf("line %d: %w", line, err)
+		}
+		if sum != record.Hash {
+			return result, fmt.Errorf("line %d: record %d was edited, or the key is wrong", line, record.Sequence)
+		}
+		if record.Hash == head {
+			headFound = true
+		}
+		result.Records++
+		result.Sequence = record.Sequence
+		result.Hash = record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("line %d: %w", line+1, err)
+	}
+	if !headFound {
+		return result, fmt.Errorf("no record has the hash %s, records were removed from the end", head)
+	}
+	return result, nil
+}
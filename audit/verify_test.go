@@ -0,0 +1,200 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes records for a few orders and returns the lines of the log and the
+// result of verifying it
+func writeLog(t *testing.T, key string) ([]string, VerifyResult) {
+	t.Helper()
+	config := Config{File: filepath.Join(t.TempDir(), "audit.jsonl"), Key: key}
+	sink, err := NewFileSink(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, eventType := range []EventType{ORDER_STARTED, ORDER_HINT, ORDER_COMPLETED, ORDER_STARTED, ORDER_CANCELLED} {
+		err := sink.Write(context.Background(), Event{Type: eventType, Provider: "bankid", TransactionID: "order"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	result, err := Verify(strings.NewReader(string(data)), []byte(key), "")
+	if err != nil {
+		t.Fatalf("log does not verify: %v", err)
+	}
+	if result.Records != len(lines) || result.Sequence != uint64(len(lines)) {
+		t.Fatalf("verified %d records up to %d, want %d", result.Records, result.Sequence, len(lines))
+	}
+	return lines, result
+}
+
+func decodeRecord(t *testing.T, line string) Record {
+	t.Helper()
+	var record Record
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func encodeRecord(t *testing.T, record Record) string {
+	t.Helper()
+	line, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line)
+}
+
+func join(lines ...string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestVerifyTampered(t *testing.T) {
+	lines, _ := writeLog(t, "secret")
+	edit := func(line int, old, new string) []string {
+		edited := append([]string{}, lines...)
+		if !strings.Contains(edited[line], old) {
+			t.Fatalf("line %d has no %q", line, old)
+		}
+		edited[line] = strings.Replace(edited[line], old, new, 1)
+		return edited
+	}
+	without := func(line int) []string {
+		return append(append([]string{}, lines[:line]...), lines[line+1:]...)
+	}
+	tests := []struct {
+		name  string
+		log   string
+		error string
+	}{
+		{"edited", join(edit(2, `"type":"order.completed"`, `"type":"order.failed"`)...), "record 3 was edited"},
+		{"edited first", join(edit(0, `"provider":"bankid"`, `"provider":"freja"`)...), "record 1 was edited"},
+		{"deleted", join(without(2)...), "record 3 is missing"},
+		{"deleted first", join(without(0)...), "record 1 is missing"},
+		{"deleted several", join(lines[0], lines[3], lines[4]), "records 2 to 3 are missing"},
+		{"reordered", join(lines[0], lines[2], lines[1], lines[3], lines[4]), "record 2 is missing"},
+		{"swapped at the end", join(lines[0], lines[1], lines[2], lines[4], lines[3]), "record 4 is missing"},
+		{"duplicated", join(lines[0], lines[1], lines[1], lines[2]), "record 2 is duplicated or out of order"},
+		{"renumbered", join(lines[0], strings.Replace(lines[2], `"seq":3`, `"seq":2`, 1)), "record 2 does not follow record 1"},
+		{"unknown field", join(strings.Replace(lines[0], "{", `{"extra":true,`, 1)), "not a valid record"},
+		{"not JSON", join(lines[0], "garbage"), "line 2: not a valid record"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Verify(strings.NewReader(test.log), []byte("secret"), "")
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+// Recomputing the hashes of an edited log needs the key
+func TestVerifyRewritten(t *testing.T) {
+	lines, _ := writeLog(t, "secret")
+	c := chain{}
+	rewritten := make([]string, len(lines))
+	prevHash := ""
+	for i, line := range lines {
+		record := decodeRecord(t, line)
+		if record.Type == ORDER_COMPLETED {
+			record.Type = ORDER_FAILED
+		}
+		record.PrevHash = prevHash
+		hash, err := c.sum(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.Hash = hash
+		prevHash = hash
+		rewritten[i] = encodeRecord(t, record)
+	}
+	if _, err := Verify(strings.NewReader(join(rewritten...)), []byte("secret"), ""); err == nil || !strings.Contains(err.Error(), "record 1 was edited, or the key is wrong") {
+		t.Errorf("log rewritten without the key: got %v", err)
+	}
+	if _, err := Verify(strings.NewReader(join(rewritten...)), nil, ""); err != nil {
+		t.Errorf("log without key refused: %v", err)
+	}
+}
+
+func TestVerifyWrongKey(t *testing.T) {
+	lines, _ := writeLog(t, "secret")
+	for _, key := range []string{"other", ""} {
+		if _, err := Verify(strings.NewReader(join(lines...)), []byte(key), ""); err == nil || !strings.Contains(err.Error(), "the key is wrong") {
+			t.Errorf("verified with key %q: %v", key, err)
+		}
+	}
+	unkeyed, _ := writeLog(t, "")
+	if _, err := Verify(strings.NewReader(join(unkeyed...)), []byte("secret"), ""); err == nil {
+		t.Error("log written without a key verified with one")
+	}
+}
+
+// Records removed from the end leave a valid chain, only the head recorded
+// before tells
+func TestVerifyTruncated(t *testing.T) {
+	lines, head := writeLog(t, "secret")
+	earlier := decodeRecord(t, lines[2])
+
+	truncated := join(lines[:3]...)
+	if _, err := Verify(strings.NewReader(truncated), []byte("secret"), ""); err != nil {
+		t.Fatalf("truncated log is a valid chain, got %v", err)
+	}
+	_, err := Verify(strings.NewReader(truncated), []byte("secret"), head.Hash)
+	if err == nil || !strings.Contains(err.Error(), "records were removed from the end") {
+		t.Errorf("truncated log verified against the recorded head: %v", err)
+	}
+	if _, err := Verify(strings.NewReader(""), []byte("secret"), head.Hash); err == nil {
+		t.Error("emptied log verified against the recorded head")
+	}
+
+	// Records written after the head was recorded are fine
+	result, err := Verify(strings.NewReader(join(lines...)), []byte("secret"), earlier.Hash)
+	if err != nil {
+		t.Errorf("log refused with an earlier head: %v", err)
+	}
+	if result.Hash != head.Hash || result.Sequence != head.Sequence {
+		t.Errorf("got head %+v, want %+v", result, head)
+	}
+}
+
+// Writing continues the chain of the records already in the log
+func TestVerifyReopened(t *testing.T) {
+	config := Config{File: filepath.Join(t.TempDir(), "audit.jsonl"), Key: "secret"}
+	for i := 0; i < 3; i++ {
+		sink, err := NewFileSink(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Write(context.Background(), Event{Type: ORDER_STARTED, Provider: "bankid"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	result, err := Verify(f, []byte("secret"), "")
+	if err != nil || result.Records != 3 {
+		t.Errorf("verified %d records: %v", result.Records, err)
+	}
+}
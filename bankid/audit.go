@@ -0,0 +1,71 @@
+package bankid
+
+import (
+	"context"
+	"log"
+
+	"github.com/Splinter0/identity/audit"
+)
+
+// Writes the event to the audit sink when there is one, orders do not fail
+// when it cannot be written
+func (provider *BankIDProvider) record(ctx context.Context, event audit.Event) {
+	if provider.Audit == nil {
+		return
+	}
+	event.Provider = "bankid"
+	if err := provider.Audit.Write(ctx, event); err != nil {
+		log.Printf("Could not write BankID audit event %s for order %s: %v", event.Type, event.TransactionID, err)
+	}
+}
+
+func (transaction BankIDTransaction) auditEvent(eventType audit.EventType) audit.Event {
+	return audit.Event{
+		Type:                eventType,
+		TransactionID:       transaction.OrderRef,
+		OrderType:           string(transaction.Type),
+		Flow:                string(transaction.Flow),
+		UserIp:              transaction.UserIp,
+		CertificatePolicies: transaction.CertificatePolicies,
+	}
+}
+
+func (provider *BankIDProvider) recordStartFailed(ctx context.Context, transaction BankIDTransaction, err error) {
+	event := transaction.auditEvent(audit.ORDER_START_FAILED)
+	event.Error = err.Error()
+	provider.record(ctx, event)
+}
+
+func certificatePolicies(requirement *AuthRequestRequirements) []string {
+	if requirement == nil {
+		return nil
+	}
+	return requirement.CertificatePolicies
+}
+
+// Outcome of a finished transaction, with who completed it if anyone
+func (provider *BankIDProvider) recordFinished(ctx context.Context, transaction BankIDTransaction, status BankIDStatusResponse) {
+	eventType := audit.ORDER_FAILED
+	if status.Status == COMPLETE {
+		eventType = audit.ORDER_COMPLETED
+	}
+	event := transaction.auditEvent(eventType)
+	event.Status = string(status.Status)
+	event.HintCode = string(status.HintCode)
+	event.Reason = status.Reason
+	if transaction.Collect != nil && transaction.Collect.Status == COMPLETE {
+		completionData := transaction.Collect.CompletionData
+		event.PersonalNumber = completionData.User.PersonalNumber
+		event.Name = completionData.User.Name
+		event.DeviceIp = completionData.Device.IpAddress
+	}
+	provider.record(ctx, event)
+
+	// Same device orders have to be completed where they were started
+	if transaction.SameDevice && event.DeviceIp != "" && event.DeviceIp != transaction.UserIp {
+		mismatch := transaction.auditEvent(audit.DEVICE_IP_MISMATCH)
+		mismatch.DeviceIp = event.DeviceIp
+		mismatch.PersonalNumber = event.PersonalNumber
+		provider.record(ctx, mismatch)
+	}
+}
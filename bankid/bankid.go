@@ -2,10 +2,10 @@ package bankid
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -13,8 +13,9 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const LATEST_VERSION = "6.0"
@@ -36,35 +37,105 @@ func (e BankIDEnvironment) getEndpoint() string {
 }
 
 type BankIDRP struct {
-	Client *http.Client
-	Config *BankIDConfig
+	Client      *http.Client
+	Config      *BankIDConfig
+	certificate *rpCertificate
+	orders      ownedOrders
 }
 
 type BankIDConfig struct {
-	Env               BankIDEnvironment `yaml:"env"`
-	Version           string            `yaml:"version"`
-	CertificateFolder string            `yaml:"certificateFolder"`
-	Domain            *string           `yaml:"domain"`
-	VisibleMessage    string            `yaml:"visibleMessage"`
+	Env               BankIDEnvironment  `yaml:"env"`
+	Version           string             `yaml:"version"`
+	CertificateFolder string             `yaml:"certificateFolder"`
+	Credentials       BankIDCredentials  `yaml:"credentials"`
+	Domain            *string            `yaml:"domain"`
+	VisibleMessage    string             `yaml:"visibleMessage"`
+	BaseURL           string             `yaml:"baseUrl"`
+	SignatureRootCA   string             `yaml:"signatureRootCA"`
+	OCSPMaxAge        time.Duration      `yaml:"ocspMaxAge"`
+	Timeouts          BankIDTimeouts     `yaml:"timeouts"`
+	Retry             RetryConfig        `yaml:"retry"`
+	Risk              RiskConfig         `yaml:"risk"`
+	Requirements      RequirementsConfig `yaml:"requirements"`
+	Store             StoreConfig        `yaml:"store"`
+	// Used for user messages when the user does not prefer a supported language
+	Language Language `yaml:"language"`
+}
+
+// Deadlines applied to each call made to the RP API, on top of any deadline
+// already carried by the context passed in by the caller.
+type BankIDTimeouts struct {
+	Default time.Duration `yaml:"default"`
+	Auth    time.Duration `yaml:"auth"`
+	Sign    time.Duration `yaml:"sign"`
+	Collect time.Duration `yaml:"collect"`
+	Cancel  time.Duration `yaml:"cancel"`
+}
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+func (t BankIDTimeouts) get(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	if t.Default > 0 {
+		return t.Default
+	}
+	return DEFAULT_TIMEOUT
+}
+
+// Uses the custom base URL if configured (e.g. to talk to the simulator),
+// otherwise the endpoint of the environment
+func (c *BankIDConfig) getEndpoint() string {
+	if c.BaseURL != "" {
+		return strings.TrimSuffix(c.BaseURL, "/")
+	}
+	return c.Env.getEndpoint()
 }
 
 func NewBankIDRP(config *BankIDConfig) (*BankIDRP, error) {
-	tlsConfig, err := buildTLSConfig(config)
+	if strings.HasPrefix(config.BaseURL, "http://") {
+		// No TLS, most likely the simulator, so no RP certificate is needed
+		log.Printf("BankID API at %s is not using TLS, not loading the RP certificate", config.BaseURL)
+		return NewBankIDRPWithClient(config, &http.Client{Timeout: 2 * config.Timeouts.get(0)}), nil
+	}
+	certificate, err := newRPCertificate(config)
+	if err != nil {
+		return nil, errors.New("Could not load TLS configuration for BankID: " + err.Error())
+	}
+	caCertPool, err := loadCAPool(config)
 	if err != nil {
 		return nil, errors.New("Could not load TLS configuration for BankID: " + err.Error())
 	}
+	go certificate.watch()
+
 	return &BankIDRP{
 		Client: &http.Client{
-			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				GetClientCertificate: certificate.get,
+				RootCAs:              caCertPool,
+			}},
+			// Last line of defence, per call deadlines are set through the context
+			Timeout: 2 * config.Timeouts.get(0),
 		},
-		Config: config,
+		Config:      config,
+		certificate: certificate,
 	}, nil
 }
 
+// Builds a client using the given HTTP client instead of one configured with
+// the RP certificates, useful to talk to the simulator or through a proxy.
+func NewBankIDRPWithClient(config *BankIDConfig, client *http.Client) *BankIDRP {
+	return &BankIDRP{
+		Client: client,
+		Config: config,
+	}
+}
+
 // URL Building
 
 func (b *BankIDRP) buildUrl(path string) string {
-	return b.Config.Env.getEndpoint() + "/rp/v" + b.Config.Version + path
+	return b.Config.getEndpoint() + "/rp/v" + b.Config.Version + path
 }
 
 func (b *BankIDRP) GetAuthUrl() string {
@@ -79,40 +150,83 @@ func (b *BankIDRP) GetPhoneAuthUrl() string {
 	return b.buildUrl("/phone/auth")
 }
 
+func (b *BankIDRP) GetSignUrl() string {
+	return b.buildUrl("/sign")
+}
+
+func (b *BankIDRP) GetPhoneSignUrl() string {
+	return b.buildUrl("/phone/sign")
+}
+
 func (b *BankIDRP) GetCancelUrl() string {
 	return b.buildUrl("/cancel")
 }
 
 // Authentication methods
 
-func (b *BankIDRP) DoAuth(ar AuthRequest) *AuthResponse {
-	var response AuthResponse
-	b.post(b.GetAuthUrl(), &ar, &response)
-	return &response
+func (b *BankIDRP) DoAuth(ar AuthRequest) (*AuthResponse, error) {
+	return b.DoAuthContext(context.Background(), ar)
+}
+
+func (b *BankIDRP) DoAuthContext(ctx context.Context, ar AuthRequest) (*AuthResponse, error) {
+	return b.createOrder(ctx, b.Config.Timeouts.Auth, b.GetAuthUrl(), requirementPersonalNumber(ar.Requirement), &ar)
+}
+
+func (b *BankIDRP) DoPhoneAuth(par PhoneAuthRequest) (*AuthResponse, error) {
+	return b.DoPhoneAuthContext(context.Background(), par)
+}
+
+func (b *BankIDRP) DoPhoneAuthContext(ctx context.Context, par PhoneAuthRequest) (*AuthResponse, error) {
+	return b.createOrder(ctx, b.Config.Timeouts.Auth, b.GetPhoneAuthUrl(), par.PersonalNumber, &par)
+}
+
+// Signing methods
+
+func (b *BankIDRP) DoSign(sr SignRequest) (*AuthResponse, error) {
+	return b.DoSignContext(context.Background(), sr)
+}
+
+func (b *BankIDRP) DoSignContext(ctx context.Context, sr SignRequest) (*AuthResponse, error) {
+	return b.createOrder(ctx, b.Config.Timeouts.Sign, b.GetSignUrl(), requirementPersonalNumber(sr.Requirement), &sr)
+}
+
+func (b *BankIDRP) DoPhoneSign(psr PhoneSignRequest) (*AuthResponse, error) {
+	return b.DoPhoneSignContext(context.Background(), psr)
 }
 
-func (b *BankIDRP) DoPhoneAuth(par PhoneAuthRequest) *AuthResponse {
-	var response AuthResponse
-	b.post(b.GetPhoneAuthUrl(), &par, &response)
-	return &response
+func (b *BankIDRP) DoPhoneSignContext(ctx context.Context, psr PhoneSignRequest) (*AuthResponse, error) {
+	return b.createOrder(ctx, b.Config.Timeouts.Sign, b.GetPhoneSignUrl(), psr.PersonalNumber, &psr)
 }
 
 // Launching
 
-func (b *BankIDRP) GenerateLaunchURL(resp *AuthResponse, returnURL string, appLink bool) string {
+// Where to go after the app is done is given as returnUrl when creating the
+// order, the launch URL itself never redirects
+func (b *BankIDRP) GenerateLaunchURL(resp *AuthResponse, appLink bool) string {
 	if appLink {
-		return fmt.Sprintf("bankid:///?autostarttoken=%s&redirect=%s", resp.AutoStartToken, returnURL)
+		return fmt.Sprintf("bankid:///?autostarttoken=%s&redirect=null", resp.AutoStartToken)
 	}
 
-	return fmt.Sprintf("https://app.bankid.com/?autostarttoken=%s&redirect=%s", resp.AutoStartToken, returnURL)
+	return fmt.Sprintf("https://app.bankid.com/?autostarttoken=%s&redirect=null", resp.AutoStartToken)
+}
+
+// Animated QR code data for the given number of seconds since the order was
+// created, see https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/qrkoder
+func GenerateQRDataAt(qrStartToken, qrStartSecret string, seconds int) string {
+	hmac := hmac.New(sha256.New, []byte(qrStartSecret))
+	hmac.Write([]byte(strconv.Itoa(seconds)))
+	qrAuthCode := hex.EncodeToString(hmac.Sum(nil))
+	return fmt.Sprintf("bankid.%s.%d.%s", qrStartToken, seconds, qrAuthCode)
+}
+
+func (b *BankIDRP) GenerateQRDataAt(resp *AuthResponse, elapsed time.Duration) string {
+	return GenerateQRDataAt(resp.QrStartToken, resp.QrStartSecret, int(elapsed.Seconds()))
 }
 
+// Deprecated: only covers the first 30 seconds of the order, use GenerateQRDataAt.
 func (b *BankIDRP) GenerateQRData(resp *AuthResponse) (qrCodeData []string) {
 	for count := 0; count < 30; count++ {
-		hmac := hmac.New(sha256.New, []byte(resp.QrStartSecret))
-		hmac.Write([]byte(strconv.Itoa(count)))
-		qrAuthCode := hex.EncodeToString(hmac.Sum(nil))
-		qrCodeData = append(qrCodeData, fmt.Sprintf("bankid.%s.%d.%s", resp.QrStartToken, count, qrAuthCode))
+		qrCodeData = append(qrCodeData, GenerateQRDataAt(resp.QrStartToken, resp.QrStartSecret, count))
 	}
 
 	return qrCodeData
@@ -120,26 +234,50 @@ func (b *BankIDRP) GenerateQRData(resp *AuthResponse) (qrCodeData []string) {
 
 // Collecting order
 
-func (b *BankIDRP) DoCollection(orderRef string) *CollectResponse {
+func (b *BankIDRP) DoCollection(orderRef string) (*CollectResponse, error) {
+	return b.DoCollectionContext(context.Background(), orderRef)
+}
+
+func (b *BankIDRP) DoCollectionContext(ctx context.Context, orderRef string) (*CollectResponse, error) {
 	collectRequest := &CollectRequest{
 		OrderRef: orderRef,
 	}
 	var response CollectResponse
-	b.post(b.GetCollectUrl(), collectRequest, &response)
-	return &response
+	if err := b.post(ctx, orderReferring, b.Config.Timeouts.Collect, b.GetCollectUrl(), collectRequest, &response); err != nil {
+		return nil, err
+	}
+	if response.Status != PENDING {
+		b.orders.remove(orderRef)
+	}
+	return &response, nil
 }
 
 // Cancelling
 
-func (b *BankIDRP) Cancel(orderRef string) {
+func (b *BankIDRP) Cancel(orderRef string) error {
+	return b.CancelContext(context.Background(), orderRef)
+}
+
+func (b *BankIDRP) CancelContext(ctx context.Context, orderRef string) error {
 	cancelRequest := &CancelRequest{
 		OrderRef: orderRef,
 	}
-	b.post(b.GetCancelUrl(), cancelRequest, nil)
+	if err := b.post(ctx, orderReferring, b.Config.Timeouts.Cancel, b.GetCancelUrl(), cancelRequest, nil); err != nil {
+		return err
+	}
+	b.orders.remove(orderRef)
+	return nil
 }
 
 // Utils
 
+func requirementPersonalNumber(requirement *AuthRequestRequirements) string {
+	if requirement == nil {
+		return ""
+	}
+	return requirement.PersonalNumber
+}
+
 func (b *BankIDRP) GetCertPolicyString(policy CertificatePolicy) string {
 	if b.Config.Env == TEST {
 		return policy.getTest()
@@ -148,53 +286,52 @@ func (b *BankIDRP) GetCertPolicyString(policy CertificatePolicy) string {
 	return string(policy)
 }
 
-func (b *BankIDRP) post(url string, request, response interface{}) {
+func (b *BankIDRP) postOnce(ctx context.Context, timeout time.Duration, url string, request, response interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, b.Config.Timeouts.get(timeout))
+	defer cancel()
 	jsonData, err := json.Marshal(request)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("bankid: could not encode request: %w", err)
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("bankid: could not build request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := b.Client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("bankid: request to %s failed: %w", url, err)
 	}
 	defer resp.Body.Close()
-	if response == nil {
-		return
-	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("bankid: could not read response: %w", err)
 	}
-	err = json.Unmarshal(body, response)
-	if err != nil {
-		log.Fatal(err)
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp.StatusCode, body)
+	}
+	if response == nil {
+		return nil
 	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("bankid: could not decode response: %w", err)
+	}
+	return nil
 }
 
-func buildTLSConfig(config *BankIDConfig) (*tls.Config, error) {
-	path := fmt.Sprintf("%s%s/", config.CertificateFolder, config.Env)
-	cert, err := tls.LoadX509KeyPair(
-		path+"cert.pem",
-		path+"key.pem",
-	)
-	if err != nil {
-		return nil, err
+func parseError(statusCode int, body []byte) *BankIDError {
+	var errorResponse BankIDResponse
+	if err := json.Unmarshal(body, &errorResponse); err != nil || errorResponse.ErrorCode == "" {
+		// Some errors (e.g. from proxies in front of BankID) do not follow the documented format
+		return &BankIDError{
+			StatusCode: statusCode,
+			ErrorCode:  INTERNAL_ERROR,
+			Details:    http.StatusText(statusCode),
+		}
 	}
-
-	caCert, err := os.ReadFile(path + "ca-cert.pem")
-	if err != nil {
-		return nil, err
+	return &BankIDError{
+		StatusCode: statusCode,
+		ErrorCode:  ErrorCode(errorResponse.ErrorCode),
+		Details:    errorResponse.Details,
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-	}, nil
 }
@@ -0,0 +1,252 @@
+package bankid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	transactionsBucket = []byte("transactions")
+	valuesBucket       = []byte("values")
+)
+
+// Store in a local database file, keeps transactions across restarts of a
+// single instance
+type BoltStore struct {
+	db   *bolt.DB
+	stop chan struct{}
+}
+
+type boltRecord struct {
+	ExpiresAt   time.Time         `json:"expiresAt"`
+	Transaction BankIDTransaction `json:"transaction"`
+}
+
+func (r boltRecord) expired() bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
+
+type boltValue struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+	Value     []byte    `json:"value"`
+}
+
+func (v boltValue) expired() bool {
+	return !v.ExpiresAt.IsZero() && time.Now().After(v.ExpiresAt)
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("the bolt transaction store needs a 'path'")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open transaction store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(transactionsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(valuesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &BoltStore{
+		db:   db,
+		stop: make(chan struct{}),
+	}
+	go s.removeExpired()
+	return s, nil
+}
+
+func (s *BoltStore) Get(ctx context.Context, key string) (BankIDTransaction, bool, error) {
+	var record *boltRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getRecord(tx, key)
+		return err
+	})
+	if err != nil || record == nil {
+		return BankIDTransaction{}, false, err
+	}
+	return record.Transaction, true, nil
+}
+
+func (s *BoltStore) Set(ctx context.Context, key string, transaction BankIDTransaction, ttl time.Duration) error {
+	record := boltRecord{Transaction: transaction}
+	if ttl > 0 {
+		record.ExpiresAt = time.Now().Add(ttl)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx, key, record)
+	})
+}
+
+func (s *BoltStore) Delete(ctx context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(transactionsBucket).Delete([]byte(key))
+	})
+}
+
+// Bolt only allows one writer at a time, so the update cannot race
+func (s *BoltStore) Update(ctx context.Context, key string, update func(*BankIDTransaction)) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, key)
+		if err != nil || record == nil {
+			return err
+		}
+		update(&record.Transaction)
+		if record.expired() {
+			return tx.Bucket(transactionsBucket).Delete([]byte(key))
+		}
+		found = true
+		return putRecord(tx, key, *record)
+	})
+	return found, err
+}
+
+func (s *BoltStore) SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	record := boltValue{Value: value}
+	if ttl > 0 {
+		record.ExpiresAt = time.Now().Add(ttl)
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(valuesBucket).Put([]byte(key), encoded)
+	})
+}
+
+func (s *BoltStore) GetValue(ctx context.Context, key string) ([]byte, bool, error) {
+	var record *boltValue
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getValue(tx, key)
+		return err
+	})
+	if err != nil || record == nil {
+		return nil, false, err
+	}
+	return record.Value, true, nil
+}
+
+func (s *BoltStore) TakeValue(ctx context.Context, key string) ([]byte, bool, error) {
+	var record *boltValue
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if record, err = getValue(tx, key); err != nil {
+			return err
+		}
+		return tx.Bucket(valuesBucket).Delete([]byte(key))
+	})
+	if err != nil || record == nil {
+		return nil, false, err
+	}
+	return record.Value, true, nil
+}
+
+func (s *BoltStore) Close() error {
+	close(s.stop)
+	return s.db.Close()
+}
+
+func (s *BoltStore) Ongoing(ctx context.Context) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(transactionsBucket).ForEach(func(key, value []byte) error {
+			var record boltRecord
+			if err := json.Unmarshal(value, &record); err == nil && !record.expired() && record.Transaction.isOngoing() {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+func (s *BoltStore) removeExpired() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(transactionsBucket).Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				var record boltRecord
+				if err := json.Unmarshal(value, &record); err != nil || record.expired() {
+					if err := cursor.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+			cursor = tx.Bucket(valuesBucket).Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				var record boltValue
+				if err := json.Unmarshal(value, &record); err != nil || record.expired() {
+					if err := cursor.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Could not remove expired BankID transactions: %v", err)
+		}
+	}
+}
+
+// Nil when missing or expired
+func getRecord(tx *bolt.Tx, key string) (*boltRecord, error) {
+	value := tx.Bucket(transactionsBucket).Get([]byte(key))
+	if value == nil {
+		return nil, nil
+	}
+	var record boltRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("could not decode transaction %s: %w", key, err)
+	}
+	if record.expired() {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// Nil when missing or expired
+func getValue(tx *bolt.Tx, key string) (*boltValue, error) {
+	encoded := tx.Bucket(valuesBucket).Get([]byte(key))
+	if encoded == nil {
+		return nil, nil
+	}
+	var value boltValue
+	if err := json.Unmarshal(encoded, &value); err != nil {
+		return nil, fmt.Errorf("could not decode value %s: %w", key, err)
+	}
+	if value.expired() {
+		return nil, nil
+	}
+	return &value, nil
+}
+
+func putRecord(tx *bolt.Tx, key string, record boltRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(transactionsBucket).Put([]byte(key), value)
+}
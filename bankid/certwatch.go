@@ -0,0 +1,201 @@
+package bankid
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Hot reloading of the RP certificate, so it can be rotated without a restart,
+// and monitoring of its expiry.
+
+const (
+	DEFAULT_RELOAD_INTERVAL = 1 * time.Minute
+	EXPIRY_WARNING_DAYS     = 30
+)
+
+type rpCertificate struct {
+	config   *BankIDConfig
+	current  atomic.Pointer[tls.Certificate]
+	modTimes map[string]time.Time
+	warnedAt time.Time
+	stop     chan struct{}
+}
+
+func newRPCertificate(config *BankIDConfig) (*rpCertificate, error) {
+	if err := config.validateCredentials(); err != nil {
+		return nil, err
+	}
+	c := &rpCertificate{
+		config: config,
+		stop:   make(chan struct{}),
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Used as tls.Config.GetClientCertificate so that new connections always
+// present the latest certificate
+func (c *rpCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+func (c *rpCertificate) reload() error {
+	modTimes := c.sourceModTimes()
+	cert, err := loadCertificate(c.config)
+	if err != nil {
+		return err
+	}
+	if err := validateCertificate(&cert, c.config.Env); err != nil {
+		return err
+	}
+	c.current.Store(&cert)
+	c.modTimes = modTimes
+	c.logExpiry(true)
+	return nil
+}
+
+func (c *rpCertificate) watch() {
+	interval := c.config.Credentials.ReloadInterval
+	if interval <= 0 {
+		interval = DEFAULT_RELOAD_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		if c.changed() {
+			if err := c.reload(); err != nil {
+				// Keep using the previous certificate until the new one is fixed
+				log.Printf("Could not reload BankID RP certificate, keeping the current one: %v", err)
+				c.modTimes = c.sourceModTimes()
+			} else {
+				log.Println("Reloaded BankID RP certificate")
+			}
+		}
+		c.logExpiry(false)
+	}
+}
+
+func (c *rpCertificate) changed() bool {
+	for path, modTime := range c.sourceModTimes() {
+		if !modTime.Equal(c.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Files the certificate is loaded from, inline credentials never change
+func (c *rpCertificate) sourceModTimes() map[string]time.Time {
+	var paths []string
+	credentials := c.config.Credentials
+	switch {
+	case credentials.PKCS12 != "":
+		paths = append(paths, credentials.PKCS12)
+		if credentials.PassphraseFile != "" {
+			paths = append(paths, credentials.PassphraseFile)
+		}
+	case credentials.CertificatePEM != "":
+	default:
+		paths = append(paths, c.config.getFolderPath()+"cert.pem", c.config.getFolderPath()+"key.pem")
+	}
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (c *rpCertificate) logExpiry(always bool) {
+	days := daysUntil(c.current.Load().Leaf.NotAfter)
+	if always {
+		log.Printf("BankID RP certificate expires in %d days (%s)", days, c.current.Load().Leaf.NotAfter.Format(time.DateOnly))
+	}
+	// Warn once a day when getting close
+	if days <= EXPIRY_WARNING_DAYS && time.Since(c.warnedAt) > 24*time.Hour {
+		log.Printf("WARNING: BankID RP certificate expires in %d days, rotate it before logins start failing", days)
+		c.warnedAt = time.Now()
+	}
+}
+
+func (c *rpCertificate) close() {
+	close(c.stop)
+}
+
+// Refuses certificates that cannot possibly work with BankID
+func validateCertificate(cert *tls.Certificate, env BankIDEnvironment) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("could not parse RP certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("RP certificate for %s expired on %s", env, cert.Leaf.NotAfter.Format(time.DateOnly))
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return fmt.Errorf("RP certificate for %s is not valid before %s", env, cert.Leaf.NotBefore.Format(time.DateOnly))
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("RP private key cannot be used for signing")
+	}
+	publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(cert.Leaf.PublicKey) {
+		return errors.New("RP private key does not match the certificate")
+	}
+	// BankID test certificates are issued by test CAs, make sure one is not
+	// deployed in production by mistake
+	if env == PRODUCTION && strings.Contains(cert.Leaf.Issuer.CommonName, "Test") {
+		return fmt.Errorf("RP certificate issued by %q is a test certificate", cert.Leaf.Issuer.CommonName)
+	}
+	return nil
+}
+
+func daysUntil(t time.Time) int {
+	return int(math.Floor(time.Until(t).Hours() / 24))
+}
+
+// Certificate currently used to authenticate against BankID, nil when the
+// client was not built from the configured credentials
+func (b *BankIDRP) Certificate() *x509.Certificate {
+	if b.certificate == nil {
+		return nil
+	}
+	return b.certificate.current.Load().Leaf
+}
+
+// Number of days left before the RP certificate expires
+func (b *BankIDRP) DaysUntilExpiry() (int, bool) {
+	cert := b.Certificate()
+	if cert == nil {
+		return 0, false
+	}
+	return daysUntil(cert.NotAfter), true
+}
+
+// Stops watching the RP certificate for changes
+func (b *BankIDRP) Close() {
+	if b.certificate != nil {
+		b.certificate.close()
+	}
+}
@@ -0,0 +1,174 @@
+package bankid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Watches an RP certificate in the folder layout, checked every few
+// milliseconds
+func watchFolder(t *testing.T, initial testCertificate) (*rpCertificate, string) {
+	t.Helper()
+	folder := t.TempDir() + "/"
+	if err := os.Mkdir(folder+string(TEST), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := &BankIDConfig{
+		Env:               TEST,
+		CertificateFolder: folder,
+		Credentials:       BankIDCredentials{ReloadInterval: 10 * time.Millisecond},
+	}
+	writePair(t, config.getFolderPath(), initial.certPEM(), initial.keyPEM(t))
+	c, err := newRPCertificate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.watch()
+	t.Cleanup(c.close)
+	return c, config.getFolderPath()
+}
+
+// Rewrites the files, dated later than before so the change is seen even when
+// the file system only keeps seconds
+func writePair(t *testing.T, path, certPEM, keyPEM string) {
+	t.Helper()
+	for name, content := range map[string]string{"cert.pem": certPEM, "key.pem": keyPEM} {
+		later := time.Now()
+		if info, err := os.Stat(path + name); err == nil {
+			later = info.ModTime().Add(time.Second)
+		}
+		if err := os.WriteFile(path+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path+name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func served(t *testing.T, c *rpCertificate) testCertificate {
+	t.Helper()
+	cert, err := c.get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{cert: cert.Leaf}
+}
+
+func waitServed(t *testing.T, c *rpCertificate, want testCertificate) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !served(t, c).cert.Equal(want.cert) {
+		if time.Now().After(deadline) {
+			t.Fatalf("still serving %s, want %s", served(t, c).cert.SerialNumber, want.cert.SerialNumber)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadCertificate(t *testing.T) {
+	initial := validTestCertificate(t)
+	c, path := watchFolder(t, initial)
+	if !served(t, c).cert.Equal(initial.cert) {
+		t.Fatal("initial certificate not served")
+	}
+
+	rotated := validTestCertificate(t)
+	writePair(t, path, rotated.certPEM(), rotated.keyPEM(t))
+	waitServed(t, c, rotated)
+
+	// The client picks the certificate for every handshake
+	cert, err := c.get(nil)
+	if err != nil || cert.PrivateKey == nil || len(cert.Certificate) == 0 {
+		t.Errorf("got %+v: %v", cert, err)
+	}
+}
+
+func TestReloadInvalidCertificate(t *testing.T) {
+	initial := validTestCertificate(t)
+	other := validTestCertificate(t)
+	expired := newTestCertificate(t, "Identity RP CA", time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+	tests := []struct {
+		name    string
+		certPEM string
+		keyPEM  string
+	}{
+		{"not PEM", "garbage", "garbage"},
+		{"key of another certificate", other.certPEM(), initial.keyPEM(t)},
+		{"expired", expired.certPEM(), expired.keyPEM(t)},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, path := watchFolder(t, initial)
+			writePair(t, path, test.certPEM, test.keyPEM)
+			// A few reload intervals
+			time.Sleep(100 * time.Millisecond)
+			if !served(t, c).cert.Equal(initial.cert) {
+				t.Fatal("invalid certificate replaced the one in use")
+			}
+
+			// Fixing the files is picked up
+			fixed := validTestCertificate(t)
+			writePair(t, path, fixed.certPEM(), fixed.keyPEM(t))
+			waitServed(t, c, fixed)
+		})
+	}
+}
+
+func TestReloadPKCS12(t *testing.T) {
+	initial := validTestCertificate(t)
+	bundle := filepath.Join(t.TempDir(), "rp.p12")
+	initial.writePKCS12(t, bundle, TEST_PASSPHRASE, nil)
+	t.Setenv("TEST_BANKID_PASSPHRASE", TEST_PASSPHRASE)
+	config := &BankIDConfig{Env: TEST, Credentials: BankIDCredentials{
+		PKCS12:            bundle,
+		PassphraseEnv:     "TEST_BANKID_PASSPHRASE",
+		CACertificateFile: TEST_CA,
+		ReloadInterval:    10 * time.Millisecond,
+	}}
+	c, err := newRPCertificate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.watch()
+	defer c.close()
+
+	rotated := validTestCertificate(t)
+	rotated.writePKCS12(t, bundle, TEST_PASSPHRASE, nil)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(bundle, later, later); err != nil {
+		t.Fatal(err)
+	}
+	waitServed(t, c, rotated)
+
+	rp := &BankIDRP{Config: config, certificate: c}
+	if !rp.Certificate().Equal(rotated.cert) {
+		t.Error("RP does not report the reloaded certificate")
+	}
+	if days, ok := rp.DaysUntilExpiry(); !ok || days != 364 {
+		t.Errorf("expires in %d days, want 364", days)
+	}
+}
+
+func TestDaysUntilExpiry(t *testing.T) {
+	if _, ok := (&BankIDRP{}).DaysUntilExpiry(); ok {
+		t.Error("expiry known without a certificate")
+	}
+	tests := []struct {
+		notAfter time.Time
+		want     int
+	}{
+		{time.Now().Add(30*24*time.Hour + time.Hour), 30},
+		{time.Now().Add(30*24*time.Hour - time.Hour), 29},
+		{time.Now().Add(time.Hour), 0},
+		{time.Now().Add(-time.Hour), -1},
+	}
+	for _, test := range tests {
+		if got := daysUntil(test.notAfter); got != test.want {
+			t.Errorf("daysUntil(%s) = %d, want %d", test.notAfter.Format(time.DateTime), got, test.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package bankid
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Where the RP certificate used for mutual TLS with BankID comes from. Only
+// one source can be used: a PKCS#12 bundle (as issued by BankID), inline PEM
+// strings, or the legacy <certificateFolder><env>/ layout with cert.pem,
+// key.pem and ca-cert.pem.
+type BankIDCredentials struct {
+	PKCS12         string `yaml:"pkcs12"`
+	PassphraseEnv  string `yaml:"passphraseEnv"`
+	PassphraseFile string `yaml:"passphraseFile"`
+
+	CertificatePEM string `yaml:"certificatePem"`
+	KeyPEM         string `yaml:"keyPem"`
+
+	// CA of the BankID API TLS certificate, defaults to ca-cert.pem in certificateFolder
+	CACertificatePEM  string `yaml:"caCertificatePem"`
+	CACertificateFile string `yaml:"caCertificateFile"`
+
+	// How often the certificate files are checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+func (c *BankIDConfig) validateCredentials() error {
+	sources := 0
+	if c.Credentials.PKCS12 != "" {
+		sources++
+		if c.Credentials.PassphraseEnv != "" && c.Credentials.PassphraseFile != "" {
+			return errors.New("only one of 'passphraseEnv' and 'passphraseFile' can be set")
+		}
+	}
+	if c.Credentials.CertificatePEM != "" || c.Credentials.KeyPEM != "" {
+		sources++
+		if c.Credentials.CertificatePEM == "" || c.Credentials.KeyPEM == "" {
+			return errors.New("both 'certificatePem' and 'keyPem' are needed for inline credentials")
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of 'pkcs12' and inline PEM credentials can be set")
+	}
+	if sources == 0 && c.CertificateFolder == "" {
+		return errors.New("no RP certificate configured, set 'credentials' or 'certificateFolder'")
+	}
+	if c.Credentials.CACertificatePEM != "" && c.Credentials.CACertificateFile != "" {
+		return errors.New("only one of 'caCertificatePem' and 'caCertificateFile' can be set")
+	}
+	if c.Credentials.CACertificatePEM == "" && c.Credentials.CACertificateFile == "" && c.CertificateFolder == "" {
+		return errors.New("no BankID CA certificate configured, set 'caCertificatePem', 'caCertificateFile' or 'certificateFolder'")
+	}
+	return nil
+}
+
+func (c *BankIDConfig) getFolderPath() string {
+	return fmt.Sprintf("%s%s/", c.CertificateFolder, c.Env)
+}
+
+func loadCertificate(config *BankIDConfig) (tls.Certificate, error) {
+	credentials := config.Credentials
+	switch {
+	case credentials.PKCS12 != "":
+		return loadPKCS12(credentials)
+	case credentials.CertificatePEM != "":
+		cert, err := tls.X509KeyPair([]byte(credentials.CertificatePEM), []byte(credentials.KeyPEM))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("invalid inline RP certificate: %w", err)
+		}
+		return cert, nil
+	default:
+		path := config.getFolderPath()
+		return tls.LoadX509KeyPair(
+			path+"cert.pem",
+			path+"key.pem",
+		)
+	}
+}
+
+func loadPKCS12(credentials BankIDCredentials) (tls.Certificate, error) {
+	data, err := os.ReadFile(credentials.PKCS12)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not read PKCS#12 bundle: %w", err)
+	}
+	passphrase, err := credentials.getPassphrase()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, passphrase)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not decode PKCS#12 bundle %s: %w", credentials.PKCS12, err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, ca := range chain {
+		cert.Certificate = append(cert.Certificate, ca.Raw)
+	}
+	return cert, nil
+}
+
+func (c BankIDCredentials) getPassphrase() (string, error) {
+	switch {
+	case c.PassphraseEnv != "":
+		passphrase, ok := os.LookupEnv(c.PassphraseEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s with the PKCS#12 passphrase is not set", c.PassphraseEnv)
+		}
+		return passphrase, nil
+	case c.PassphraseFile != "":
+		passphrase, err := os.ReadFile(c.PassphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read PKCS#12 passphrase file: %w", err)
+		}
+		return strings.TrimRight(string(passphrase), "\r\n"), nil
+	default:
+		return "", nil
+	}
+}
+
+func loadCAPool(config *BankIDConfig) (*x509.CertPool, error) {
+	var caCert []byte
+	var err error
+	switch {
+	case config.Credentials.CACertificatePEM != "":
+		caCert = []byte(config.Credentials.CACertificatePEM)
+	case config.Credentials.CACertificateFile != "":
+		caCert, err = os.ReadFile(config.Credentials.CACertificateFile)
+	default:
+		caCert, err = os.ReadFile(config.getFolderPath() + "ca-cert.pem")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(caCert); block == nil {
+		return nil, errors.New("BankID CA certificate is not PEM encoded")
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("no valid certificate in BankID CA certificate")
+	}
+	return caCertPool, nil
+}
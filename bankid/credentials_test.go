@@ -0,0 +1,313 @@
+package bankid
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// BankID test RP certificate shipped in certificates/, which expired on
+// 2024-08-18
+const (
+	TEST_PKCS12     = "certificates/test.p12"
+	TEST_PASSPHRASE = "qwerty123"
+	TEST_CA         = "certificates/test/ca-cert.pem"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Self-signed RP certificate valid between the given times
+func newTestCertificate(t *testing.T, issuer string, notBefore, notAfter time.Time) testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "RP " + issuer},
+		Issuer:       pkix.Name{CommonName: issuer},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{cert: cert, key: key}
+}
+
+func validTestCertificate(t *testing.T) testCertificate {
+	return newTestCertificate(t, "Identity RP CA", time.Now().Add(-time.Hour), time.Now().Add(365*24*time.Hour))
+}
+
+func (c testCertificate) certPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+}
+
+func (c testCertificate) keyPEM(t *testing.T) string {
+	der, err := x509.MarshalPKCS8PrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// Writes the certificate as a PKCS#12 bundle, with the key of other when given
+func (c testCertificate) writePKCS12(t *testing.T, path, passphrase string, other *testCertificate) {
+	t.Helper()
+	key := c.key
+	if other != nil {
+		key = other.key
+	}
+	data, err := pkcs12.Modern.Encode(key, c.cert, nil, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		config BankIDConfig
+		error  string
+	}{
+		{name: "certificate folder", config: BankIDConfig{CertificateFolder: "certificates/"}},
+		{name: "PKCS#12", config: BankIDConfig{Credentials: BankIDCredentials{PKCS12: TEST_PKCS12, PassphraseEnv: "PASSPHRASE", CACertificateFile: TEST_CA}}},
+		{name: "inline PEM", config: BankIDConfig{Credentials: BankIDCredentials{CertificatePEM: "cert", KeyPEM: "key", CACertificatePEM: "ca"}}},
+		{
+			name:   "nothing",
+			config: BankIDConfig{},
+			error:  "no RP certificate configured",
+		},
+		{
+			name:   "two passphrases",
+			config: BankIDConfig{Credentials: BankIDCredentials{PKCS12: TEST_PKCS12, PassphraseEnv: "PASSPHRASE", PassphraseFile: "passphrase", CACertificateFile: TEST_CA}},
+			error:  "only one of 'passphraseEnv' and 'passphraseFile'",
+		},
+		{
+			name:   "certificate without key",
+			config: BankIDConfig{Credentials: BankIDCredentials{CertificatePEM: "cert", CACertificatePEM: "ca"}},
+			error:  "both 'certificatePem' and 'keyPem'",
+		},
+		{
+			name:   "key without certificate",
+			config: BankIDConfig{Credentials: BankIDCredentials{KeyPEM: "key", CACertificatePEM: "ca"}},
+			error:  "both 'certificatePem' and 'keyPem'",
+		},
+		{
+			name:   "PKCS#12 and PEM",
+			config: BankIDConfig{Credentials: BankIDCredentials{PKCS12: TEST_PKCS12, CertificatePEM: "cert", KeyPEM: "key", CACertificatePEM: "ca"}},
+			error:  "only one of 'pkcs12' and inline PEM",
+		},
+		{
+			name:   "two CAs",
+			config: BankIDConfig{Credentials: BankIDCredentials{PKCS12: TEST_PKCS12, CACertificatePEM: "ca", CACertificateFile: TEST_CA}},
+			error:  "only one of 'caCertificatePem' and 'caCertificateFile'",
+		},
+		{
+			name:   "no CA",
+			config: BankIDConfig{Credentials: BankIDCredentials{PKCS12: TEST_PKCS12}},
+			error:  "no BankID CA certificate configured",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.validateCredentials()
+			if test.error == "" && err != nil {
+				t.Errorf("valid credentials refused: %v", err)
+			}
+			if test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)) {
+				t.Errorf("got %v, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestLoadPKCS12(t *testing.T) {
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte(TEST_PASSPHRASE+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_BANKID_PASSPHRASE", TEST_PASSPHRASE)
+	for name, credentials := range map[string]BankIDCredentials{
+		"passphrase from the environment": {PKCS12: TEST_PKCS12, PassphraseEnv: "TEST_BANKID_PASSPHRASE"},
+		"passphrase from a file":          {PKCS12: TEST_PKCS12, PassphraseFile: passphraseFile},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cert, err := loadCertificate(&BankIDConfig{Credentials: credentials})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "FP Testcert 4" {
+				t.Fatalf("got leaf %v", cert.Leaf)
+			}
+			if len(cert.Certificate) < 1 || cert.PrivateKey == nil {
+				t.Errorf("got %d certificates and key %T", len(cert.Certificate), cert.PrivateKey)
+			}
+		})
+	}
+}
+
+func TestLoadPKCS12Invalid(t *testing.T) {
+	t.Setenv("TEST_BANKID_PASSPHRASE", "wrong")
+	tests := []struct {
+		name        string
+		credentials BankIDCredentials
+		error       string
+	}{
+		{"wrong passphrase", BankIDCredentials{PKCS12: TEST_PKCS12, PassphraseEnv: "TEST_BANKID_PASSPHRASE"}, "could not decode PKCS#12 bundle"},
+		{"no passphrase", BankIDCredentials{PKCS12: TEST_PKCS12}, "could not decode PKCS#12 bundle"},
+		{"passphrase not set", BankIDCredentials{PKCS12: TEST_PKCS12, PassphraseEnv: "TEST_BANKID_MISSING"}, "TEST_BANKID_MISSING"},
+		{"missing passphrase file", BankIDCredentials{PKCS12: TEST_PKCS12, PassphraseFile: "missing"}, "could not read PKCS#12 passphrase file"},
+		{"missing bundle", BankIDCredentials{PKCS12: "certificates/missing.p12"}, "could not read PKCS#12 bundle"},
+		{"not a bundle", BankIDCredentials{PKCS12: TEST_CA}, "could not decode PKCS#12 bundle"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadCertificate(&BankIDConfig{Credentials: test.credentials})
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+// The shipped test certificate expired, so it is refused in every form
+func TestExpiredCertificate(t *testing.T) {
+	t.Setenv("TEST_BANKID_PASSPHRASE", TEST_PASSPHRASE)
+	shipped, err := os.ReadFile("certificates/test/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shippedKey, err := os.ReadFile("certificates/test/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := newTestCertificate(t, "Identity RP CA", time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+	notYetValid := newTestCertificate(t, "Identity RP CA", time.Now().Add(24*time.Hour), time.Now().Add(48*time.Hour))
+
+	tests := []struct {
+		name   string
+		config BankIDConfig
+		error  string
+	}{
+		{
+			name:   "PKCS#12",
+			config: BankIDConfig{Env: TEST, Credentials: BankIDCredentials{PKCS12: TEST_PKCS12, PassphraseEnv: "TEST_BANKID_PASSPHRASE", CACertificateFile: TEST_CA}},
+			error:  "RP certificate for test expired on 2024-08-18",
+		},
+		{
+			name:   "certificate folder",
+			config: BankIDConfig{Env: TEST, CertificateFolder: "certificates/"},
+			error:  "RP certificate for test expired on 2024-08-18",
+		},
+		{
+			name:   "inline PEM",
+			config: BankIDConfig{Env: TEST, Credentials: BankIDCredentials{CertificatePEM: string(shipped), KeyPEM: string(shippedKey), CACertificateFile: TEST_CA}},
+			error:  "RP certificate for test expired on 2024-08-18",
+		},
+		{
+			name:   "expired yesterday",
+			config: BankIDConfig{Env: TEST, Credentials: BankIDCredentials{CertificatePEM: expired.certPEM(), KeyPEM: expired.keyPEM(t), CACertificateFile: TEST_CA}},
+			error:  "expired on",
+		},
+		{
+			name:   "not valid yet",
+			config: BankIDConfig{Env: TEST, Credentials: BankIDCredentials{CertificatePEM: notYetValid.certPEM(), KeyPEM: notYetValid.keyPEM(t), CACertificateFile: TEST_CA}},
+			error:  "is not valid before",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newRPCertificate(&test.config)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestCertificateKeyMismatch(t *testing.T) {
+	cert := validTestCertificate(t)
+	other := validTestCertificate(t)
+	bundle := filepath.Join(t.TempDir(), "rp.p12")
+	cert.writePKCS12(t, bundle, TEST_PASSPHRASE, &other)
+	t.Setenv("TEST_BANKID_PASSPHRASE", TEST_PASSPHRASE)
+
+	tests := []struct {
+		name   string
+		config BankIDConfig
+		error  string
+	}{
+		{
+			name:   "PKCS#12",
+			config: BankIDConfig{Env: TEST, Credentials: BankIDCredentials{PKCS12: bundle, PassphraseEnv: "TEST_BANKID_PASSPHRASE", CACertificateFile: TEST_CA}},
+			error:  "RP private key does not match the certificate",
+		},
+		{
+			name:   "inline PEM",
+			config: BankIDConfig{Env: TEST, Credentials: BankIDCredentials{CertificatePEM: cert.certPEM(), KeyPEM: other.keyPEM(t), CACertificateFile: TEST_CA}},
+			error:  "invalid inline RP certificate",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newRPCertificate(&test.config)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestValidCertificate(t *testing.T) {
+	cert := validTestCertificate(t)
+	bundle := filepath.Join(t.TempDir(), "rp.p12")
+	cert.writePKCS12(t, bundle, TEST_PASSPHRASE, nil)
+	t.Setenv("TEST_BANKID_PASSPHRASE", TEST_PASSPHRASE)
+	config := &BankIDConfig{Env: PRODUCTION, Credentials: BankIDCredentials{PKCS12: bundle, PassphraseEnv: "TEST_BANKID_PASSPHRASE", CACertificateFile: TEST_CA}}
+	rpCert, err := newRPCertificate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := rpCert.get(nil)
+	if err != nil || !got.Leaf.Equal(cert.cert) {
+		t.Errorf("got %v, want the certificate of the bundle: %v", got.Leaf, err)
+	}
+
+	// Test CA certificates are refused in production
+	testCA := newTestCertificate(t, "Testbank A RP CA v1 for BankID Test", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	config.Credentials = BankIDCredentials{CertificatePEM: testCA.certPEM(), KeyPEM: testCA.keyPEM(t), CACertificateFile: TEST_CA}
+	if _, err := newRPCertificate(config); err == nil || !strings.Contains(err.Error(), "is a test certificate") {
+		t.Errorf("got %v, want a test certificate refused in production", err)
+	}
+	config.Env = TEST
+	if _, err := newRPCertificate(config); err != nil {
+		t.Errorf("test certificate refused in test: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package bankid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Splinter0/identity/personnummer"
+)
+
+// https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/graenssnittsbeskrivning/felkoder
+
+type ErrorCode string
+
+const (
+	ALREADY_IN_PROGRESS    ErrorCode = "alreadyInProgress"
+	INVALID_PARAMETERS     ErrorCode = "invalidParameters"
+	UNAUTHORIZED           ErrorCode = "unauthorized"
+	NOT_FOUND              ErrorCode = "notFound"
+	METHOD_NOT_ALLOWED     ErrorCode = "methodNotAllowed"
+	REQUEST_TIMEOUT        ErrorCode = "requestTimeout"
+	UNSUPPORTED_MEDIA_TYPE ErrorCode = "unsupportedMediaType"
+	INTERNAL_ERROR         ErrorCode = "internalError"
+	MAINTENANCE            ErrorCode = "maintenance"
+)
+
+// BankIDError is returned by the RP client whenever BankID answers with
+// anything other than 200 OK.
+type BankIDError struct {
+	StatusCode int
+	ErrorCode  ErrorCode
+	Details    string
+}
+
+func (e *BankIDError) Error() string {
+	if e.Details == "" {
+		return fmt.Sprintf("bankid: %s (HTTP %d)", e.ErrorCode, e.StatusCode)
+	}
+	return fmt.Sprintf("bankid: %s (HTTP %d): %s", e.ErrorCode, e.StatusCode, e.Details)
+}
+
+// Message that can be shown to the end user, as mandated by the BankID guidelines.
+func (e *BankIDError) GetMessage() string {
+	return e.GetLocalizedMessage(DEFAULT_LANGUAGE)
+}
+
+func (e *BankIDError) GetLocalizedMessage(language Language) string {
+	switch e.ErrorCode {
+	case ALREADY_IN_PROGRESS:
+		return GetLocalizedMessage("RFA4", language)
+	case INTERNAL_ERROR, MAINTENANCE, REQUEST_TIMEOUT:
+		return GetLocalizedMessage("RFA5", language)
+	default:
+		return GetLocalizedMessage("RFA22", language)
+	}
+}
+
+// HTTP status code our own endpoints should answer with for this error.
+func (e *BankIDError) HTTPStatus() int {
+	switch e.ErrorCode {
+	case ALREADY_IN_PROGRESS:
+		return 409
+	case INVALID_PARAMETERS:
+		return 400
+	case MAINTENANCE:
+		return 503
+	case REQUEST_TIMEOUT:
+		return 504
+	default:
+		return 502
+	}
+}
+
+// Returns the user facing message for any error produced by this package.
+func GetErrorMessage(err error) string {
+	return GetLocalizedErrorMessage(err, DEFAULT_LANGUAGE)
+}
+
+func GetLocalizedErrorMessage(err error, language Language) string {
+	var bankIDErr *BankIDError
+	if errors.As(err, &bankIDErr) {
+		return bankIDErr.GetLocalizedMessage(language)
+	}
+	if errors.Is(err, personnummer.ErrInvalid) {
+		return GetLocalizedMessage("invalidPersonalNumber", language)
+	}
+	return GetLocalizedMessage("RFA5", language)
+}
+
+// Returns the HTTP status code to use for any error produced by this package.
+func GetErrorStatus(err error) int {
+	var bankIDErr *BankIDError
+	if errors.As(err, &bankIDErr) {
+		return bankIDErr.HTTPStatus()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 504
+	}
+	if errors.Is(err, personnummer.ErrInvalid) {
+		return 400
+	}
+	return 502
+}
@@ -0,0 +1,83 @@
+package bankid
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Final outcome of a transaction, given once to every listener
+type TransactionEvent struct {
+	OrderRef string
+	Type     OrderType
+	Flow     Flow
+	UserIp   string
+	// COMPLETE only once the completion data passed every check
+	Status   CollectStatus
+	HintCode HintCode
+	Reason   string
+	// Only set on completion
+	CompletionData *CollectCompletionData
+	StartedAt      time.Time
+	FinishedAt     time.Time
+}
+
+// Called when transactions complete, fail or are cancelled, from the
+// goroutine collecting the order so it should not block for long
+type Listener func(TransactionEvent)
+
+func (provider *BankIDProvider) AddListener(listener Listener) {
+	provider.listenersMutex.Lock()
+	defer provider.listenersMutex.Unlock()
+	provider.listeners = append(provider.listeners, listener)
+}
+
+// Records the outcome of the transaction, in the audit log and metrics, and
+// tells listeners about it, only the first time it is called for a
+// transaction
+func (provider *BankIDProvider) finish(ctx context.Context, transactionKey string) {
+	var transaction BankIDTransaction
+	first := false
+	updated, err := provider.Store.Update(ctx, transactionKey, func(t *BankIDTransaction) {
+		first = !t.Finished
+		t.Finished = true
+		transaction = *t
+	})
+	if err != nil {
+		log.Printf("Could not finish BankID transaction: %v", err)
+		return
+	}
+	if !updated || !first {
+		return
+	}
+	// Same checks as when the client asks for the status
+	provider.finished(ctx, transaction, provider.transactionStatus(transactionKey, transaction, DEFAULT_LANGUAGE))
+}
+
+func (provider *BankIDProvider) finished(ctx context.Context, transaction BankIDTransaction, status BankIDStatusResponse) {
+	event := TransactionEvent{
+		OrderRef:   transaction.OrderRef,
+		Type:       transaction.Type,
+		Flow:       transaction.Flow,
+		UserIp:     transaction.UserIp,
+		Status:     status.Status,
+		HintCode:   status.HintCode,
+		Reason:     status.Reason,
+		StartedAt:  transaction.StartedAt,
+		FinishedAt: time.Now(),
+	}
+	if status.Status == COMPLETE {
+		event.CompletionData = &transaction.Collect.CompletionData
+	}
+	// Cancelled orders were recorded as such when cancelled
+	if !transaction.Cancelled {
+		provider.recordFinished(ctx, transaction, status)
+	}
+	observeFinished(transaction, status, event.FinishedAt)
+
+	provider.listenersMutex.RLock()
+	defer provider.listenersMutex.RUnlock()
+	for _, listener := range provider.listeners {
+		listener(event)
+	}
+}
@@ -1,24 +1,114 @@
 package bankid
 
-var messages = map[string]string{
-	"RFA1":  "Start your BankID app.",
-	"RFA3":  "Action cancelled. Please try again.",
-	"RFA4":  "An identification or signing for this personal number is already started. Please try again.",
-	"RFA5":  "Internal error. Please try again.",
-	"RFA6":  "Action cancelled.",
-	"RFA8":  "The BankID app is not responding. Please check that it's started and that you have internet access. If you don't have a valid BankID you can get one from your bank. Try again.",
-	"RFA9":  "Enter your security code in the BankID app and select Identify or Sign.",
-	"RFA13": "Trying to start your BankID app.",
-	"RFA14": "Searching for BankID, it may take a little while... If a few seconds have passed and still no BankID has been found, you probably don't have a BankID which can be used for this identification/signing on this computer. If you have a BankID card, please insert it into your card reader. If you don't have a BankID you can get one from your bank. If you have a BankID on another device you can start the BankID app on that device.",
-	"RFA15": "Searching for BankID:s, it may take a little while... If a few seconds have passed and still no BankID has been found, you probably don't have a BankID which can be used for this identification/signing on this computer. If you have a BankID card, please insert it into your card reader. If you don't have a BankID you can get one from your bank.",
-	"RFA16": "The BankID you are trying to use is blocked or too old. Please use another BankID or get a new one from your bank.",
-	"RFA17": "The BankID app couldn't be found on your computer or mobile device. Please install it and get a BankID from your bank. Install the app from your app store or https://install.bankid.com.",
-	"RFA18": "Start the BankID app.",
-	"RFA19": "Would you like to identify yourself or sign with a BankID on this computer, or with a Mobile BankID?",
-	"RFA20": "Would you like to identify yourself or sign with a BankID on this computer, or with a BankID on another device?",
-	"RFA21": "Identification or signing in progress.",
-	"RFA22": "Unknown error. Please try again.",
-	"RFA23": "Process your machine-readable travel document using the BankID app.",
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Recommended user messages (RFA) from the BankID guidelines
+// https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/rekommenderade-anvandarmeddelanden
+
+type Language string
+
+const (
+	ENGLISH Language = "en"
+	SWEDISH Language = "sv"
+)
+
+const DEFAULT_LANGUAGE = ENGLISH
+
+var messages = map[Language]map[string]string{
+	ENGLISH: {
+		"RFA1":   "Start your BankID app.",
+		"RFA2":   "The BankID app is not installed. Please contact your bank.",
+		"RFA3":   "Action cancelled. Please try again.",
+		"RFA4":   "An identification or signing for this personal number is already started. Please try again.",
+		"RFA5":   "Internal error. Please try again.",
+		"RFA6":   "Action cancelled.",
+		"RFA8":   "The BankID app is not responding. Please check that it's started and that you have internet access. If you don't have a valid BankID you can get one from your bank. Try again.",
+		"RFA9":   "Enter your security code in the BankID app and select Identify or Sign.",
+		"RFA13":  "Trying to start your BankID app.",
+		"RFA14A": "Searching for BankID, it may take a little while... If a few seconds have passed and still no BankID has been found, you probably don't have a BankID which can be used for this identification/signing on this computer. If you have a BankID card, please insert it into your card reader. If you don't have a BankID you can get one from your bank. If you have a BankID on another device you can start the BankID app on that device.",
+		"RFA14B": "Searching for BankID, it may take a little while... If a few seconds have passed and still no BankID has been found, you probably don't have a BankID which can be used for this identification/signing on this device. If you don't have a BankID you can get one from your bank. If you have a BankID on another device you can start the BankID app on that device.",
+		"RFA15A": "Searching for BankID:s, it may take a little while... If a few seconds have passed and still no BankID has been found, you probably don't have a BankID which can be used for this identification/signing on this computer. If you have a BankID card, please insert it into your card reader. If you don't have a BankID you can get one from your bank.",
+		"RFA15B": "Searching for BankID, it may take a little while... If a few seconds have passed and still no BankID has been found, you probably don't have a BankID which can be used for this identification/signing on this device. If you don't have a BankID you can get one from your bank.",
+		"RFA16":  "The BankID you are trying to use is blocked or too old. Please use another BankID or get a new one from your bank.",
+		"RFA17A": "The BankID app couldn't be found on your computer or mobile device. Please install it and get a BankID from your bank. Install the app from your app store or https://install.bankid.com.",
+		"RFA17B": "Failed to scan the QR code. Start the BankID app and scan the QR code. Check that the BankID app is up to date. If you don't have the BankID app, you need to install it and get a BankID from your bank. Install the app from your app store or https://install.bankid.com.",
+		"RFA18":  "Start the BankID app.",
+		"RFA19":  "Would you like to identify yourself or sign with a BankID on this computer, or with a Mobile BankID?",
+		"RFA20":  "Would you like to identify yourself or sign with a BankID on this device, or with a BankID on another device?",
+		"RFA21":  "Identification or signing in progress.",
+		"RFA22":  "Unknown error. Please try again.",
+		"RFA23":  "Process your machine-readable travel document using the BankID app.",
+
+		// Not part of the guidelines, which have no messages for the phone
+		// hint codes userCallConfirm and userDeclinedCall either
+		"callConfirm":           "Confirm in the BankID app that you are on a call with us.",
+		"callDeclined":          "You declined the call in the BankID app.",
+		"complete":              "Success!",
+		"transactionExpired":    "Transaction expired",
+		"transactionNotStarted": "Transaction not started",
+		"notFound":              "Transaction not found",
+		"unexpectedStatus":      "Authentication failed",
+		"otherDevice":           "BankID transaction was not completed using the same device",
+		"otherBrowser":          "Open this page in the browser where you started, or start again",
+		"consumed":              "This transaction was already completed, start again",
+		"invalidSignature":      "The BankID signature could not be verified",
+		"invalidOCSP":           "The status of the BankID certificate could not be verified",
+		"riskRejected":          "The BankID transaction was rejected",
+		"invalidPersonalNumber": "Invalid personal identity number",
+	},
+	SWEDISH: {
+		"RFA1":   "Starta BankID-appen.",
+		"RFA2":   "Du har inte BankID-appen installerad. Kontakta din bank.",
+		"RFA3":   "Åtgärden avbruten. Försök igen.",
+		"RFA4":   "En identifiering eller underskrift för det här personnumret är redan påbörjad. Försök igen.",
+		"RFA5":   "Internt tekniskt fel. Försök igen.",
+		"RFA6":   "Åtgärden avbruten.",
+		"RFA8":   "BankID-appen svarar inte. Kontrollera att den är startad och att du har internetanslutning. Om du inte har något giltigt BankID kan du skaffa ett hos din bank. Försök sedan igen.",
+		"RFA9":   "Skriv in din säkerhetskod i BankID-appen och välj Identifiera eller Skriv under.",
+		"RFA13":  "Försöker starta BankID-appen.",
+		"RFA14A": "Söker efter BankID, det kan ta en liten stund... Om det har gått några sekunder och inget BankID har hittats har du sannolikt inget BankID som går att använda för den aktuella identifieringen/underskriften i den här datorn. Om du har ett BankID-kort, sätt in det i kortläsaren. Om du inte har något BankID kan du skaffa ett hos din bank. Om du har ett BankID på en annan enhet kan du starta din BankID-app där.",
+		"RFA14B": "Söker efter BankID, det kan ta en liten stund... Om det har gått några sekunder och inget BankID har hittats har du sannolikt inget BankID som går att använda för den aktuella identifieringen/underskriften i den här enheten. Om du inte har något BankID kan du skaffa ett hos din bank. Om du har ett BankID på en annan enhet kan du starta din BankID-app där.",
+		"RFA15A": "Söker efter BankID, det kan ta en liten stund... Om det har gått några sekunder och inget BankID har hittats har du sannolikt inget BankID som går att använda för den aktuella identifieringen/underskriften i den här datorn. Om du har ett BankID-kort, sätt in det i kortläsaren. Om du inte har något BankID kan du skaffa ett hos din bank.",
+		"RFA15B": "Söker efter BankID, det kan ta en liten stund... Om det har gått några sekunder och inget BankID har hittats har du sannolikt inget BankID som går att använda för den aktuella identifieringen/underskriften i den här enheten. Om du inte har något BankID kan du skaffa ett hos din bank.",
+		"RFA16":  "Det BankID du försöker använda är för gammalt eller spärrat. Använd ett annat BankID eller skaffa ett nytt hos din bank.",
+		"RFA17A": "BankID-appen verkar inte finnas i din dator eller mobil. Installera den och skaffa ett BankID hos din bank. Installera appen från din appbutik eller https://install.bankid.com.",
+		"RFA17B": "Misslyckades att läsa av QR-koden. Starta BankID-appen och läs av QR-koden. Kontrollera att BankID-appen är uppdaterad. Om du inte har BankID-appen måste du installera den och skaffa ett BankID hos din bank. Installera appen från din appbutik eller https://install.bankid.com.",
+		"RFA18":  "Starta BankID-appen.",
+		"RFA19":  "Vill du identifiera dig eller skriva under med BankID på den här datorn eller med ett Mobilt BankID?",
+		"RFA20":  "Vill du identifiera dig eller skriva under med ett BankID på den här enheten eller med ett BankID på en annan enhet?",
+		"RFA21":  "Identifiering eller underskrift pågår.",
+		"RFA22":  "Okänt fel. Försök igen.",
+		"RFA23":  "Fotografera och läs av din ID-handling med BankID-appen.",
+
+		"callConfirm":           "Bekräfta i BankID-appen att du pratar med oss i telefon.",
+		"callDeclined":          "Du nekade samtalet i BankID-appen.",
+		"complete":              "Klart!",
+		"transactionExpired":    "Transaktionen har gått ut",
+		"transactionNotStarted": "Transaktionen har inte startats",
+		"notFound":              "Transaktionen hittades inte",
+		"unexpectedStatus":      "Identifieringen misslyckades",
+		"otherDevice":           "BankID-transaktionen slutfördes inte på samma enhet",
+		"otherBrowser":          "Öppna sidan i webbläsaren där du började, eller börja om",
+		"consumed":              "Transaktionen är redan slutförd, börja om",
+		"invalidSignature":      "BankID-underskriften kunde inte verifieras",
+		"invalidOCSP":           "Statusen för BankID-certifikatet kunde inte verifieras",
+		"riskRejected":          "BankID-transaktionen nekades",
+		"invalidPersonalNumber": "Ogiltigt personnummer",
+	},
+}
+
+// Message for the key in the language, in the default language when the
+// language is not supported
+func GetLocalizedMessage(key string, language Language) string {
+	catalogue, ok := messages[language]
+	if !ok {
+		catalogue = messages[DEFAULT_LANGUAGE]
+	}
+	return catalogue[key]
 }
 
 type HintCode string
@@ -39,29 +129,112 @@ const (
 	USER_DECLINED_CALL      HintCode = "userDeclinedCall"
 )
 
+// Key of the message to show for a collect response, following the BankID
+// guidelines for the flow the order was started with
+func GetMessageKey(status CollectStatus, hintCode HintCode, flow Flow) string {
+	autoStart := flow.SameDevice()
+	// Variant A is for computers, B for mobile devices
+	variant := "A"
+	if flow == FLOW_SAME_DEVICE_MOBILE {
+		variant = "B"
+	}
+	switch status {
+	case COMPLETE:
+		return "complete"
+	case PENDING:
+		switch hintCode {
+		case OUTSTANDING_TRANSACTION:
+			if autoStart {
+				return "RFA13"
+			}
+			return "RFA1"
+		case NO_CLIENT:
+			return "RFA1"
+		case STARTED:
+			if flow == FLOW_PHONE {
+				return "RFA21"
+			}
+			if autoStart {
+				return "RFA15" + variant
+			}
+			return "RFA14" + variant
+		case USER_MRTD:
+			return "RFA23"
+		case USER_CALL_CONFRIRM:
+			// Local message, there is no RFA for it
+			return "callConfirm"
+		case USER_SIGN:
+			return "RFA9"
+		default:
+			return "RFA21"
+		}
+	case FAILED:
+		switch hintCode {
+		case EXPIRED_TRANSACTION:
+			return "RFA8"
+		case CERTIFICATE_ERR:
+			return "RFA16"
+		case USER_CANCEL:
+			return "RFA6"
+		case CANCELLED:
+			return "RFA3"
+		case START_FAILED:
+			if flow == FLOW_QR {
+				return "RFA17B"
+			}
+			return "RFA17A"
+		case USER_DECLINED_CALL:
+			// Local message, there is no RFA for it
+			return "callDeclined"
+		}
+	}
+	return "RFA22"
+}
+
+// Message to show the user for a collect response
+func ResolveMessage(status CollectStatus, hintCode HintCode, flow Flow, language Language) string {
+	return GetLocalizedMessage(GetMessageKey(status, hintCode, flow), language)
+}
+
+// Deprecated: does not follow the guidelines for all flows, use ResolveMessage.
 func (hc HintCode) GetMessage() string {
+	status := PENDING
 	switch hc {
-	case OUTSTANDING_TRANSACTION:
-		return messages["RFA13"]
-	case NO_CLIENT:
-		return messages["RFA1"]
-	case STARTED:
-		return messages["RFA15"]
-	case USER_MRTD:
-		return messages["RFA23"]
-	case USER_SIGN:
-		return messages["RFA9"]
-	case EXPIRED_TRANSACTION:
-		return messages["RFA8"]
-	case CERTIFICATE_ERR:
-		return messages["RFA16"]
-	case USER_CANCEL:
-		return messages["RFA6"]
-	case CANCELLED:
-		return messages["RFA3"]
-	case START_FAILED:
-		return messages["RFA17"]
-	default:
-		return messages["RFA22"]
+	case EXPIRED_TRANSACTION, CERTIFICATE_ERR, USER_CANCEL, CANCELLED, START_FAILED, USER_DECLINED_CALL:
+		status = FAILED
+	}
+	return ResolveMessage(status, hc, FLOW_SAME_DEVICE_DESKTOP, ENGLISH)
+}
+
+// Picks the supported language the user prefers the most from an
+// Accept-Language header, fallback when none is supported
+func ParseAcceptLanguage(header string, fallback Language) Language {
+	type candidate struct {
+		language Language
+		quality  float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+		if _, ok := messages[Language(primary)]; ok && quality > 0 {
+			candidates = append(candidates, candidate{Language(primary), quality})
+		}
+	}
+	if len(candidates) == 0 {
+		if fallback == "" {
+			return DEFAULT_LANGUAGE
+		}
+		return fallback
 	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].language
 }
@@ -0,0 +1,125 @@
+package bankid
+
+import "testing"
+
+var allFlows = []Flow{FLOW_QR, FLOW_SAME_DEVICE_DESKTOP, FLOW_SAME_DEVICE_MOBILE, FLOW_PHONE}
+
+func TestGetMessageKey(t *testing.T) {
+	// Keys for the QR, same device desktop, same device mobile and phone allFlows
+	tests := []struct {
+		status   CollectStatus
+		hintCode HintCode
+		want     [4]string
+	}{
+		{PENDING, OUTSTANDING_TRANSACTION, [4]string{"RFA1", "RFA13", "RFA13", "RFA1"}},
+		{PENDING, NO_CLIENT, [4]string{"RFA1", "RFA1", "RFA1", "RFA1"}},
+		{PENDING, STARTED, [4]string{"RFA14A", "RFA15A", "RFA15B", "RFA21"}},
+		{PENDING, USER_MRTD, [4]string{"RFA23", "RFA23", "RFA23", "RFA23"}},
+		{PENDING, USER_CALL_CONFRIRM, [4]string{"callConfirm", "callConfirm", "callConfirm", "callConfirm"}},
+		{PENDING, USER_SIGN, [4]string{"RFA9", "RFA9", "RFA9", "RFA9"}},
+		{PENDING, UNKNOWN, [4]string{"RFA21", "RFA21", "RFA21", "RFA21"}},
+		{PENDING, "somethingNew", [4]string{"RFA21", "RFA21", "RFA21", "RFA21"}},
+		{FAILED, EXPIRED_TRANSACTION, [4]string{"RFA8", "RFA8", "RFA8", "RFA8"}},
+		{FAILED, CERTIFICATE_ERR, [4]string{"RFA16", "RFA16", "RFA16", "RFA16"}},
+		{FAILED, USER_CANCEL, [4]string{"RFA6", "RFA6", "RFA6", "RFA6"}},
+		{FAILED, CANCELLED, [4]string{"RFA3", "RFA3", "RFA3", "RFA3"}},
+		{FAILED, START_FAILED, [4]string{"RFA17B", "RFA17A", "RFA17A", "RFA17A"}},
+		{FAILED, USER_DECLINED_CALL, [4]string{"callDeclined", "callDeclined", "callDeclined", "callDeclined"}},
+		{FAILED, "somethingNew", [4]string{"RFA22", "RFA22", "RFA22", "RFA22"}},
+		{COMPLETE, "", [4]string{"complete", "complete", "complete", "complete"}},
+		{"unknownStatus", "", [4]string{"RFA22", "RFA22", "RFA22", "RFA22"}},
+	}
+	for _, test := range tests {
+		for i, flow := range allFlows {
+			if got := GetMessageKey(test.status, test.hintCode, flow); got != test.want[i] {
+				t.Errorf("GetMessageKey(%s, %s, %s) = %q, want %q", test.status, test.hintCode, flow, got, test.want[i])
+			}
+		}
+	}
+}
+
+// Every key shown to the user has a message in every language
+func TestMessagesComplete(t *testing.T) {
+	hintCodes := []HintCode{
+		UNKNOWN, OUTSTANDING_TRANSACTION, NO_CLIENT, STARTED, USER_MRTD, USER_CALL_CONFRIRM, USER_SIGN,
+		EXPIRED_TRANSACTION, CERTIFICATE_ERR, USER_CANCEL, CANCELLED, START_FAILED, USER_DECLINED_CALL,
+	}
+	for _, status := range []CollectStatus{PENDING, FAILED, COMPLETE} {
+		for _, hintCode := range hintCodes {
+			for _, flow := range allFlows {
+				key := GetMessageKey(status, hintCode, flow)
+				for language := range messages {
+					if messages[language][key] == "" {
+						t.Errorf("no %s message for %s", language, key)
+					}
+				}
+			}
+		}
+	}
+	for language, catalogue := range messages {
+		for key := range messages[DEFAULT_LANGUAGE] {
+			if catalogue[key] == "" {
+				t.Errorf("no %s message for %s", language, key)
+			}
+		}
+	}
+}
+
+func TestResolveMessage(t *testing.T) {
+	english := ResolveMessage(FAILED, USER_CANCEL, FLOW_QR, ENGLISH)
+	if english != "Action cancelled." {
+		t.Errorf("got %q", english)
+	}
+	swedish := ResolveMessage(FAILED, USER_CANCEL, FLOW_QR, SWEDISH)
+	if swedish == "" || swedish == english {
+		t.Errorf("got %q in Swedish", swedish)
+	}
+	for _, language := range []Language{"de", "", "EN"} {
+		if got := ResolveMessage(FAILED, USER_CANCEL, FLOW_QR, language); got != english {
+			t.Errorf("got %q for %q, want the default language", got, language)
+		}
+	}
+	if got := ResolveMessage(PENDING, OUTSTANDING_TRANSACTION, FLOW_SAME_DEVICE_MOBILE, ENGLISH); got != GetLocalizedMessage("RFA13", ENGLISH) {
+		t.Errorf("got %q, want RFA13", got)
+	}
+	if got := GetLocalizedMessage("missing", ENGLISH); got != "" {
+		t.Errorf("got %q for an unknown key", got)
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header   string
+		fallback Language
+		want     Language
+	}{
+		{"sv", ENGLISH, SWEDISH},
+		{"en", SWEDISH, ENGLISH},
+		{"sv-SE", ENGLISH, SWEDISH},
+		{"SV-se", ENGLISH, SWEDISH},
+		{"en-GB,en;q=0.9", SWEDISH, ENGLISH},
+		{"sv-SE,sv;q=0.9,en-US;q=0.8,en;q=0.7", ENGLISH, SWEDISH},
+		{"en;q=0.5,sv;q=0.8", ENGLISH, SWEDISH},
+		{"en;q=0.8, sv;q=0.5", SWEDISH, ENGLISH},
+		{" sv ; q=0.3 , en ; q=0.2 ", ENGLISH, SWEDISH},
+		// Unsupported languages are skipped
+		{"de-DE,de;q=0.9,sv;q=0.1", ENGLISH, SWEDISH},
+		{"fr,de", SWEDISH, SWEDISH},
+		// Refused with q=0
+		{"sv;q=0,en;q=0.1", SWEDISH, ENGLISH},
+		{"sv;q=0", ENGLISH, ENGLISH},
+		// Same quality keeps the order of the header
+		{"sv,en", ENGLISH, SWEDISH},
+		{"en,sv", SWEDISH, ENGLISH},
+		{"*", SWEDISH, SWEDISH},
+		{"", SWEDISH, SWEDISH},
+		{"", "", DEFAULT_LANGUAGE},
+		{"de", "", DEFAULT_LANGUAGE},
+		{"sv;q=invalid", ENGLISH, SWEDISH},
+	}
+	for _, test := range tests {
+		if got := ParseAcceptLanguage(test.header, test.fallback); got != test.want {
+			t.Errorf("ParseAcceptLanguage(%q, %q) = %q, want %q", test.header, test.fallback, got, test.want)
+		}
+	}
+}
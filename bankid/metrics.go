@@ -0,0 +1,57 @@
+package bankid
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Splinter0/identity/metrics"
+)
+
+func (b *BankIDRP) observe(url string, start time.Time, err error) {
+	endpoint := strings.TrimPrefix(url, b.buildUrl(""))
+	metrics.RPRequestDuration.WithLabelValues("bankid", endpoint, errorCode(err)).Observe(time.Since(start).Seconds())
+}
+
+func errorCode(err error) string {
+	var bankIDErr *BankIDError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &bankIDErr):
+		return string(bankIDErr.ErrorCode)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "network"
+	}
+}
+
+func observeFinished(transaction BankIDTransaction, status BankIDStatusResponse, finishedAt time.Time) {
+	flow := string(transaction.Flow)
+	outcome := string(status.Status)
+	switch {
+	case status.Status == COMPLETE:
+		metrics.TransactionsCompleted.WithLabelValues("bankid", flow).Inc()
+	case status.Reason == "cancelled":
+		outcome = "cancelled"
+		metrics.TransactionsCancelled.WithLabelValues("bankid", flow).Inc()
+	default:
+		metrics.TransactionsFailed.WithLabelValues("bankid", flow, string(status.HintCode), status.Reason).Inc()
+	}
+	metrics.TransactionDuration.WithLabelValues("bankid", flow, outcome).Observe(finishedAt.Sub(transaction.StartedAt).Seconds())
+}
+
+// Reports the ongoing transactions of the store and the expiry of the RP
+// certificate in the metrics
+func (provider *BankIDProvider) RegisterMetrics() {
+	metrics.SetActiveTransactions("bankid", provider.Store.Ongoing)
+	metrics.SetCertificateExpiry("bankid", func() (time.Time, bool) {
+		cert := provider.Client.Certificate()
+		if cert == nil {
+			return time.Time{}, false
+		}
+		return cert.NotAfter, true
+	})
+}
@@ -1,5 +1,7 @@
 package bankid
 
+import "github.com/Splinter0/identity/personnummer"
+
 // https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/graenssnittsbeskrivning/auth
 
 // Requests
@@ -10,6 +12,26 @@ type AuthRequest struct {
 	UserNonVisibleData    string                   `json:"userNonVisibleData,omitempty"`
 	UserVisibleDataFormat string                   `json:"userVisibleDataFormat,omitempty"`
 	Requirement           *AuthRequestRequirements `json:"requirement,omitempty"`
+	ReturnUrl             string                   `json:"returnUrl,omitempty"`
+	ReturnRisk            bool                     `json:"returnRisk,omitempty"`
+	App                   *AppDevice               `json:"app,omitempty"`
+	Web                   *WebDevice               `json:"web,omitempty"`
+}
+
+// Information about the device of the user, only one of app and web can be
+// given. Used by BankID to detect fraud.
+
+type AppDevice struct {
+	AppIdentifier    string `json:"appIdentifier"`
+	DeviceOS         string `json:"deviceOS"`
+	DeviceModelName  string `json:"deviceModelName"`
+	DeviceIdentifier string `json:"deviceIdentifier"`
+}
+
+type WebDevice struct {
+	ReferringDomain  string `json:"referringDomain"`
+	UserAgent        string `json:"userAgent"`
+	DeviceIdentifier string `json:"deviceIdentifier"`
 }
 
 type CardReaderClass string
@@ -61,6 +83,31 @@ type PhoneAuthRequest struct {
 	UserNonVisibleData    string                   `json:"userNonVisibleData,omitempty"`
 	UserVisibleDataFormat string                   `json:"userVisibleDataFormat,omitempty"`
 	Requirements          *AuthRequestRequirements `json:"requirement,omitempty"`
+	ReturnRisk            bool                     `json:"returnRisk,omitempty"`
+}
+
+// https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/graenssnittsbeskrivning/sign
+
+type SignRequest struct {
+	EndUserIp             string                   `json:"endUserIp"`
+	UserVisibleData       string                   `json:"userVisibleData"`
+	UserNonVisibleData    string                   `json:"userNonVisibleData,omitempty"`
+	UserVisibleDataFormat string                   `json:"userVisibleDataFormat,omitempty"`
+	Requirement           *AuthRequestRequirements `json:"requirement,omitempty"`
+	ReturnUrl             string                   `json:"returnUrl,omitempty"`
+	ReturnRisk            bool                     `json:"returnRisk,omitempty"`
+	App                   *AppDevice               `json:"app,omitempty"`
+	Web                   *WebDevice               `json:"web,omitempty"`
+}
+
+type PhoneSignRequest struct {
+	PersonalNumber        string                   `json:"personalNumber"`
+	CallInitiator         CallInitiator            `json:"callInitiator"`
+	UserVisibleData       string                   `json:"userVisibleData"`
+	UserNonVisibleData    string                   `json:"userNonVisibleData,omitempty"`
+	UserVisibleDataFormat string                   `json:"userVisibleDataFormat,omitempty"`
+	Requirements          *AuthRequestRequirements `json:"requirement,omitempty"`
+	ReturnRisk            bool                     `json:"returnRisk,omitempty"`
 }
 
 type OrderRequest struct {
@@ -109,6 +156,7 @@ type CollectCompletionData struct {
 	StepUp          CompletionDataStepUp `json:"stepUp"`
 	Signature       string               `json:"signature"`
 	OcspResponse    string               `json:"ocspResponse"`
+	Risk            RiskLevel            `json:"risk,omitempty"`
 }
 
 type CompletionDataUser struct {
@@ -118,6 +166,10 @@ type CompletionDataUser struct {
 	Surname        string `json:"surname"`
 }
 
+func (u CompletionDataUser) Personnummer() (personnummer.Personnummer, error) {
+	return personnummer.Parse(u.PersonalNumber)
+}
+
 type CompletionDataDevice struct {
 	IpAddress string `json:"ipAddress"`
 	UHI       string `json:"uhi"`
@@ -0,0 +1,106 @@
+package bankid
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Validation of the OCSP response found in CollectCompletionData.OcspResponse,
+// which proves the signer certificate was valid when the order completed.
+
+var ErrInvalidOCSPResponse = errors.New("bankid: invalid OCSP response")
+
+const DEFAULT_OCSP_MAX_AGE = 5 * time.Minute
+
+type OCSPStatus string
+
+const (
+	OCSP_GOOD    OCSPStatus = "good"
+	OCSP_REVOKED OCSPStatus = "revoked"
+	OCSP_UNKNOWN OCSPStatus = "unknown"
+)
+
+// Parsed OCSP response, meant to be stored alongside the signature for audit
+type OCSPResult struct {
+	ProducedAt   time.Time  `json:"producedAt"`
+	ThisUpdate   time.Time  `json:"thisUpdate"`
+	SerialNumber *big.Int   `json:"serialNumber"`
+	Status       OCSPStatus `json:"status"`
+}
+
+// Validates the base64 encoded OCSP response against a signature that was
+// already verified, so that the signer and its issuer are trusted.
+func (v *SignatureVerifier) VerifyOCSP(ocspResponse string, signature *VerifiedSignature, maxAge time.Duration) (*OCSPResult, error) {
+	if len(signature.Chain) < 2 {
+		return nil, ocspError("no issuer for the signer certificate")
+	}
+	if maxAge <= 0 {
+		maxAge = DEFAULT_OCSP_MAX_AGE
+	}
+	der, err := base64.StdEncoding.DecodeString(ocspResponse)
+	if err != nil {
+		return nil, ocspError("response is not valid base64: %v", err)
+	}
+	signer, issuer := signature.Chain[0], signature.Chain[1]
+	// Checks the responder signature and that the response is about the signer
+	resp, err := ocsp.ParseResponseForCert(der, signer, issuer)
+	if err != nil {
+		return nil, ocspError("%v", err)
+	}
+	if resp.Certificate != nil && !hasExtKeyUsage(resp.Certificate, x509.ExtKeyUsageOCSPSigning) {
+		return nil, ocspError("responder certificate is not authorised for OCSP signing")
+	}
+
+	result := &OCSPResult{
+		ProducedAt:   resp.ProducedAt,
+		ThisUpdate:   resp.ThisUpdate,
+		SerialNumber: resp.SerialNumber,
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		result.Status = OCSP_GOOD
+	case ocsp.Revoked:
+		result.Status = OCSP_REVOKED
+	default:
+		result.Status = OCSP_UNKNOWN
+	}
+	if result.Status != OCSP_GOOD {
+		return result, ocspError("signer certificate status is %s", result.Status)
+	}
+
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	// Allow a bit of clock skew with the responder
+	if resp.ProducedAt.After(now().Add(time.Minute)) {
+		return result, ocspError("response is produced in the future (%s)", resp.ProducedAt)
+	}
+	if now().Sub(resp.ProducedAt) > maxAge {
+		return result, ocspError("response is too old, produced at %s", resp.ProducedAt)
+	}
+	if !resp.NextUpdate.IsZero() && now().After(resp.NextUpdate) {
+		return result, ocspError("response expired at %s", resp.NextUpdate)
+	}
+
+	return result, nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func ocspError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOCSPResponse, fmt.Sprintf(format, args...))
+}
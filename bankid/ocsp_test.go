@@ -0,0 +1,138 @@
+package bankid_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/bankid/simulator"
+)
+
+// Signature of a completed order, verified so its OCSP response can be
+func verifiedSign(t *testing.T, config simulator.Config) (bankid.CollectCompletionData, *bankid.SignatureVerifier, *bankid.VerifiedSignature) {
+	t.Helper()
+	completionData, verifier := completedSign(t, config)
+	signature, err := verifier.Verify(completionData.Signature, bankid.ExpectedSignedData{UserVisibleData: encode(signedText)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return completionData, verifier, signature
+}
+
+func TestVerifyOCSP(t *testing.T) {
+	completionData, verifier, signature := verifiedSign(t, simulator.Config{})
+
+	result, err := verifier.VerifyOCSP(completionData.OcspResponse, signature, 0)
+	if err != nil {
+		t.Fatalf("valid OCSP response: %v", err)
+	}
+	if result.Status != bankid.OCSP_GOOD {
+		t.Errorf("status %s, want good", result.Status)
+	}
+	if result.SerialNumber.Cmp(signature.SignerCertificate.SerialNumber) != 0 {
+		t.Errorf("response is about certificate %s, want the signer", result.SerialNumber)
+	}
+}
+
+func TestVerifyOCSPInvalid(t *testing.T) {
+	completionData, verifier, signature := verifiedSign(t, simulator.Config{})
+	otherData, _, _ := verifiedSign(t, simulator.Config{})
+	users := []simulator.User{{PersonalNumber: "199001012385", GivenName: "Revoked", Surname: "Revokedsson", Revoked: true}}
+	revokedData, revokedVerifier, revokedSignature := verifiedSign(t, simulator.Config{Users: users})
+
+	der, err := base64.StdEncoding.DecodeString(completionData.OcspResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der[len(der)-1] ^= 0xff
+	tampered := base64.StdEncoding.EncodeToString(der)
+
+	tests := []struct {
+		name      string
+		response  string
+		verifier  *bankid.SignatureVerifier
+		signature *bankid.VerifiedSignature
+		now       time.Time
+		maxAge    time.Duration
+		status    bankid.OCSPStatus
+		err       string
+	}{
+		{
+			name:      "revoked",
+			response:  revokedData.OcspResponse,
+			verifier:  revokedVerifier,
+			signature: revokedSignature,
+			status:    bankid.OCSP_REVOKED,
+			err:       "status is revoked",
+		},
+		{
+			name:      "stale",
+			response:  completionData.OcspResponse,
+			verifier:  verifier,
+			signature: signature,
+			now:       time.Now().Add(bankid.DEFAULT_OCSP_MAX_AGE + time.Minute),
+			status:    bankid.OCSP_GOOD,
+			err:       "response is too old",
+		},
+		{
+			name:      "produced in the future",
+			response:  completionData.OcspResponse,
+			verifier:  verifier,
+			signature: signature,
+			now:       time.Now().Add(-10 * time.Minute),
+			status:    bankid.OCSP_GOOD,
+			err:       "produced in the future",
+		},
+		{
+			name:      "expired",
+			response:  completionData.OcspResponse,
+			verifier:  verifier,
+			signature: signature,
+			// Past the next update of the response, even if accepted as recent
+			now:    time.Now().Add(2 * time.Hour),
+			maxAge: 3 * time.Hour,
+			status: bankid.OCSP_GOOD,
+			err:    "response expired",
+		},
+		{
+			name:      "about another certificate",
+			response:  otherData.OcspResponse,
+			verifier:  verifier,
+			signature: signature,
+		},
+		{
+			name:      "tampered",
+			response:  tampered,
+			verifier:  verifier,
+			signature: signature,
+		},
+		{
+			name:      "not base64",
+			response:  "not base64!",
+			verifier:  verifier,
+			signature: signature,
+			err:       "not valid base64",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := *test.verifier
+			if !test.now.IsZero() {
+				verifier.Now = func() time.Time { return test.now }
+			}
+			result, err := verifier.VerifyOCSP(test.response, test.signature, test.maxAge)
+			if !errors.Is(err, bankid.ErrInvalidOCSPResponse) {
+				t.Fatalf("got %v, want an invalid OCSP response", err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %q, want %q", err, test.err)
+			}
+			if test.status != "" && (result == nil || result.Status != test.status) {
+				t.Errorf("got result %+v, want status %s", result, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package bankid
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Splinter0/identity/audit"
+)
+
+// Orders are collected in the background, once per order no matter how many
+// clients are following it, and the latest result is kept in the transaction.
+
+// How often BankID recommends calling collect
+const COLLECT_INTERVAL = 2 * time.Second
+
+// The transaction left the store before its order finished
+var errTransactionGone = errors.New("transaction is gone from the store")
+
+// Polls the order of the transaction as it was started, which is what gets
+// reported if the transaction leaves the store early
+func (provider *BankIDProvider) poll(transactionKey string, transaction BankIDTransaction) {
+	ticker := time.NewTicker(COLLECT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-provider.done:
+			return
+		case <-ticker.C:
+		}
+		pending, err := provider.refresh(context.Background(), transactionKey)
+		if errors.Is(err, errTransactionGone) {
+			provider.expire(context.Background(), transactionKey, transaction)
+		}
+		if !pending {
+			return
+		}
+	}
+}
+
+// Collects the order and stores the result in the transaction, returns false
+// once there is nothing left to collect
+func (provider *BankIDProvider) refresh(ctx context.Context, transactionKey string) (bool, error) {
+	transaction, ok, err := provider.Store.Get(ctx, transactionKey)
+	if err != nil {
+		log.Printf("Could not get BankID transaction: %v", err)
+		return true, err
+	}
+	if !ok {
+		return false, errTransactionGone
+	}
+	if transaction.Cancelled || !transaction.isPending() {
+		return false, nil
+	}
+	collected, err := provider.Client.DoCollectionContext(ctx, transaction.OrderRef)
+	if err != nil {
+		log.Printf("Could not collect BankID order %s: %v", transaction.OrderRef, err)
+		// BankID does not know about the order anymore, no point in trying again
+		var bankIDErr *BankIDError
+		if errors.As(err, &bankIDErr) && (bankIDErr.ErrorCode == INVALID_PARAMETERS || bankIDErr.ErrorCode == NOT_FOUND) {
+			provider.expire(ctx, transactionKey, transaction)
+			return false, nil
+		}
+		return true, err
+	}
+	updated, err := provider.Store.Update(ctx, transactionKey, func(transaction *BankIDTransaction) {
+		transaction.Collect = collected
+		transaction.CollectedAt = time.Now()
+	})
+	if err != nil {
+		log.Printf("Could not update BankID transaction: %v", err)
+		return true, err
+	}
+	if !updated {
+		return false, errTransactionGone
+	}
+	provider.notify(transactionKey)
+	if collected.Status == PENDING && (transaction.Collect == nil || transaction.Collect.HintCode != collected.HintCode) {
+		event := transaction.auditEvent(audit.ORDER_HINT)
+		event.Status = string(collected.Status)
+		event.HintCode = string(collected.HintCode)
+		provider.record(ctx, event)
+	}
+	if collected.Status != PENDING {
+		provider.finish(ctx, transactionKey)
+	}
+	return collected.Status == PENDING, nil
+}
+
+// Gives up on an order that cannot be collected anymore, it fails as expired
+// so it still gets recorded and listeners hear about it
+func (provider *BankIDProvider) expire(ctx context.Context, transactionKey string, transaction BankIDTransaction) {
+	expired := &CollectResponse{
+		CollectRequest: CollectRequest{OrderRef: transaction.OrderRef},
+		Status:         FAILED,
+		HintCode:       EXPIRED_TRANSACTION,
+	}
+	updated, err := provider.Store.Update(ctx, transactionKey, func(transaction *BankIDTransaction) {
+		if transaction.isPending() && !transaction.Cancelled {
+			transaction.Collect = expired
+			transaction.CollectedAt = time.Now()
+		}
+	})
+	if err != nil {
+		log.Printf("Could not expire BankID transaction: %v", err)
+		return
+	}
+	if updated {
+		provider.notify(transactionKey)
+		provider.finish(ctx, transactionKey)
+		return
+	}
+	// Nothing else can have finished it once it is gone
+	transaction.Collect = expired
+	provider.finished(ctx, transaction, BankIDStatusResponse{
+		Message:  ResolveMessage(FAILED, EXPIRED_TRANSACTION, transaction.Flow, DEFAULT_LANGUAGE),
+		Status:   FAILED,
+		HintCode: EXPIRED_TRANSACTION,
+	})
+}
+
+func (transaction BankIDTransaction) isPending() bool {
+	return transaction.Collect == nil || transaction.Collect.Status == PENDING
+}
+
+// Still waiting for the user, neither finished nor cancelled
+func (transaction BankIDTransaction) isOngoing() bool {
+	return transaction.isPending() && !transaction.Cancelled
+}
+
+// The poller should have collected the order by now, it might have stopped or
+// be running somewhere else
+func (transaction BankIDTransaction) isStale() bool {
+	last := transaction.CollectedAt
+	if last.IsZero() {
+		last = transaction.StartedAt
+	}
+	return transaction.isPending() && !transaction.Cancelled && time.Since(last) > 2*COLLECT_INTERVAL
+}
+
+// Signals every time the transaction is updated, the returned function has to
+// be called once done
+func (provider *BankIDProvider) Subscribe(transactionKey string) (<-chan struct{}, func()) {
+	updates := make(chan struct{}, 1)
+	provider.subscribersMutex.Lock()
+	defer provider.subscribersMutex.Unlock()
+	if provider.subscribers[transactionKey] == nil {
+		provider.subscribers[transactionKey] = make(map[chan struct{}]struct{})
+	}
+	provider.subscribers[transactionKey][updates] = struct{}{}
+
+	return updates, func() {
+		provider.subscribersMutex.Lock()
+		defer provider.subscribersMutex.Unlock()
+		delete(provider.subscribers[transactionKey], updates)
+		if len(provider.subscribers[transactionKey]) == 0 {
+			delete(provider.subscribers, transactionKey)
+		}
+	}
+}
+
+func (provider *BankIDProvider) notify(transactionKey string) {
+	provider.subscribersMutex.Lock()
+	defer provider.subscribersMutex.Unlock()
+	for updates := range provider.subscribers[transactionKey] {
+		select {
+		case updates <- struct{}{}:
+		default:
+			// Already has an update waiting
+		}
+	}
+}
+
+// Stops collecting orders in the background and watching the RP certificate
+func (provider *BankIDProvider) Close() {
+	close(provider.done)
+	provider.Client.Close()
+	if err := provider.Store.Close(); err != nil {
+		log.Printf("Could not close BankID transaction store: %v", err)
+	}
+}
@@ -1,18 +1,42 @@
 package bankid
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/Splinter0/identity/audit"
+	"github.com/Splinter0/identity/metrics"
+	"github.com/Splinter0/identity/personnummer"
 	"github.com/patrickmn/go-cache"
 )
 
-const SESSION_TIMEOUT = 30
+// Seconds an order can live before BankID expires it
+const SESSION_TIMEOUT = 180
+
+// Transactions are kept a while longer than their orders, so the last collect
+// and the outcome are not lost to clocks drifting or BankID being late
+const TRANSACTION_RETENTION = 2 * time.Minute
 
 type BankIDProvider struct {
 	Client *BankIDRP
-	Cache  *cache.Cache
+	Store  TransactionStore
+	// Verifies the signature in the completion data, disabled when nil
+	Verifier *SignatureVerifier
+	// Records what happens to orders, disabled when nil
+	Audit audit.AuditSink
+
+	subscribersMutex sync.Mutex
+	subscribers      map[string]map[chan struct{}]struct{}
+	listenersMutex   sync.RWMutex
+	listeners        []Listener
+	// Checks of the completion data by transaction key, only run once
+	checks *cache.Cache
+	done   chan struct{}
 }
 
 type BankIDAuthenticationRequest struct {
@@ -20,7 +44,50 @@ type BankIDAuthenticationRequest struct {
 	UserAgent      string
 	UserIp         string
 	MessageForUser string
-	RedirectURL    string
+	// Where the BankID app sends the user back to, only for same device
+	ReturnURL string
+	// Nonce in ReturnURL, checked with CheckReturn once the user is back
+	ReturnNonce string
+	BankIDReturn
+	BankIDDeviceInfo
+}
+
+type BankIDSignRequest struct {
+	SameDevice         bool
+	UserAgent          string
+	UserIp             string
+	UserVisibleData    string
+	UserNonVisibleData string
+	ReturnURL          string
+	ReturnNonce        string
+	BankIDReturn
+	BankIDDeviceInfo
+}
+
+// Where to send the user once the order completed, with the opaque state of
+// the caller, both have to be checked by the caller
+type BankIDReturn struct {
+	ReturnTo string
+	State    string
+	// Login flow of the service the transaction was started for, e.g. an
+	// OIDC authorization request, empty for plain logins
+	Flow string
+}
+
+// Order started by calling the user, or by the user calling the RP
+type BankIDPhoneRequest struct {
+	PersonalNumber     string
+	CallInitiator      CallInitiator
+	UserVisibleData    string
+	UserNonVisibleData string
+}
+
+// Device context sent to BankID along with the user agent. App is used instead
+// of the web information when the request comes from a native app.
+type BankIDDeviceInfo struct {
+	ReferringDomain  string
+	DeviceIdentifier string
+	App              *AppDevice
 }
 
 type BankIDAuthenticationResponse struct {
@@ -29,21 +96,66 @@ type BankIDAuthenticationResponse struct {
 	Success        bool   `json:"success"`
 	Message        string `json:"message,omitempty"`
 	TransactionKey string `json:"-"`
+	// Has to be kept by the client that started the transaction and given
+	// back to CheckBinding, it is only stored hashed
+	BindingNonce string `json:"-"`
 }
 
 type BankIDStatusResponse struct {
 	Message string        `json:"message"`
 	Status  CollectStatus `json:"status"`
 	Data    interface{}   `json:"data,omitempty"`
+	// Only set on completion
+	Type         OrderType `json:"-"`
+	BankIDReturn `json:"-"`
+	// Set on failures, the hint code from BankID or why the order was
+	// refused after completing
+	HintCode HintCode `json:"-"`
+	Reason   string   `json:"-"`
+	// Only set on completion, when signature verification is enabled
+	Signature *VerifiedSignature `json:"-"`
+	OCSP      *OCSPResult        `json:"-"`
+	// Only set on completion, when a maximum risk is configured for the flow
+	Risk        RiskLevel `json:"-"`
+	RiskFlagged bool      `json:"-"`
 }
 
+type OrderType string
+
+const (
+	AUTH OrderType = "auth"
+	SIGN OrderType = "sign"
+)
+
 type BankIDTransaction struct {
+	Type       OrderType
+	Flow       Flow
 	SameDevice bool
 	Mobile     bool
 	UserIp     string
-	QrCodeData []string
 	OrderRef   string
 	StartedAt  time.Time
+	// Needed to compute the animated QR code, only for QR flows
+	QrStartToken  string
+	QrStartSecret string
+	// As sent to BankID, to be checked against the signature
+	UserVisibleData    string
+	UserNonVisibleData string
+	// Latest result from collecting the order
+	Collect     *CollectResponse
+	CollectedAt time.Time
+	Cancelled   bool
+	// SHA-256 of the nonce binding the transaction to the client
+	BindingHash string
+	// SHA-256 of the nonce in the return URL, when there is one
+	ReturnHash string
+	// As required from BankID
+	CertificatePolicies []string
+	BankIDReturn
+	// Listeners were told about the outcome
+	Finished bool
+	// The completed status was handed out, it is only given once
+	Consumed bool
 }
 
 func NewBankIDProvider(config *BankIDConfig) *BankIDProvider {
@@ -51,92 +163,341 @@ func NewBankIDProvider(config *BankIDConfig) *BankIDProvider {
 	if err != nil {
 		log.Fatal(err)
 	}
-	c := cache.New((SESSION_TIMEOUT+1)*time.Second, 1*time.Minute)
+
+	return NewBankIDProviderWithRP(rp)
+}
+
+func NewBankIDProviderWithRP(rp *BankIDRP) *BankIDProvider {
+	store, err := NewTransactionStore(rp.Config.Store)
+	if err != nil {
+		log.Fatalf("Could not create BankID transaction store: %v", err)
+	}
+
+	return NewBankIDProviderWithStore(rp, store)
+}
+
+func NewBankIDProviderWithStore(rp *BankIDRP, store TransactionStore) *BankIDProvider {
+	if err := rp.Config.Risk.validate(); err != nil {
+		log.Fatalf("Invalid BankID risk configuration: %v", err)
+	}
+	if err := rp.Config.Requirements.validate(); err != nil {
+		log.Fatalf("Invalid BankID requirements: %v", err)
+	}
+	if _, ok := messages[rp.Config.Language]; rp.Config.Language != "" && !ok {
+		log.Fatalf("Unsupported BankID message language %q", rp.Config.Language)
+	}
+	var verifier *SignatureVerifier
+	if rp.Config.SignatureRootCA != "" {
+		var err error
+		verifier, err = NewSignatureVerifierFromFile(rp.Config.SignatureRootCA)
+		if err != nil {
+			log.Fatalf("Could not load BankID signature root CA: %v", err)
+		}
+	} else {
+		log.Println("BankID signature verification is disabled, set 'signatureRootCA' to enable it")
+	}
 
 	return &BankIDProvider{
-		Client: rp,
-		Cache:  c,
+		Client:      rp,
+		Store:       store,
+		Verifier:    verifier,
+		subscribers: make(map[string]map[chan struct{}]struct{}),
+		checks:      cache.New(SESSION_TIMEOUT*time.Second+TRANSACTION_RETENTION, time.Minute),
+		done:        make(chan struct{}),
 	}
 }
 
-func (provider *BankIDProvider) Authenticate(request BankIDAuthenticationRequest) BankIDAuthenticationResponse {
-	var policy CertificatePolicy
+func (provider *BankIDProvider) Authenticate(request BankIDAuthenticationRequest) (BankIDAuthenticationResponse, error) {
+	return provider.AuthenticateContext(context.Background(), request)
+}
+
+func (provider *BankIDProvider) AuthenticateContext(ctx context.Context, request BankIDAuthenticationRequest) (BankIDAuthenticationResponse, error) {
 	isMobile := IsMobileUserAgent(request.UserAgent)
-	if isMobile || !request.SameDevice {
-		policy = Mobile
-	} else {
-		policy = OnFile
+	flow := getFlow(request.SameDevice, isMobile)
+	requirement, err := provider.buildRequirements(flow)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
 	}
 	rawRequest := AuthRequest{
 		EndUserIp:             request.UserIp,
 		UserVisibleDataFormat: "simpleMarkdownV1",
 		UserVisibleData:       provider.buildUserVisibeData(request.MessageForUser),
-		Requirement: &AuthRequestRequirements{
-			CertificatePolicies: []string{
-				provider.Client.GetCertPolicyString(
-					policy,
-				),
-			},
-		},
-	}
-	resp := provider.Client.DoAuth(rawRequest)
-	if resp.ErrorCode != "" {
-		return BankIDAuthenticationResponse{
-			Success: false,
-			Message: resp.Details,
-		}
+		Requirement:           requirement,
+		ReturnRisk:            provider.Client.Config.Risk.maxRisk(AUTH, flow) != "",
+	}
+	if request.SameDevice {
+		rawRequest.ReturnUrl = request.ReturnURL
+	}
+	rawRequest.App, rawRequest.Web = request.BankIDDeviceInfo.build(request.UserAgent)
+	transaction := BankIDTransaction{
+		Type:                AUTH,
+		Flow:                flow,
+		SameDevice:          request.SameDevice,
+		Mobile:              isMobile,
+		UserIp:              request.UserIp,
+		UserVisibleData:     rawRequest.UserVisibleData,
+		ReturnHash:          returnHash(request.SameDevice, request.ReturnNonce),
+		BankIDReturn:        request.BankIDReturn,
+		CertificatePolicies: certificatePolicies(requirement),
+	}
+	resp, err := provider.Client.DoAuthContext(ctx, rawRequest)
+	if err != nil {
+		provider.recordStartFailed(ctx, transaction, err)
+		return BankIDAuthenticationResponse{}, err
+	}
+
+	return provider.startTransaction(ctx, resp, transaction)
+}
+
+func (provider *BankIDProvider) Sign(request BankIDSignRequest) (BankIDAuthenticationResponse, error) {
+	return provider.SignContext(context.Background(), request)
+}
+
+func (provider *BankIDProvider) SignContext(ctx context.Context, request BankIDSignRequest) (BankIDAuthenticationResponse, error) {
+	isMobile := IsMobileUserAgent(request.UserAgent)
+	flow := getFlow(request.SameDevice, isMobile)
+	requirement, err := provider.buildRequirements(flow)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
+	}
+	rawRequest := SignRequest{
+		EndUserIp:             request.UserIp,
+		UserVisibleDataFormat: "simpleMarkdownV1",
+		UserVisibleData:       provider.buildUserVisibeData(request.UserVisibleData),
+		Requirement:           requirement,
+		ReturnRisk:            provider.Client.Config.Risk.maxRisk(SIGN, flow) != "",
+	}
+	if request.UserNonVisibleData != "" {
+		rawRequest.UserNonVisibleData = provider.buildUserVisibeData(request.UserNonVisibleData)
+	}
+	if request.SameDevice {
+		rawRequest.ReturnUrl = request.ReturnURL
+	}
+	rawRequest.App, rawRequest.Web = request.BankIDDeviceInfo.build(request.UserAgent)
+	transaction := BankIDTransaction{
+		Type:                SIGN,
+		Flow:                flow,
+		SameDevice:          request.SameDevice,
+		Mobile:              isMobile,
+		UserIp:              request.UserIp,
+		UserVisibleData:     rawRequest.UserVisibleData,
+		UserNonVisibleData:  rawRequest.UserNonVisibleData,
+		ReturnHash:          returnHash(request.SameDevice, request.ReturnNonce),
+		BankIDReturn:        request.BankIDReturn,
+		CertificatePolicies: certificatePolicies(requirement),
+	}
+	resp, err := provider.Client.DoSignContext(ctx, rawRequest)
+	if err != nil {
+		provider.recordStartFailed(ctx, transaction, err)
+		return BankIDAuthenticationResponse{}, err
+	}
+
+	return provider.startTransaction(ctx, resp, transaction)
+}
+
+func returnHash(sameDevice bool, nonce string) string {
+	if !sameDevice || nonce == "" {
+		return ""
+	}
+	return sha256sum(nonce)
+}
+
+func (provider *BankIDProvider) PhoneAuthenticate(request BankIDPhoneRequest) (BankIDAuthenticationResponse, error) {
+	return provider.PhoneAuthenticateContext(context.Background(), request)
+}
+
+func (provider *BankIDProvider) PhoneAuthenticateContext(ctx context.Context, request BankIDPhoneRequest) (BankIDAuthenticationResponse, error) {
+	personalNumber, err := personnummer.Parse(request.PersonalNumber)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
+	}
+	requirement, err := provider.buildRequirements(FLOW_PHONE)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
+	}
+	rawRequest := PhoneAuthRequest{
+		PersonalNumber: personalNumber.String(),
+		CallInitiator:  request.CallInitiator,
+		Requirements:   requirement,
+		ReturnRisk:     provider.Client.Config.Risk.maxRisk(AUTH, FLOW_PHONE) != "",
+	}
+	if request.UserVisibleData != "" {
+		rawRequest.UserVisibleDataFormat = "simpleMarkdownV1"
+		rawRequest.UserVisibleData = provider.buildUserVisibeData(request.UserVisibleData)
+	}
+	if request.UserNonVisibleData != "" {
+		rawRequest.UserNonVisibleData = provider.buildUserVisibeData(request.UserNonVisibleData)
+	}
+	transaction := BankIDTransaction{
+		Type:                AUTH,
+		Flow:                FLOW_PHONE,
+		UserVisibleData:     rawRequest.UserVisibleData,
+		UserNonVisibleData:  rawRequest.UserNonVisibleData,
+		CertificatePolicies: certificatePolicies(requirement),
+	}
+	resp, err := provider.Client.DoPhoneAuthContext(ctx, rawRequest)
+	if err != nil {
+		provider.recordStartFailed(ctx, transaction, err)
+		return BankIDAuthenticationResponse{}, err
+	}
+
+	return provider.startTransaction(ctx, resp, transaction)
+}
+
+func (provider *BankIDProvider) PhoneSign(request BankIDPhoneRequest) (BankIDAuthenticationResponse, error) {
+	return provider.PhoneSignContext(context.Background(), request)
+}
+
+func (provider *BankIDProvider) PhoneSignContext(ctx context.Context, request BankIDPhoneRequest) (BankIDAuthenticationResponse, error) {
+	personalNumber, err := personnummer.Parse(request.PersonalNumber)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
+	}
+	requirement, err := provider.buildRequirements(FLOW_PHONE)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
+	}
+	rawRequest := PhoneSignRequest{
+		PersonalNumber:        personalNumber.String(),
+		CallInitiator:         request.CallInitiator,
+		UserVisibleDataFormat: "simpleMarkdownV1",
+		UserVisibleData:       provider.buildUserVisibeData(request.UserVisibleData),
+		Requirements:          requirement,
+		ReturnRisk:            provider.Client.Config.Risk.maxRisk(SIGN, FLOW_PHONE) != "",
+	}
+	if request.UserNonVisibleData != "" {
+		rawRequest.UserNonVisibleData = provider.buildUserVisibeData(request.UserNonVisibleData)
+	}
+	transaction := BankIDTransaction{
+		Type:                SIGN,
+		Flow:                FLOW_PHONE,
+		UserVisibleData:     rawRequest.UserVisibleData,
+		UserNonVisibleData:  rawRequest.UserNonVisibleData,
+		CertificatePolicies: certificatePolicies(requirement),
+	}
+	resp, err := provider.Client.DoPhoneSignContext(ctx, rawRequest)
+	if err != nil {
+		provider.recordStartFailed(ctx, transaction, err)
+		return BankIDAuthenticationResponse{}, err
+	}
+
+	return provider.startTransaction(ctx, resp, transaction)
+}
+
+func (provider *BankIDProvider) startTransaction(ctx context.Context, resp *AuthResponse, transaction BankIDTransaction) (BankIDAuthenticationResponse, error) {
+	key, err := randomToken(32)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return BankIDAuthenticationResponse{}, err
 	}
 	response := BankIDAuthenticationResponse{
-		TransactionKey: md5sum(resp.OrderRef),
+		TransactionKey: key,
+		BindingNonce:   nonce,
 		Success:        true,
 	}
-	qrCodeData := []string{}
-	if !request.SameDevice {
-		qrCodeData = provider.Client.GenerateQRData(resp)
-		response.QrCodeData = qrCodeData[0]
-	} else {
-		response.LaunchURL = provider.Client.GenerateLaunchURL(resp, request.RedirectURL, true)
-	}
-	provider.setTransaction(
-		response.TransactionKey,
-		BankIDTransaction{
-			SameDevice: request.SameDevice,
-			Mobile:     isMobile,
-			UserIp:     request.UserIp,
-			QrCodeData: qrCodeData,
-			OrderRef:   resp.OrderRef,
-			StartedAt:  time.Now(),
-		},
-	)
+	transaction.BindingHash = sha256sum(nonce)
+	switch transaction.Flow {
+	case FLOW_QR:
+		response.QrCodeData = provider.Client.GenerateQRDataAt(resp, 0)
+		transaction.QrStartToken = resp.QrStartToken
+		transaction.QrStartSecret = resp.QrStartSecret
+	case FLOW_SAME_DEVICE_DESKTOP, FLOW_SAME_DEVICE_MOBILE:
+		response.LaunchURL = provider.Client.GenerateLaunchURL(resp, true)
+	}
+	transaction.OrderRef = resp.OrderRef
+	transaction.StartedAt = time.Now()
+	if err := provider.Store.Set(ctx, response.TransactionKey, transaction, SESSION_TIMEOUT*time.Second+TRANSACTION_RETENTION); err != nil {
+		return BankIDAuthenticationResponse{}, err
+	}
+	provider.record(ctx, transaction.auditEvent(audit.ORDER_STARTED))
+	metrics.TransactionsStarted.WithLabelValues("bankid", string(transaction.Flow)).Inc()
+	go provider.poll(response.TransactionKey, transaction)
 
-	return response
+	return response, nil
+}
+
+func (provider *BankIDProvider) Status(transactionKey string) (BankIDStatusResponse, error) {
+	return provider.StatusContext(context.Background(), transactionKey)
+}
+
+func (provider *BankIDProvider) StatusContext(ctx context.Context, transactionKey string) (BankIDStatusResponse, error) {
+	return provider.LocalizedStatusContext(ctx, transactionKey, provider.Client.Config.Language)
 }
 
-func (provider *BankIDProvider) Status(transactionKey string) BankIDStatusResponse {
-	transaction, ok := provider.getTransaction(transactionKey)
+func (provider *BankIDProvider) LocalizedStatus(transactionKey string, language Language) (BankIDStatusResponse, error) {
+	return provider.LocalizedStatusContext(context.Background(), transactionKey, language)
+}
+
+// Same as StatusContext with messages in the given language
+func (provider *BankIDProvider) LocalizedStatusContext(ctx context.Context, transactionKey string, language Language) (BankIDStatusResponse, error) {
+	transaction, ok, err := provider.Store.Get(ctx, transactionKey)
+	if err != nil {
+		return BankIDStatusResponse{}, err
+	}
 	if !ok {
 		return BankIDStatusResponse{
-			Message: "Transaction not found",
+			Message: GetLocalizedMessage("notFound", language),
+			Status:  FAILED,
+			Reason:  "notFound",
+		}, nil
+	}
+
+	if transaction.Consumed {
+		return BankIDStatusResponse{
+			Message: GetLocalizedMessage("consumed", language),
 			Status:  FAILED,
+			Reason:  "consumed",
+		}, nil
+	}
+	if transaction.isStale() {
+		if _, err := provider.refresh(ctx, transactionKey); err != nil && !errors.Is(err, errTransactionGone) {
+			return BankIDStatusResponse{}, err
+		}
+		if transaction, ok, err = provider.Store.Get(ctx, transactionKey); err != nil {
+			return BankIDStatusResponse{}, err
+		} else if !ok {
+			return BankIDStatusResponse{
+				Message: GetLocalizedMessage("notFound", language),
+				Status:  FAILED,
+				Reason:  "notFound",
+			}, nil
 		}
 	}
+	return provider.transactionStatus(transactionKey, transaction, language), nil
+}
 
-	collectedData := provider.Client.DoCollection(transaction.OrderRef)
-	if collectedData.Status == FAILED {
+func (provider *BankIDProvider) transactionStatus(transactionKey string, transaction BankIDTransaction, language Language) BankIDStatusResponse {
+	if transaction.Cancelled {
 		return BankIDStatusResponse{
-			Message: collectedData.HintCode.GetMessage(),
+			Message: GetLocalizedMessage("RFA3", language),
 			Status:  FAILED,
+			Reason:  "cancelled",
+		}
+	}
+	collectedData := transaction.Collect
+	if collectedData == nil {
+		// Not collected yet
+		collectedData = &CollectResponse{Status: PENDING, HintCode: OUTSTANDING_TRANSACTION}
+	}
+	message := ResolveMessage(collectedData.Status, collectedData.HintCode, transaction.Flow, language)
+	if collectedData.Status == FAILED {
+		return BankIDStatusResponse{
+			Message:  message,
+			Status:   FAILED,
+			HintCode: collectedData.HintCode,
 		}
 	} else if collectedData.Status == PENDING {
 		var data interface{}
-		if !transaction.SameDevice {
-			frame := int(time.Since(transaction.StartedAt).Seconds()) % SESSION_TIMEOUT
+		if transaction.Flow == FLOW_QR {
 			data = map[string]string{
-				"qrData": transaction.QrCodeData[frame],
+				"qrData": transaction.QRDataAt(time.Now()),
 			}
 		}
 		return BankIDStatusResponse{
-			Message: collectedData.HintCode.GetMessage(),
+			Message: message,
 			Status:  PENDING,
 			Data:    data,
 		}
@@ -145,52 +506,196 @@ func (provider *BankIDProvider) Status(transactionKey string) BankIDStatusRespon
 	// If for some reason we have a weird status
 	if collectedData.Status != COMPLETE {
 		return BankIDStatusResponse{
-			Message: "Authentication failed",
+			Message: GetLocalizedMessage("unexpectedStatus", language),
 			Status:  FAILED,
+			Reason:  "unexpectedStatus",
 		}
 	}
 
 	if transaction.SameDevice && transaction.UserIp != collectedData.CompletionData.Device.IpAddress {
 		return BankIDStatusResponse{
-			Message: "BankID transaction was not completed using the same device",
+			Message: GetLocalizedMessage("otherDevice", language),
+			Status:  FAILED,
+			Reason:  "otherDevice",
+		}
+	}
+
+	check := provider.checkCompletion(transactionKey, transaction)
+	if check.rejected != "" {
+		return BankIDStatusResponse{
+			Message: GetLocalizedMessage(check.rejected, language),
 			Status:  FAILED,
+			Reason:  check.rejected,
+		}
+	}
+
+	response := BankIDStatusResponse{
+		Message:      message,
+		Status:       COMPLETE,
+		Data:         collectedData.CompletionData,
+		Type:         transaction.Type,
+		BankIDReturn: transaction.BankIDReturn,
+		Signature:    check.signature,
+		OCSP:         check.ocsp,
+	}
+	risk := provider.Client.Config.Risk
+	if maxRisk := risk.maxRisk(transaction.Type, transaction.Flow); maxRisk != "" {
+		response.Risk = collectedData.CompletionData.Risk
+		if response.Risk.Exceeds(maxRisk) {
+			log.Printf("BankID order %s has risk %q, over the maximum of %q", transaction.OrderRef, response.Risk, maxRisk)
+			if risk.Action != RISK_FLAG {
+				return BankIDStatusResponse{
+					Message: GetLocalizedMessage("riskRejected", language),
+					Status:  FAILED,
+					Reason:  "riskRejected",
+					Risk:    response.Risk,
+				}
+			}
+			response.RiskFlagged = true
 		}
 	}
 
-	return BankIDStatusResponse{
-		Message: "Success!",
-		Status:  COMPLETE,
-		Data:    collectedData.CompletionData,
+	return response
+}
+
+// Outcome of checking the signature and OCSP response of a completed order
+type completionCheck struct {
+	signature *VerifiedSignature
+	ocsp      *OCSPResult
+	// Message key and reason when the completion data was rejected
+	rejected string
+}
+
+// Checks the completion data the first time the transaction is seen complete
+// and reuses the outcome after that
+func (provider *BankIDProvider) checkCompletion(transactionKey string, transaction BankIDTransaction) completionCheck {
+	if cached, ok := provider.checks.Get(transactionKey); ok {
+		return cached.(completionCheck)
 	}
+	var check completionCheck
+	if provider.Verifier != nil {
+		completionData := transaction.Collect.CompletionData
+		var err error
+		check.signature, err = provider.Verifier.Verify(completionData.Signature, ExpectedSignedData{
+			UserVisibleData:    transaction.UserVisibleData,
+			UserNonVisibleData: transaction.UserNonVisibleData,
+		})
+		if err != nil {
+			log.Printf("BankID signature verification failed for order %s: %v", transaction.OrderRef, err)
+			check = completionCheck{rejected: "invalidSignature"}
+		} else if check.ocsp, err = provider.Verifier.VerifyOCSP(completionData.OcspResponse, check.signature, provider.Client.Config.OCSPMaxAge); err != nil {
+			log.Printf("BankID OCSP validation failed for order %s: %v", transaction.OrderRef, err)
+			check = completionCheck{rejected: "invalidOCSP"}
+		}
+	}
+	provider.checks.Set(transactionKey, check, cache.DefaultExpiration)
+	return check
+}
+
+// Marks the completed transaction as handed out, true only the first time so
+// a login cannot be replayed. Later status calls fail with the reason
+// "consumed".
+func (provider *BankIDProvider) ConsumeContext(ctx context.Context, transactionKey string) (bool, error) {
+	first := false
+	_, err := provider.Store.Update(ctx, transactionKey, func(transaction *BankIDTransaction) {
+		first = !transaction.Consumed
+		transaction.Consumed = true
+	})
+	return first, err
+}
+
+func (provider *BankIDProvider) Cancel(transactionKey string) error {
+	return provider.CancelContext(context.Background(), transactionKey)
 }
 
-func (provider *BankIDProvider) Cancel(transactionKey string) {
-	transaction, ok := provider.getTransaction(transactionKey)
+func (provider *BankIDProvider) CancelContext(ctx context.Context, transactionKey string) error {
+	transaction, ok, err := provider.Store.Get(ctx, transactionKey)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		// Means it's already expired and it does not matter
-		return
+		return nil
 	}
-	provider.Client.Cancel(transaction.OrderRef)
+	// Finished orders are cancelled too when starting new ones, not worth
+	// recording
+	ongoing := transaction.isPending() && !transaction.Cancelled
+	event := transaction.auditEvent(audit.ORDER_CANCELLED)
+	if err := provider.Client.CancelContext(ctx, transaction.OrderRef); err != nil {
+		if ongoing {
+			event.Error = err.Error()
+			provider.record(ctx, event)
+		}
+		return err
+	}
+	_, err = provider.Store.Update(ctx, transactionKey, func(transaction *BankIDTransaction) {
+		transaction.Cancelled = true
+	})
+	if err != nil {
+		return err
+	}
+	if ongoing {
+		provider.record(ctx, event)
+	}
+	provider.notify(transactionKey)
+	provider.finish(ctx, transactionKey)
+	return nil
 }
 
-func (provider *BankIDProvider) buildUserVisibeData(message string) string {
-	return base64.StdEncoding.EncodeToString([]byte(message))
+// Whether the nonce is the one given when the transaction was started, false
+// when the transaction does not exist
+func (provider *BankIDProvider) CheckBinding(ctx context.Context, transactionKey, nonce string) (bool, error) {
+	transaction, ok, err := provider.Store.Get(ctx, transactionKey)
+	if err != nil || !ok {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(sha256sum(nonce)), []byte(transaction.BindingHash)) == 1, nil
+}
+
+// Whether the nonce is the one in the return URL of the transaction, false
+// when the transaction does not exist or has no return URL
+func (provider *BankIDProvider) CheckReturn(ctx context.Context, transactionKey, nonce string) (bool, error) {
+	transaction, ok, err := provider.Store.Get(ctx, transactionKey)
+	if err != nil || !ok || transaction.ReturnHash == "" {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(sha256sum(nonce)), []byte(transaction.ReturnHash)) == 1, nil
 }
 
-func (provider *BankIDProvider) setTransaction(key string, transaction BankIDTransaction) {
-	provider.Cache.Set(key, transaction, cache.DefaultExpiration)
+// QR code data of the transaction at the given time, false when the
+// transaction does not exist or is not using a QR code
+func (provider *BankIDProvider) QRData(transactionKey string, at time.Time) (string, bool) {
+	transaction, ok, err := provider.Store.Get(context.Background(), transactionKey)
+	if err != nil || !ok || transaction.Flow != FLOW_QR {
+		return "", false
+	}
+	return transaction.QRDataAt(at), true
 }
 
-func (provider *BankIDProvider) getTransaction(key string) (BankIDTransaction, bool) {
-	value, found := provider.Cache.Get(key)
-	if !found {
-		return BankIDTransaction{}, false
+func (transaction BankIDTransaction) QRDataAt(at time.Time) string {
+	seconds := int(at.Sub(transaction.StartedAt).Seconds())
+	if seconds < 0 {
+		seconds = 0
 	}
+	return GenerateQRDataAt(transaction.QrStartToken, transaction.QrStartSecret, seconds)
+}
 
-	transaction, ok := value.(BankIDTransaction)
-	if !ok {
-		return BankIDTransaction{}, false
+func (provider *BankIDProvider) buildRequirements(flow Flow) (*AuthRequestRequirements, error) {
+	config := provider.Client.Config
+	return config.Requirements.builder(flow).Build(flow, config.Env)
+}
+
+func (d BankIDDeviceInfo) build(userAgent string) (*AppDevice, *WebDevice) {
+	if d.App != nil {
+		return d.App, nil
+	}
+	return nil, &WebDevice{
+		ReferringDomain:  d.ReferringDomain,
+		UserAgent:        userAgent,
+		DeviceIdentifier: d.DeviceIdentifier,
 	}
+}
 
-	return transaction, true
+func (provider *BankIDProvider) buildUserVisibeData(message string) string {
+	return base64.StdEncoding.EncodeToString([]byte(message))
 }
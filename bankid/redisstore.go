@@ -0,0 +1,207 @@
+package bankid
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Attempts at updating a transaction that keeps being changed concurrently
+const REDIS_UPDATE_ATTEMPTS = 10
+
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	TLS      bool   `yaml:"tls"`
+	// Prepended to the transaction keys, defaults to "bankid:transaction:".
+	// Ongoing transactions are also listed in the sorted set <prefix>ongoing
+	KeyPrefix string `yaml:"keyPrefix"`
+	// Prepended to the keys of other values, defaults to "identity:value:"
+	ValueKeyPrefix string `yaml:"valueKeyPrefix"`
+}
+
+// Store shared by every instance using the same Redis (or Redis compatible) server
+type RedisStore struct {
+	client      *redis.Client
+	prefix      string
+	valuePrefix string
+	// Keys of the ongoing transactions scored by when they expire, so they
+	// are counted without scanning the keyspace and a transaction abandoned
+	// before it finished stops being counted once expired
+	ongoingKey string
+}
+
+func NewRedisStore(config RedisConfig) (*RedisStore, error) {
+	if config.Address == "" {
+		return nil, errors.New("the redis transaction store needs an 'address'")
+	}
+	options := &redis.Options{
+		Addr:     config.Address,
+		Username: config.Username,
+		Password: config.Password,
+		DB:       config.DB,
+	}
+	if config.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	store := NewRedisStoreWithClient(redis.NewClient(options), config.KeyPrefix)
+	if config.ValueKeyPrefix != "" {
+		store.valuePrefix = config.ValueKeyPrefix
+	}
+	return store, nil
+}
+
+func NewRedisStoreWithClient(client *redis.Client, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = "bankid:transaction:"
+	}
+	return &RedisStore{
+		client:      client,
+		prefix:      prefix,
+		valuePrefix: "identity:value:",
+		ongoingKey:  prefix + "ongoing",
+	}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (BankIDTransaction, bool, error) {
+	value, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return BankIDTransaction{}, false, nil
+	}
+	if err != nil {
+		return BankIDTransaction{}, false, err
+	}
+	var transaction BankIDTransaction
+	if err := json.Unmarshal(value, &transaction); err != nil {
+		return BankIDTransaction{}, false, fmt.Errorf("could not decode transaction %s: %w", key, err)
+	}
+	return transaction, true, nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, transaction BankIDTransaction, ttl time.Duration) error {
+	value, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+	// Expiry follows the clock of the server, like the TTL of the key
+	now, err := s.client.Time(ctx).Result()
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.prefix+key, value, ttl)
+		if transaction.isOngoing() {
+			expiresAt := math.Inf(1)
+			if ttl > 0 {
+				expiresAt = float64(now.Add(ttl).UnixMilli())
+			}
+			pipe.ZAdd(ctx, s.ongoingKey, redis.Z{Score: expiresAt, Member: key})
+		} else {
+			pipe.ZRem(ctx, s.ongoingKey, key)
+		}
+		pipe.ZRemRangeByScore(ctx, s.ongoingKey, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.prefix+key)
+		pipe.ZRem(ctx, s.ongoingKey, key)
+		return nil
+	})
+	return err
+}
+
+// Optimistic locking, the transaction is only written if the key was not
+// changed since it was read
+func (s *RedisStore) Update(ctx context.Context, key string, update func(*BankIDTransaction)) (bool, error) {
+	member := key
+	key = s.prefix + key
+	for attempt := 0; attempt < REDIS_UPDATE_ATTEMPTS; attempt++ {
+		found := false
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			found = true
+			var transaction BankIDTransaction
+			if err := json.Unmarshal(value, &transaction); err != nil {
+				return fmt.Errorf("could not decode transaction %s: %w", key, err)
+			}
+			update(&transaction)
+			updated, err := json.Marshal(transaction)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(ctx, key, updated, redis.SetArgs{KeepTTL: true})
+				if !transaction.isOngoing() {
+					pipe.ZRem(ctx, s.ongoingKey, member)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return found, err
+	}
+	return false, fmt.Errorf("could not update transaction %s, it keeps changing", key)
+}
+
+// Counts the ongoing transactions not expired yet
+func (s *RedisStore) Ongoing(ctx context.Context) (int, error) {
+	now, err := s.client.Time(ctx).Result()
+	if err != nil {
+		return 0, err
+	}
+	count, err := s.client.ZCount(ctx, s.ongoingKey, "("+strconv.FormatInt(now.UnixMilli(), 10), "+inf").Result()
+	return int(count), err
+}
+
+func (s *RedisStore) SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, s.valuePrefix+key, value, ttl).Err()
+}
+
+func (s *RedisStore) GetValue(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.client.Get(ctx, s.valuePrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// GETDEL is atomic, needs Redis 6.2 or later
+func (s *RedisStore) TakeValue(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.client.GetDel(ctx, s.valuePrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,194 @@
+package bankid
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/Splinter0/identity/personnummer"
+)
+
+// How the user is starting the order, each flow can have its own requirements
+type Flow string
+
+const (
+	FLOW_QR                  Flow = "qr"
+	FLOW_SAME_DEVICE_DESKTOP Flow = "sameDeviceDesktop"
+	FLOW_SAME_DEVICE_MOBILE  Flow = "sameDeviceMobile"
+	FLOW_PHONE               Flow = "phone"
+)
+
+func getFlow(sameDevice, isMobile bool) Flow {
+	switch {
+	case !sameDevice:
+		return FLOW_QR
+	case isMobile:
+		return FLOW_SAME_DEVICE_MOBILE
+	default:
+		return FLOW_SAME_DEVICE_DESKTOP
+	}
+}
+
+func (f Flow) SameDevice() bool {
+	return f == FLOW_SAME_DEVICE_DESKTOP || f == FLOW_SAME_DEVICE_MOBILE
+}
+
+// Requirements of a flow as set in the config, certificate policies are given
+// with their production OIDs and translated when running against test
+type RequirementConfig struct {
+	PinCode             bool                `yaml:"pinCode"`
+	Mrtd                bool                `yaml:"mrtd"`
+	CardReader          CardReaderClass     `yaml:"cardReader"`
+	CertificatePolicies []CertificatePolicy `yaml:"certificatePolicies"`
+}
+
+type RequirementsConfig struct {
+	QR                *RequirementConfig `yaml:"qr"`
+	SameDeviceDesktop *RequirementConfig `yaml:"sameDeviceDesktop"`
+	SameDeviceMobile  *RequirementConfig `yaml:"sameDeviceMobile"`
+	Phone             *RequirementConfig `yaml:"phone"`
+}
+
+func (c RequirementsConfig) get(flow Flow) *RequirementConfig {
+	switch flow {
+	case FLOW_QR:
+		return c.QR
+	case FLOW_SAME_DEVICE_DESKTOP:
+		return c.SameDeviceDesktop
+	case FLOW_SAME_DEVICE_MOBILE:
+		return c.SameDeviceMobile
+	case FLOW_PHONE:
+		return c.Phone
+	}
+	return nil
+}
+
+func (c RequirementsConfig) validate() error {
+	for _, flow := range []Flow{FLOW_QR, FLOW_SAME_DEVICE_DESKTOP, FLOW_SAME_DEVICE_MOBILE, FLOW_PHONE} {
+		if _, err := c.builder(flow).validate(flow); err != nil {
+			return fmt.Errorf("requirements for %s: %w", flow, err)
+		}
+	}
+	return nil
+}
+
+// Builder for the configured flow, defaults to Mobile BankID for QR, phone
+// and mobile flows and BankID on file on desktop
+func (c RequirementsConfig) builder(flow Flow) *RequirementBuilder {
+	config := c.get(flow)
+	if config == nil {
+		if flow == FLOW_SAME_DEVICE_DESKTOP {
+			return NewRequirement().CertificatePolicies(OnFile)
+		}
+		return NewRequirement().CertificatePolicies(Mobile)
+	}
+	builder := NewRequirement().CertificatePolicies(config.CertificatePolicies...)
+	if config.PinCode {
+		builder.PinCode()
+	}
+	if config.Mrtd {
+		builder.Mrtd()
+	}
+	if config.CardReader != "" {
+		builder.CardReader(config.CardReader)
+	}
+	return builder
+}
+
+// Builds the requirement of an order, for example:
+//
+//	requirement, err := NewRequirement().PinCode().CertificatePolicies(Mobile).Build(FLOW_QR, TEST)
+type RequirementBuilder struct {
+	requirement AuthRequestRequirements
+	policies    []CertificatePolicy
+}
+
+func NewRequirement() *RequirementBuilder {
+	return &RequirementBuilder{}
+}
+
+// User has to enter the security code, biometrics are not allowed
+func (b *RequirementBuilder) PinCode() *RequirementBuilder {
+	b.requirement.PinCode = true
+	return b
+}
+
+// User has to scan their passport or national ID card
+func (b *RequirementBuilder) Mrtd() *RequirementBuilder {
+	b.requirement.Mrtd = true
+	return b
+}
+
+func (b *RequirementBuilder) CardReader(class CardReaderClass) *RequirementBuilder {
+	b.requirement.CardReader = class
+	return b
+}
+
+func (b *RequirementBuilder) PersonalNumber(personalNumber string) *RequirementBuilder {
+	b.requirement.PersonalNumber = personalNumber
+	return b
+}
+
+// Replaces the accepted certificate policies, all are accepted when empty
+func (b *RequirementBuilder) CertificatePolicies(policies ...CertificatePolicy) *RequirementBuilder {
+	b.policies = policies
+	return b
+}
+
+// Validates the requirement for the flow and translates the certificate
+// policies for the environment
+func (b *RequirementBuilder) Build(flow Flow, env BankIDEnvironment) (*AuthRequestRequirements, error) {
+	requirement, err := b.validate(flow)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range b.policies {
+		if env == TEST {
+			requirement.CertificatePolicies = append(requirement.CertificatePolicies, policy.getTest())
+		} else {
+			requirement.CertificatePolicies = append(requirement.CertificatePolicies, string(policy))
+		}
+	}
+	return requirement, nil
+}
+
+func (b *RequirementBuilder) validate(flow Flow) (*AuthRequestRequirements, error) {
+	requirement := b.requirement
+	for _, policy := range b.policies {
+		switch policy {
+		case OnFile, SmartCard, Mobile:
+		default:
+			return nil, fmt.Errorf("unknown certificate policy %q", policy)
+		}
+	}
+	accepts := func(policy CertificatePolicy) bool {
+		return len(b.policies) == 0 || slices.Contains(b.policies, policy)
+	}
+	switch requirement.CardReader {
+	case "":
+	case ComputerOrReader, OnlyReader:
+		if !accepts(SmartCard) {
+			return nil, errors.New("a card reader can only be required when BankID on smart card is accepted")
+		}
+	default:
+		return nil, fmt.Errorf("unknown card reader class %q", requirement.CardReader)
+	}
+	if requirement.Mrtd && !accepts(Mobile) {
+		return nil, errors.New("MRTD can only be required when Mobile BankID is accepted")
+	}
+	// Only Mobile BankID can scan a QR code, take a call or run on a phone
+	if (flow == FLOW_QR || flow == FLOW_PHONE || flow == FLOW_SAME_DEVICE_MOBILE) && !accepts(Mobile) {
+		return nil, fmt.Errorf("Mobile BankID must be accepted for the %s flow", flow)
+	}
+	if flow == FLOW_PHONE && requirement.CardReader != "" {
+		return nil, errors.New("a card reader cannot be required for the phone flow")
+	}
+	if requirement.PersonalNumber != "" {
+		personalNumber, err := personnummer.Parse(requirement.PersonalNumber)
+		if err != nil {
+			return nil, err
+		}
+		requirement.PersonalNumber = personalNumber.String()
+	}
+	return &requirement, nil
+}
@@ -0,0 +1,189 @@
+package bankid
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRequirementBuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		builder  *RequirementBuilder
+		flow     Flow
+		env      BankIDEnvironment
+		policies []string
+	}{
+		{"test OIDs", NewRequirement().CertificatePolicies(OnFile, SmartCard, Mobile), FLOW_SAME_DEVICE_DESKTOP, TEST, []string{"1.2.3.4.5", "1.2.3.4.10", "1.2.3.4.25"}},
+		{"production OIDs", NewRequirement().CertificatePolicies(OnFile, SmartCard, Mobile), FLOW_SAME_DEVICE_DESKTOP, PRODUCTION, []string{"1.2.752.78.1.1", "1.2.752.78.1.2", "1.2.752.78.1.5"}},
+		{"mobile on test", NewRequirement().CertificatePolicies(Mobile), FLOW_QR, TEST, []string{"1.2.3.4.25"}},
+		{"every policy accepted", NewRequirement(), FLOW_PHONE, TEST, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requirement, err := test.builder.Build(test.flow, test.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(requirement.CertificatePolicies, test.policies) {
+				t.Errorf("got policies %v, want %v", requirement.CertificatePolicies, test.policies)
+			}
+		})
+	}
+}
+
+// Building twice, e.g. for every order, does not add the policies again
+func TestRequirementBuildTwice(t *testing.T) {
+	builder := NewRequirement().CertificatePolicies(Mobile)
+	for i := 0; i < 2; i++ {
+		requirement, err := builder.Build(FLOW_QR, TEST)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(requirement.CertificatePolicies) != 1 {
+			t.Errorf("got policies %v on build %d", requirement.CertificatePolicies, i+1)
+		}
+	}
+}
+
+func TestRequirementInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *RequirementBuilder
+		flow    Flow
+		error   string
+	}{
+		{"unknown policy", NewRequirement().CertificatePolicies("1.2.3"), FLOW_SAME_DEVICE_DESKTOP, "unknown certificate policy"},
+		{"card reader without smart card", NewRequirement().CardReader(OnlyReader).CertificatePolicies(OnFile), FLOW_SAME_DEVICE_DESKTOP, "card reader"},
+		{"unknown card reader", NewRequirement().CardReader("class3"), FLOW_SAME_DEVICE_DESKTOP, "unknown card reader class"},
+		{"mrtd without mobile", NewRequirement().Mrtd().CertificatePolicies(OnFile, SmartCard), FLOW_SAME_DEVICE_DESKTOP, "MRTD"},
+		{"QR without mobile", NewRequirement().CertificatePolicies(OnFile), FLOW_QR, "Mobile BankID must be accepted"},
+		{"phone without mobile", NewRequirement().CertificatePolicies(SmartCard), FLOW_PHONE, "Mobile BankID must be accepted"},
+		{"mobile device without mobile", NewRequirement().CertificatePolicies(OnFile), FLOW_SAME_DEVICE_MOBILE, "Mobile BankID must be accepted"},
+		{"card reader on the phone", NewRequirement().CardReader(ComputerOrReader), FLOW_PHONE, "phone flow"},
+		{"invalid personal number", NewRequirement().PersonalNumber("199001012384"), FLOW_QR, "personnummer"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requirement, err := test.builder.Build(test.flow, TEST)
+			if err == nil {
+				t.Fatalf("built %+v", requirement)
+			}
+			if !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %q, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestRequirementJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *RequirementBuilder
+		flow    Flow
+		want    string
+	}{
+		{
+			name:    "pin code",
+			builder: NewRequirement().PinCode().CertificatePolicies(Mobile),
+			flow:    FLOW_QR,
+			want:    `{"pinCode":true,"certificatePolicies":["1.2.3.4.25"]}`,
+		},
+		{
+			name:    "mrtd",
+			builder: NewRequirement().Mrtd(),
+			flow:    FLOW_SAME_DEVICE_MOBILE,
+			want:    `{"mrtd":true}`,
+		},
+		{
+			name:    "card reader",
+			builder: NewRequirement().CardReader(OnlyReader).CertificatePolicies(SmartCard),
+			flow:    FLOW_SAME_DEVICE_DESKTOP,
+			want:    `{"cardReader":"class2","certificatePolicies":["1.2.3.4.10"]}`,
+		},
+		{
+			name:    "personal number",
+			builder: NewRequirement().PersonalNumber("19900101-2385"),
+			flow:    FLOW_PHONE,
+			want:    `{"personalNumber":"199001012385"}`,
+		},
+		{
+			name:    "nothing required",
+			builder: NewRequirement(),
+			flow:    FLOW_QR,
+			want:    `{}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requirement, err := test.builder.Build(test.flow, TEST)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(requirement)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequirementsConfig(t *testing.T) {
+	valid := RequirementsConfig{
+		QR:                &RequirementConfig{PinCode: true, CertificatePolicies: []CertificatePolicy{Mobile}},
+		SameDeviceDesktop: &RequirementConfig{CardReader: OnlyReader, CertificatePolicies: []CertificatePolicy{SmartCard, OnFile}},
+		SameDeviceMobile:  &RequirementConfig{Mrtd: true},
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("valid requirements refused: %v", err)
+	}
+	if err := (RequirementsConfig{}).validate(); err != nil {
+		t.Errorf("default requirements refused: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		config RequirementsConfig
+		error  string
+	}{
+		{"QR without mobile", RequirementsConfig{QR: &RequirementConfig{CertificatePolicies: []CertificatePolicy{OnFile}}}, "requirements for qr"},
+		{"mrtd on file", RequirementsConfig{SameDeviceDesktop: &RequirementConfig{Mrtd: true, CertificatePolicies: []CertificatePolicy{OnFile}}}, "requirements for sameDeviceDesktop"},
+		{"card reader on the phone", RequirementsConfig{Phone: &RequirementConfig{CardReader: ComputerOrReader}}, "requirements for phone"},
+		{"card reader without smart card", RequirementsConfig{SameDeviceMobile: &RequirementConfig{CardReader: OnlyReader, CertificatePolicies: []CertificatePolicy{Mobile}}}, "requirements for sameDeviceMobile"},
+		{"unknown policy", RequirementsConfig{QR: &RequirementConfig{CertificatePolicies: []CertificatePolicy{Mobile, "1.2.752.78.1.9"}}}, "unknown certificate policy"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.validate()
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+// Flows without configured requirements accept what can be used there
+func TestRequirementsDefaults(t *testing.T) {
+	tests := []struct {
+		flow Flow
+		want []string
+	}{
+		{FLOW_QR, []string{"1.2.3.4.25"}},
+		{FLOW_SAME_DEVICE_MOBILE, []string{"1.2.3.4.25"}},
+		{FLOW_PHONE, []string{"1.2.3.4.25"}},
+		{FLOW_SAME_DEVICE_DESKTOP, []string{"1.2.3.4.5"}},
+	}
+	for _, test := range tests {
+		requirement, err := (RequirementsConfig{}).builder(test.flow).Build(test.flow, TEST)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(requirement.CertificatePolicies, test.want) {
+			t.Errorf("%s accepts %v, want %v", test.flow, requirement.CertificatePolicies, test.want)
+		}
+	}
+}
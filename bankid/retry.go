@@ -0,0 +1,198 @@
+package bankid
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Retrying of RP API calls, following the error handling recommendations in
+// https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/graenssnittsbeskrivning/felkoder
+
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"maxAttempts"`
+	BaseDelay   time.Duration `yaml:"baseDelay"`
+	MaxDelay    time.Duration `yaml:"maxDelay"`
+}
+
+const (
+	DEFAULT_MAX_ATTEMPTS = 3
+	// BankID asks not to retry more often than once per second during maintenance
+	DEFAULT_BASE_DELAY = 1 * time.Second
+	DEFAULT_MAX_DELAY  = 5 * time.Second
+)
+
+func (r RetryConfig) maxAttempts() int {
+	if r.MaxAttempts <= 0 {
+		return DEFAULT_MAX_ATTEMPTS
+	}
+	return r.MaxAttempts
+}
+
+// Exponential backoff with jitter, the delay is picked in [d/2, d]
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	base, max := r.BaseDelay, r.MaxDelay
+	if base <= 0 {
+		base = DEFAULT_BASE_DELAY
+	}
+	if max <= 0 {
+		max = DEFAULT_MAX_DELAY
+	}
+	delay := base << (attempt - 1)
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+type callKind int
+
+const (
+	// Creates a new order (auth, sign), retrying must not risk starting two orders
+	orderCreating callKind = iota
+	// Refers to an existing order (collect, cancel), safe to repeat
+	orderReferring
+)
+
+type retryAction int
+
+const (
+	noRetry retryAction = iota
+	// After the backoff, the error is transient
+	retryLater
+	// The user already has an order in progress, which BankID aborts. When
+	// this RP started it, it is cancelled and the order created again at once
+	cancelThenRetry
+)
+
+func shouldRetry(kind callKind, err error) retryAction {
+	var bankIDErr *BankIDError
+	if !errors.As(err, &bankIDErr) {
+		// Transport errors, we cannot know if an order was created
+		if kind == orderReferring {
+			return retryLater
+		}
+		return noRetry
+	}
+	switch bankIDErr.ErrorCode {
+	case MAINTENANCE:
+		// The request never reached the order handling
+		return retryLater
+	case INTERNAL_ERROR, REQUEST_TIMEOUT:
+		if kind == orderReferring {
+			return retryLater
+		}
+		return noRetry
+	case ALREADY_IN_PROGRESS:
+		if kind == orderCreating {
+			return cancelThenRetry
+		}
+		return noRetry
+	default:
+		return noRetry
+	}
+}
+
+// Orders started by this RP for a personal number and not finished yet, so
+// an alreadyInProgress caused by one of them can be solved by cancelling it.
+// Orders of other RPs or other replicas are left alone.
+type ownedOrders struct {
+	mutex  sync.Mutex
+	orders map[string]ownedOrder
+}
+
+type ownedOrder struct {
+	OrderRef  string
+	CreatedAt time.Time
+}
+
+func (o *ownedOrders) add(personalNumber, orderRef string) {
+	if personalNumber == "" {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.orders == nil {
+		o.orders = map[string]ownedOrder{}
+	}
+	// Orders never collected until the end are forgotten once expired
+	for key, order := range o.orders {
+		if time.Since(order.CreatedAt) > SESSION_TIMEOUT*time.Second {
+			delete(o.orders, key)
+		}
+	}
+	o.orders[personalNumber] = ownedOrder{OrderRef: orderRef, CreatedAt: time.Now()}
+}
+
+func (o *ownedOrders) get(personalNumber string) (string, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	order, ok := o.orders[personalNumber]
+	if !ok || time.Since(order.CreatedAt) > SESSION_TIMEOUT*time.Second {
+		return "", false
+	}
+	return order.OrderRef, true
+}
+
+func (o *ownedOrders) remove(orderRef string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for key, order := range o.orders {
+		if order.OrderRef == orderRef {
+			delete(o.orders, key)
+		}
+	}
+}
+
+// Creates an order with the retry policy, replacing the order in progress of
+// the user once when it is one of ours
+func (b *BankIDRP) createOrder(ctx context.Context, timeout time.Duration, url, personalNumber string, request interface{}) (*AuthResponse, error) {
+	var response AuthResponse
+	err := b.post(ctx, orderCreating, timeout, url, request, &response)
+	if err != nil && personalNumber != "" && shouldRetry(orderCreating, err) == cancelThenRetry {
+		orderRef, ok := b.orders.get(personalNumber)
+		if !ok {
+			return nil, err
+		}
+		log.Printf("Cancelling order %s in progress for the same user before starting a new one", orderRef)
+		if cancelErr := b.CancelContext(ctx, orderRef); cancelErr != nil {
+			var bankIDErr *BankIDError
+			if !errors.As(cancelErr, &bankIDErr) {
+				return nil, err
+			}
+			// Already aborted by BankID or finished
+			b.orders.remove(orderRef)
+		}
+		err = b.post(ctx, orderCreating, timeout, url, request, &response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.orders.add(personalNumber, response.OrderRef)
+	return &response, nil
+}
+
+func (b *BankIDRP) post(ctx context.Context, kind callKind, timeout time.Duration, url string, request, response interface{}) error {
+	attempts := b.Config.Retry.maxAttempts()
+	var err error
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err = b.postOnce(ctx, timeout, url, request, response)
+		b.observe(url, start, err)
+		if err == nil || attempt >= attempts || ctx.Err() != nil || shouldRetry(kind, err) != retryLater {
+			return err
+		}
+		log.Printf("Retrying BankID request to %s after error: %v", url, err)
+
+		timer := time.NewTimer(b.Config.Retry.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package bankid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	transport := errors.New("bankid: request failed: connection reset")
+	bankIDError := func(code ErrorCode) error {
+		return fmt.Errorf("wrapped: %w", &BankIDError{ErrorCode: code})
+	}
+	tests := []struct {
+		err       error
+		creating  retryAction
+		referring retryAction
+	}{
+		{transport, noRetry, retryLater},
+		{bankIDError(MAINTENANCE), retryLater, retryLater},
+		{bankIDError(INTERNAL_ERROR), noRetry, retryLater},
+		{bankIDError(REQUEST_TIMEOUT), noRetry, retryLater},
+		{bankIDError(ALREADY_IN_PROGRESS), cancelThenRetry, noRetry},
+		{bankIDError(INVALID_PARAMETERS), noRetry, noRetry},
+		{bankIDError(UNAUTHORIZED), noRetry, noRetry},
+		{bankIDError(NOT_FOUND), noRetry, noRetry},
+		{bankIDError(METHOD_NOT_ALLOWED), noRetry, noRetry},
+		{bankIDError(UNSUPPORTED_MEDIA_TYPE), noRetry, noRetry},
+		{bankIDError("somethingNew"), noRetry, noRetry},
+	}
+	for _, test := range tests {
+		if got := shouldRetry(orderCreating, test.err); got != test.creating {
+			t.Errorf("auth or sign failing with %v: got %d, want %d", test.err, got, test.creating)
+		}
+		if got := shouldRetry(orderReferring, test.err); got != test.referring {
+			t.Errorf("collect or cancel failing with %v: got %d, want %d", test.err, got, test.referring)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  RetryConfig
+		attempt int
+		max     time.Duration
+	}{
+		{"first attempt", RetryConfig{}, 1, DEFAULT_BASE_DELAY},
+		{"doubled", RetryConfig{}, 2, 2 * DEFAULT_BASE_DELAY},
+		{"capped", RetryConfig{}, 4, DEFAULT_MAX_DELAY},
+		{"configured", RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 3, 400 * time.Millisecond},
+		{"configured cap", RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 5, time.Second},
+		// Shifted past the size of the duration
+		{"overflow", RetryConfig{}, 64, DEFAULT_MAX_DELAY},
+		{"far overflow", RetryConfig{BaseDelay: time.Duration(math.MaxInt64 / 2), MaxDelay: time.Hour}, 3, time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := test.config.backoff(test.attempt)
+				if delay < test.max/2 || delay > test.max {
+					t.Fatalf("backoff(%d) = %s, want between %s and %s", test.attempt, delay, test.max/2, test.max)
+				}
+			}
+		})
+	}
+}
+
+// RP API that aborts the order in progress of a user starting another one,
+// like BankID
+type fakeRP struct {
+	mutex     sync.Mutex
+	next      int
+	orders    map[string]string
+	completed map[string]bool
+	cancelled []string
+}
+
+func newFakeRP(t *testing.T) (*fakeRP, *BankIDRP) {
+	fake := &fakeRP{orders: map[string]string{}, completed: map[string]bool{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	config := &BankIDConfig{BaseURL: server.URL, Version: LATEST_VERSION, Retry: RetryConfig{MaxAttempts: 1}}
+	return fake, NewBankIDRPWithClient(config, server.Client())
+}
+
+func (f *fakeRP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		OrderRef       string                   `json:"orderRef"`
+		PersonalNumber string                   `json:"personalNumber"`
+		Requirement    *AuthRequestRequirements `json:"requirement"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fail := func(code ErrorCode) {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(BankIDResponse{ErrorCode: string(code)})
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/collect"):
+		if _, ok := f.orders[request.OrderRef]; !ok {
+			fail(INVALID_PARAMETERS)
+			return
+		}
+		status := PENDING
+		if f.completed[request.OrderRef] {
+			status = COMPLETE
+			delete(f.orders, request.OrderRef)
+		}
+		json.NewEncoder(w).Encode(CollectResponse{CollectRequest: CollectRequest{OrderRef: request.OrderRef}, Status: status})
+	case strings.HasSuffix(r.URL.Path, "/cancel"):
+		f.cancelled = append(f.cancelled, request.OrderRef)
+		if _, ok := f.orders[request.OrderRef]; !ok {
+			fail(INVALID_PARAMETERS)
+			return
+		}
+		delete(f.orders, request.OrderRef)
+		w.Write([]byte("{}"))
+	default:
+		personalNumber := request.PersonalNumber
+		if request.Requirement != nil {
+			personalNumber = request.Requirement.PersonalNumber
+		}
+		for orderRef, other := range f.orders {
+			if personalNumber != "" && other == personalNumber {
+				delete(f.orders, orderRef)
+				fail(ALREADY_IN_PROGRESS)
+				return
+			}
+		}
+		f.next++
+		orderRef := fmt.Sprintf("order-%d", f.next)
+		f.orders[orderRef] = personalNumber
+		json.NewEncoder(w).Encode(AuthResponse{OrderRef: orderRef})
+	}
+}
+
+// An order started by someone else for the personal number
+func (f *fakeRP) otherOrder(personalNumber string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.orders["other"] = personalNumber
+}
+
+func (f *fakeRP) cancelledOrders() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.cancelled...)
+}
+
+const inProgressPersonalNumber = "199001012385"
+
+func authRequest(personalNumber string) AuthRequest {
+	return AuthRequest{EndUserIp: "127.0.0.1", Requirement: &AuthRequestRequirements{PersonalNumber: personalNumber}}
+}
+
+func TestAlreadyInProgress(t *testing.T) {
+	starts := []struct {
+		name  string
+		start func(b *BankIDRP) (*AuthResponse, error)
+	}{
+		{"auth", func(b *BankIDRP) (*AuthResponse, error) {
+			return b.DoAuth(authRequest(inProgressPersonalNumber))
+		}},
+		{"sign", func(b *BankIDRP) (*AuthResponse, error) {
+			return b.DoSign(SignRequest{EndUserIp: "127.0.0.1", UserVisibleData: "data", Requirement: &AuthRequestRequirements{PersonalNumber: inProgressPersonalNumber}})
+		}},
+		{"phone auth", func(b *BankIDRP) (*AuthResponse, error) {
+			return b.DoPhoneAuth(PhoneAuthRequest{PersonalNumber: inProgressPersonalNumber, CallInitiator: RPCallInitiator})
+		}},
+		{"phone sign", func(b *BankIDRP) (*AuthResponse, error) {
+			return b.DoPhoneSign(PhoneSignRequest{PersonalNumber: inProgressPersonalNumber, CallInitiator: RPCallInitiator, UserVisibleData: "data"})
+		}},
+	}
+	for _, test := range starts {
+		t.Run(test.name, func(t *testing.T) {
+			fake, rp := newFakeRP(t)
+			first, err := test.start(rp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := test.start(rp)
+			if err != nil {
+				t.Fatalf("order of this RP in progress not replaced: %v", err)
+			}
+			if second.OrderRef == first.OrderRef {
+				t.Errorf("got the same order %s", first.OrderRef)
+			}
+			if cancelled := fake.cancelledOrders(); len(cancelled) != 1 || cancelled[0] != first.OrderRef {
+				t.Errorf("cancelled %v, want %s", cancelled, first.OrderRef)
+			}
+		})
+	}
+}
+
+func TestAlreadyInProgressOtherOrder(t *testing.T) {
+	assertInProgress := func(t *testing.T, fake *fakeRP, err error) {
+		t.Helper()
+		var bankIDErr *BankIDError
+		if !errors.As(err, &bankIDErr) || bankIDErr.ErrorCode != ALREADY_IN_PROGRESS {
+			t.Errorf("got %v, want alreadyInProgress", err)
+		}
+		if cancelled := fake.cancelledOrders(); len(cancelled) != 0 {
+			t.Errorf("cancelled %v, which this RP does not own", cancelled)
+		}
+	}
+
+	t.Run("started elsewhere", func(t *testing.T) {
+		fake, rp := newFakeRP(t)
+		fake.otherOrder(inProgressPersonalNumber)
+		_, err := rp.DoAuth(authRequest(inProgressPersonalNumber))
+		assertInProgress(t, fake, err)
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		fake, rp := newFakeRP(t)
+		if _, err := rp.DoAuth(authRequest("199001012393")); err != nil {
+			t.Fatal(err)
+		}
+		fake.otherOrder(inProgressPersonalNumber)
+		_, err := rp.DoAuth(authRequest(inProgressPersonalNumber))
+		assertInProgress(t, fake, err)
+	})
+
+	// Once collected as complete the order is no longer ours to cancel
+	t.Run("finished", func(t *testing.T) {
+		fake, rp := newFakeRP(t)
+		first, err := rp.DoAuth(authRequest(inProgressPersonalNumber))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.mutex.Lock()
+		fake.completed[first.OrderRef] = true
+		fake.mutex.Unlock()
+		if _, err := rp.DoCollection(first.OrderRef); err != nil {
+			t.Fatal(err)
+		}
+		fake.otherOrder(inProgressPersonalNumber)
+		_, err = rp.DoAuth(authRequest(inProgressPersonalNumber))
+		assertInProgress(t, fake, err)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		fake, rp := newFakeRP(t)
+		first, err := rp.DoAuth(authRequest(inProgressPersonalNumber))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rp.Cancel(first.OrderRef); err != nil {
+			t.Fatal(err)
+		}
+		fake.otherOrder(inProgressPersonalNumber)
+		_, err = rp.DoAuth(authRequest(inProgressPersonalNumber))
+		var bankIDErr *BankIDError
+		if !errors.As(err, &bankIDErr) || bankIDErr.ErrorCode != ALREADY_IN_PROGRESS {
+			t.Errorf("got %v, want alreadyInProgress", err)
+		}
+		if cancelled := fake.cancelledOrders(); len(cancelled) != 1 {
+			t.Errorf("cancelled %v, want only the order cancelled by the user", cancelled)
+		}
+	})
+}
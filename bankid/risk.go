@@ -0,0 +1,84 @@
+package bankid
+
+import "fmt"
+
+// Risk assessment of an order, as returned by BankID in the completion data
+// when returnRisk is set.
+type RiskLevel string
+
+const (
+	RISK_LOW      RiskLevel = "low"
+	RISK_MODERATE RiskLevel = "moderate"
+	RISK_HIGH     RiskLevel = "high"
+)
+
+func (r RiskLevel) rank() int {
+	switch r {
+	case RISK_LOW:
+		return 1
+	case RISK_MODERATE:
+		return 2
+	case RISK_HIGH:
+		return 3
+	}
+	return 0
+}
+
+// True when the risk is above max, an unknown risk exceeds any maximum
+func (r RiskLevel) Exceeds(max RiskLevel) bool {
+	if r.rank() == 0 {
+		return true
+	}
+	return r.rank() > max.rank()
+}
+
+type RiskAction string
+
+const (
+	// Orders over the maximum risk fail
+	RISK_FAIL RiskAction = "fail"
+	// Orders over the maximum risk complete but are flagged in the status
+	RISK_FLAG RiskAction = "flag"
+)
+
+type RiskLimits struct {
+	QR         RiskLevel `yaml:"qr"`
+	SameDevice RiskLevel `yaml:"sameDevice"`
+	Phone      RiskLevel `yaml:"phone"`
+}
+
+// Maximum acceptable risk per flow, no limit for the ones left empty
+type RiskConfig struct {
+	Action RiskAction `yaml:"action"`
+	Auth   RiskLimits `yaml:"auth"`
+	Sign   RiskLimits `yaml:"sign"`
+}
+
+func (c RiskConfig) validate() error {
+	switch c.Action {
+	case "", RISK_FAIL, RISK_FLAG:
+	default:
+		return fmt.Errorf("invalid risk action %q, must be 'fail' or 'flag'", c.Action)
+	}
+	for _, level := range []RiskLevel{c.Auth.QR, c.Auth.SameDevice, c.Auth.Phone, c.Sign.QR, c.Sign.SameDevice, c.Sign.Phone} {
+		if level != "" && level.rank() == 0 {
+			return fmt.Errorf("invalid risk level %q, must be 'low', 'moderate' or 'high'", level)
+		}
+	}
+	return nil
+}
+
+// Empty when there is no limit for the flow
+func (c RiskConfig) maxRisk(orderType OrderType, flow Flow) RiskLevel {
+	limits := c.Auth
+	if orderType == SIGN {
+		limits = c.Sign
+	}
+	switch flow {
+	case FLOW_PHONE:
+		return limits.Phone
+	case FLOW_SAME_DEVICE_DESKTOP, FLOW_SAME_DEVICE_MOBILE:
+		return limits.SameDevice
+	}
+	return limits.QR
+}
@@ -0,0 +1,48 @@
+package bankid
+
+import "testing"
+
+func TestMaxRisk(t *testing.T) {
+	config := RiskConfig{
+		Auth: RiskLimits{QR: RISK_LOW, SameDevice: RISK_MODERATE, Phone: RISK_HIGH},
+		Sign: RiskLimits{QR: RISK_MODERATE},
+	}
+	tests := []struct {
+		orderType OrderType
+		flow      Flow
+		want      RiskLevel
+	}{
+		{AUTH, FLOW_QR, RISK_LOW},
+		{AUTH, FLOW_SAME_DEVICE_DESKTOP, RISK_MODERATE},
+		{AUTH, FLOW_SAME_DEVICE_MOBILE, RISK_MODERATE},
+		{AUTH, FLOW_PHONE, RISK_HIGH},
+		{SIGN, FLOW_QR, RISK_MODERATE},
+		// Phone flows do not fall back to the QR limit
+		{SIGN, FLOW_PHONE, ""},
+		{SIGN, FLOW_SAME_DEVICE_MOBILE, ""},
+	}
+	for _, test := range tests {
+		if got := config.maxRisk(test.orderType, test.flow); got != test.want {
+			t.Errorf("maxRisk(%s, %s) = %q, want %q", test.orderType, test.flow, got, test.want)
+		}
+	}
+}
+
+func TestRiskExceeds(t *testing.T) {
+	tests := []struct {
+		risk, max RiskLevel
+		want      bool
+	}{
+		{RISK_LOW, RISK_LOW, false},
+		{RISK_MODERATE, RISK_LOW, true},
+		{RISK_MODERATE, RISK_HIGH, false},
+		{RISK_HIGH, RISK_MODERATE, true},
+		// Missing from the completion data
+		{"", RISK_HIGH, true},
+	}
+	for _, test := range tests {
+		if got := test.risk.Exceeds(test.max); got != test.want {
+			t.Errorf("%q.Exceeds(%q) = %v, want %v", test.risk, test.max, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package bankid
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// Verification of the XML signature found in CollectCompletionData.Signature
+// https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/graenssnittsbeskrivning/collect
+
+const (
+	XMLDSIG_NAMESPACE = "http://www.w3.org/2000/09/xmldsig#"
+	BANKID_NAMESPACE  = "http://www.bankid.com/signature/v1.0.0/types"
+
+	SIGNED_DATA_ID = "bidSignedData"
+	KEY_INFO_ID    = "bidKeyInfo"
+)
+
+var ErrInvalidSignature = errors.New("bankid: invalid signature")
+
+type SignatureVerifier struct {
+	Roots *x509.CertPool
+	// Time at which the certificate chain must be valid, defaults to time.Now
+	Now func() time.Time
+}
+
+// What the RP sent to BankID, as base64 encoded in the request
+type ExpectedSignedData struct {
+	UserVisibleData    string
+	UserNonVisibleData string
+}
+
+type VerifiedSignature struct {
+	SignerCertificate *x509.Certificate
+	// Signer certificate first, up to the root CA
+	Chain              []*x509.Certificate
+	UserVisibleData    string
+	UserNonVisibleData string
+}
+
+func NewSignatureVerifier(rootCAPEM []byte) (*SignatureVerifier, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootCAPEM) {
+		return nil, errors.New("no certificate found in BankID signature root CA")
+	}
+	return &SignatureVerifier{
+		Roots: roots,
+		Now:   time.Now,
+	}, nil
+}
+
+func NewSignatureVerifierFromFile(path string) (*SignatureVerifier, error) {
+	rootCAPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignatureVerifier(rootCAPEM)
+}
+
+// Verifies the base64 encoded signature as returned by collect
+func (v *SignatureVerifier) Verify(signature string, expected ExpectedSignedData) (*VerifiedSignature, error) {
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, signatureError("signature is not valid base64: %v", err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, signatureError("signature is not valid XML: %v", err)
+	}
+	root := doc.Root()
+	if root == nil || !isElement(root, XMLDSIG_NAMESPACE, "Signature") {
+		return nil, signatureError("missing Signature element")
+	}
+
+	signedInfo := childElement(root, XMLDSIG_NAMESPACE, "SignedInfo")
+	if signedInfo == nil {
+		return nil, signatureError("missing SignedInfo element")
+	}
+	// Both the signed data and the certificates need to be covered by the signature
+	if err := verifyReferences(root, signedInfo, SIGNED_DATA_ID, KEY_INFO_ID); err != nil {
+		return nil, err
+	}
+
+	chain, err := parseKeyInfo(root)
+	if err != nil {
+		return nil, err
+	}
+	signer := chain[0]
+	if err := verifySignedInfo(root, signedInfo, signer); err != nil {
+		return nil, err
+	}
+	verifiedChain, err := v.verifyChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	signedData := findByID(root, SIGNED_DATA_ID)
+	if !isElement(signedData, BANKID_NAMESPACE, "bankIdSignedData") {
+		return nil, signatureError("signed data is not bankIdSignedData")
+	}
+	result := &VerifiedSignature{
+		SignerCertificate:  signer,
+		Chain:              verifiedChain,
+		UserVisibleData:    childText(signedData, BANKID_NAMESPACE, "usrVisibleData"),
+		UserNonVisibleData: childText(signedData, BANKID_NAMESPACE, "usrNonVisibleData"),
+	}
+	if result.UserVisibleData != expected.UserVisibleData {
+		return nil, signatureError("signed usrVisibleData does not match the request")
+	}
+	if result.UserNonVisibleData != expected.UserNonVisibleData {
+		return nil, signatureError("signed usrNonVisibleData does not match the request")
+	}
+
+	return result, nil
+}
+
+func (v *SignatureVerifier) verifyChain(chain []*x509.Certificate) ([]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	chains, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, signatureError("signer certificate is not trusted: %v", err)
+	}
+	return chains[0], nil
+}
+
+func verifyReferences(root, signedInfo *etree.Element, required ...string) error {
+	seen := map[string]bool{}
+	for _, reference := range childElements(signedInfo, XMLDSIG_NAMESPACE, "Reference") {
+		uri := reference.SelectAttrValue("URI", "")
+		if !strings.HasPrefix(uri, "#") {
+			return signatureError("unsupported reference URI %q", uri)
+		}
+		id := uri[1:]
+		if seen[id] {
+			return signatureError("duplicate reference to %q", id)
+		}
+		seen[id] = true
+
+		target := findByID(root, id)
+		if target == nil {
+			return signatureError("referenced element %q not found", id)
+		}
+		if transforms := childElement(reference, XMLDSIG_NAMESPACE, "Transforms"); transforms != nil {
+			for _, transform := range childElements(transforms, XMLDSIG_NAMESPACE, "Transform") {
+				if _, err := getCanonicalizer(transform.SelectAttrValue("Algorithm", "")); err != nil {
+					return err
+				}
+			}
+		}
+		canonicalizer, err := getCanonicalizer(algorithmOf(reference, "Transforms/Transform"))
+		if err != nil {
+			return err
+		}
+		canonical, err := canonicalize(canonicalizer, target)
+		if err != nil {
+			return signatureError("could not canonicalize %q: %v", id, err)
+		}
+		hash, err := getHash(algorithmOf(reference, "DigestMethod"))
+		if err != nil {
+			return err
+		}
+		digest := hash.New()
+		digest.Write(canonical)
+		expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(childText(reference, XMLDSIG_NAMESPACE, "DigestValue")))
+		if err != nil || string(expected) != string(digest.Sum(nil)) {
+			return signatureError("digest of %q does not match", id)
+		}
+	}
+	for _, id := range required {
+		if !seen[id] {
+			return signatureError("%q is not covered by the signature", id)
+		}
+	}
+	return nil
+}
+
+func verifySignedInfo(root, signedInfo *etree.Element, signer *x509.Certificate) error {
+	canonicalizer, err := getCanonicalizer(algorithmOf(signedInfo, "CanonicalizationMethod"))
+	if err != nil {
+		return err
+	}
+	canonical, err := canonicalize(canonicalizer, signedInfo)
+	if err != nil {
+		return signatureError("could not canonicalize SignedInfo: %v", err)
+	}
+	signatureValue, err := base64.StdEncoding.DecodeString(
+		strings.Join(strings.Fields(childText(root, XMLDSIG_NAMESPACE, "SignatureValue")), ""),
+	)
+	if err != nil {
+		return signatureError("SignatureValue is not valid base64: %v", err)
+	}
+
+	hash, err := getSignatureHash(algorithmOf(signedInfo, "SignatureMethod"))
+	if err != nil {
+		return err
+	}
+	digest := hash.New()
+	digest.Write(canonical)
+	hashed := digest.Sum(nil)
+
+	switch key := signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, hash, hashed, signatureValue)
+	case *ecdsa.PublicKey:
+		// XML signatures encode ECDSA as the concatenation of r and s
+		size := len(signatureValue) / 2
+		r := new(big.Int).SetBytes(signatureValue[:size])
+		s := new(big.Int).SetBytes(signatureValue[size:])
+		if !ecdsa.Verify(key, hashed, r, s) {
+			err = errors.New("ecdsa verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return signatureError("SignatureValue does not verify: %v", err)
+	}
+	return nil
+}
+
+func parseKeyInfo(root *etree.Element) ([]*x509.Certificate, error) {
+	keyInfo := findByID(root, KEY_INFO_ID)
+	if !isElement(keyInfo, XMLDSIG_NAMESPACE, "KeyInfo") {
+		return nil, signatureError("missing KeyInfo element")
+	}
+	x509Data := childElement(keyInfo, XMLDSIG_NAMESPACE, "X509Data")
+	if x509Data == nil {
+		return nil, signatureError("missing X509Data element")
+	}
+	var chain []*x509.Certificate
+	for _, el := range childElements(x509Data, XMLDSIG_NAMESPACE, "X509Certificate") {
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(el.Text()), ""))
+		if err != nil {
+			return nil, signatureError("X509Certificate is not valid base64: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, signatureError("could not parse X509Certificate: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, signatureError("no certificate in KeyInfo")
+	}
+	return chain, nil
+}
+
+// XML helpers
+
+func isElement(el *etree.Element, namespace, tag string) bool {
+	return el != nil && el.Tag == tag && el.NamespaceURI() == namespace
+}
+
+func childElements(el *etree.Element, namespace, tag string) []*etree.Element {
+	var children []*etree.Element
+	for _, child := range el.ChildElements() {
+		if isElement(child, namespace, tag) {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+func childElement(el *etree.Element, namespace, tag string) *etree.Element {
+	children := childElements(el, namespace, tag)
+	if len(children) != 1 {
+		return nil
+	}
+	return children[0]
+}
+
+func childText(el *etree.Element, namespace, tag string) string {
+	child := childElement(el, namespace, tag)
+	if child == nil {
+		return ""
+	}
+	return child.Text()
+}
+
+// Finds the only element with the given Id, duplicated ids are rejected to
+// avoid signature wrapping attacks
+func findByID(root *etree.Element, id string) *etree.Element {
+	var found *etree.Element
+	count := 0
+	var walk func(el *etree.Element)
+	walk = func(el *etree.Element) {
+		if el.SelectAttrValue("Id", "") == id {
+			found = el
+			count++
+		}
+		for _, child := range el.ChildElements() {
+			walk(child)
+		}
+	}
+	walk(root)
+	if count != 1 {
+		return nil
+	}
+	return found
+}
+
+// Algorithm of the last element in the path
+func algorithmOf(el *etree.Element, path string) string {
+	for _, tag := range strings.Split(path, "/") {
+		children := childElements(el, XMLDSIG_NAMESPACE, tag)
+		if len(children) == 0 {
+			return ""
+		}
+		el = children[len(children)-1]
+	}
+	return el.SelectAttrValue("Algorithm", "")
+}
+
+func getCanonicalizer(algorithm string) (dsig.Canonicalizer, error) {
+	switch dsig.AlgorithmID(algorithm) {
+	case dsig.CanonicalXML10RecAlgorithmId:
+		return dsig.MakeC14N10RecCanonicalizer(), nil
+	case dsig.CanonicalXML10ExclusiveAlgorithmId:
+		return dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(""), nil
+	case dsig.CanonicalXML11AlgorithmId:
+		return dsig.MakeC14N11Canonicalizer(), nil
+	default:
+		return nil, signatureError("unsupported canonicalization %q", algorithm)
+	}
+}
+
+// Canonical form of the element with the namespaces in scope where it is in
+// the document. Canonicalizing it in place gets the default namespace wrong
+// when the element declares its own, like bankIdSignedData does.
+func canonicalize(canonicalizer dsig.Canonicalizer, el *etree.Element) ([]byte, error) {
+	ctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil, err
+	}
+	detached, err := etreeutils.NSDetatch(ctx, el)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalizer.Canonicalize(detached)
+}
+
+func getHash(algorithm string) (crypto.Hash, error) {
+	switch algorithm {
+	case "http://www.w3.org/2001/04/xmlenc#sha256":
+		return crypto.SHA256, nil
+	case "http://www.w3.org/2001/04/xmlenc#sha512":
+		return crypto.SHA512, nil
+	default:
+		return 0, signatureError("unsupported digest %q", algorithm)
+	}
+}
+
+func getSignatureHash(algorithm string) (crypto.Hash, error) {
+	switch algorithm {
+	case "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+		"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256":
+		return crypto.SHA256, nil
+	case "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512",
+		"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512":
+		return crypto.SHA512, nil
+	default:
+		return 0, signatureError("unsupported signature method %q", algorithm)
+	}
+}
+
+func signatureError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidSignature, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,300 @@
+package bankid_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/bankid/simulator"
+)
+
+const signedText = "Transfer 100 SEK"
+
+// Completion data of a sign order completed by the simulator, along with a
+// verifier trusting its root CA
+func completedSign(t *testing.T, config simulator.Config) (bankid.CollectCompletionData, *bankid.SignatureVerifier) {
+	t.Helper()
+	config.Script = []simulator.Step{{Status: bankid.COMPLETE}}
+	sim, err := simulator.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := sim.Start()
+	t.Cleanup(server.Close)
+	rp := bankid.NewBankIDRPWithClient(&bankid.BankIDConfig{
+		Env:     bankid.TEST,
+		Version: bankid.LATEST_VERSION,
+		BaseURL: server.URL,
+	}, server.Client())
+
+	order, err := rp.DoSignContext(context.Background(), bankid.SignRequest{
+		EndUserIp:       "192.0.2.1",
+		UserVisibleData: encode(signedText),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collected, err := rp.DoCollectionContext(context.Background(), order.OrderRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collected.Status != bankid.COMPLETE {
+		t.Fatalf("order is %s, want complete", collected.Status)
+	}
+	verifier, err := bankid.NewSignatureVerifier(sim.RootCAPEM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collected.CompletionData, verifier
+}
+
+func encode(text string) string {
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+// Edits the XML of the base64 encoded signature
+func tamper(t *testing.T, signature, old, new string) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), old) {
+		t.Fatalf("signature does not contain %q", old)
+	}
+	return encode(strings.Replace(string(raw), old, new, 1))
+}
+
+func TestVerifySignature(t *testing.T) {
+	completionData, verifier := completedSign(t, simulator.Config{})
+	expected := bankid.ExpectedSignedData{UserVisibleData: encode(signedText)}
+
+	signature, err := verifier.Verify(completionData.Signature, expected)
+	if err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+	if signature.UserVisibleData != expected.UserVisibleData {
+		t.Errorf("signed usrVisibleData %q, want %q", signature.UserVisibleData, expected.UserVisibleData)
+	}
+	if len(signature.Chain) != 2 || signature.Chain[0] != signature.SignerCertificate {
+		t.Errorf("chain does not go from the signer to the root: %d certificates", len(signature.Chain))
+	}
+}
+
+func TestVerifySignatureInvalid(t *testing.T) {
+	completionData, verifier := completedSign(t, simulator.Config{})
+	otherData, otherVerifier := completedSign(t, simulator.Config{})
+	expected := bankid.ExpectedSignedData{UserVisibleData: encode(signedText)}
+
+	tests := []struct {
+		name      string
+		signature string
+		verifier  *bankid.SignatureVerifier
+		expected  bankid.ExpectedSignedData
+		err       string
+	}{
+		{
+			// Not covered by a digest, only by the signature value
+			name:      "tampered SignedInfo",
+			signature: tamper(t, completionData.Signature, `Type="`+bankid.BANKID_NAMESPACE+`"`, `Type="urn:tampered"`),
+			verifier:  verifier,
+			expected:  expected,
+			err:       "SignatureValue does not verify",
+		},
+		{
+			name:      "tampered signed data",
+			signature: tamper(t, completionData.Signature, encode(signedText), encode("Transfer 9999 SEK")),
+			verifier:  verifier,
+			expected:  bankid.ExpectedSignedData{UserVisibleData: encode("Transfer 9999 SEK")},
+			err:       `digest of "bidSignedData" does not match`,
+		},
+		{
+			name:      "duplicated signed data id",
+			signature: tamper(t, completionData.Signature, "<srvInfo>", `<srvInfo Id="`+bankid.SIGNED_DATA_ID+`">`),
+			verifier:  verifier,
+			expected:  expected,
+			err:       "not found",
+		},
+		{
+			name:      "wrong chain root",
+			signature: completionData.Signature,
+			verifier:  otherVerifier,
+			expected:  expected,
+			err:       "signer certificate is not trusted",
+		},
+		{
+			name:      "chain of another signer",
+			signature: otherData.Signature,
+			verifier:  verifier,
+			expected:  expected,
+			err:       "signer certificate is not trusted",
+		},
+		{
+			name:      "usrVisibleData not matching the request",
+			signature: completionData.Signature,
+			verifier:  verifier,
+			expected:  bankid.ExpectedSignedData{UserVisibleData: encode("Transfer 1 SEK")},
+			err:       "signed usrVisibleData does not match",
+		},
+		{
+			name:      "usrNonVisibleData not signed",
+			signature: completionData.Signature,
+			verifier:  verifier,
+			expected:  bankid.ExpectedSignedData{UserVisibleData: encode(signedText), UserNonVisibleData: encode("id-42")},
+			err:       "signed usrNonVisibleData does not match",
+		},
+		{
+			name:      "not a signature",
+			signature: encode("<bankIdSignedData/>"),
+			verifier:  verifier,
+			expected:  expected,
+			err:       "missing Signature element",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.verifier.Verify(test.signature, test.expected)
+			if !errors.Is(err, bankid.ErrInvalidSignature) {
+				t.Fatalf("got %v, want an invalid signature", err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %q, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// Signature with the layout of BankID, where bankIdSignedData declares its
+// own default namespace inside Signature, or with both namespaces declared
+// with prefixes on the root. Digests are computed over the canonical form of
+// the elements with the namespaces in scope, or over what Canonicalize gives
+// for the element in place when detached is false.
+func namespacedSignature(t *testing.T, prefixed, detached bool) (string, *bankid.SignatureVerifier) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test BankID Signer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds, bid := "", ""
+	if prefixed {
+		ds, bid = "ds:", "bid:"
+	}
+	doc := etree.NewDocument()
+	signature := doc.CreateElement(ds + "Signature")
+	if prefixed {
+		signature.CreateAttr("xmlns:ds", bankid.XMLDSIG_NAMESPACE)
+		signature.CreateAttr("xmlns:bid", bankid.BANKID_NAMESPACE)
+	} else {
+		signature.CreateAttr("xmlns", bankid.XMLDSIG_NAMESPACE)
+	}
+	signedInfo := signature.CreateElement(ds + "SignedInfo")
+	signedInfo.CreateElement(ds+"CanonicalizationMethod").CreateAttr("Algorithm", string(dsig.CanonicalXML10RecAlgorithmId))
+	signedInfo.CreateElement(ds+"SignatureMethod").CreateAttr("Algorithm", "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256")
+	var digests []*etree.Element
+	for _, id := range []string{bankid.SIGNED_DATA_ID, bankid.KEY_INFO_ID} {
+		reference := signedInfo.CreateElement(ds + "Reference")
+		reference.CreateAttr("URI", "#"+id)
+		reference.CreateElement(ds+"Transforms").CreateElement(ds+"Transform").CreateAttr("Algorithm", string(dsig.CanonicalXML10RecAlgorithmId))
+		reference.CreateElement(ds+"DigestMethod").CreateAttr("Algorithm", "http://www.w3.org/2001/04/xmlenc#sha256")
+		digests = append(digests, reference.CreateElement(ds+"DigestValue"))
+	}
+	signatureValue := signature.CreateElement(ds + "SignatureValue")
+	keyInfo := signature.CreateElement(ds + "KeyInfo")
+	keyInfo.CreateAttr("Id", bankid.KEY_INFO_ID)
+	keyInfo.CreateElement(ds + "X509Data").CreateElement(ds + "X509Certificate").SetText(base64.StdEncoding.EncodeToString(der))
+	signedData := signature.CreateElement(ds + "Object").CreateElement(bid + "bankIdSignedData")
+	if !prefixed {
+		signedData.CreateAttr("xmlns", bankid.BANKID_NAMESPACE)
+	}
+	signedData.CreateAttr("Id", bankid.SIGNED_DATA_ID)
+	signedData.CreateElement(bid + "usrVisibleData").SetText(encode(signedText))
+
+	canonicalizer := dsig.MakeC14N10RecCanonicalizer()
+	canonicalize := func(el *etree.Element) []byte {
+		if detached {
+			ctx, err := etreeutils.NSBuildParentContext(el)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if el, err = etreeutils.NSDetatch(ctx, el); err != nil {
+				t.Fatal(err)
+			}
+		}
+		canonical, err := canonicalizer.Canonicalize(el)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return canonical
+	}
+	for i, el := range []*etree.Element{signedData, keyInfo} {
+		sum := sha256.Sum256(canonicalize(el))
+		digests[i].SetText(base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	hashed := sha256.Sum256(canonicalize(signedInfo))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureValue.SetText(base64.StdEncoding.EncodeToString(value))
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := bankid.NewSignatureVerifier(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw), verifier
+}
+
+func TestVerifySignatureNamespaces(t *testing.T) {
+	expected := bankid.ExpectedSignedData{UserVisibleData: encode(signedText)}
+	for _, prefixed := range []bool{false, true} {
+		signature, verifier := namespacedSignature(t, prefixed, true)
+		verified, err := verifier.Verify(signature, expected)
+		if err != nil {
+			t.Fatalf("valid signature with prefixes %v: %v", prefixed, err)
+		}
+		if verified.UserVisibleData != expected.UserVisibleData {
+			t.Errorf("signed usrVisibleData %q, want %q", verified.UserVisibleData, expected.UserVisibleData)
+		}
+	}
+
+	// Signed data digested in the namespace of Signature
+	signature, verifier := namespacedSignature(t, false, false)
+	_, err := verifier.Verify(signature, expected)
+	if err == nil || !strings.Contains(err.Error(), `digest of "bidSignedData" does not match`) {
+		t.Errorf("got %v, want the digest of the signed data refused", err)
+	}
+}
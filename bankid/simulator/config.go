@@ -0,0 +1,121 @@
+package simulator
+
+import (
+	"os"
+	"time"
+
+	"github.com/Splinter0/identity/bankid"
+	"gopkg.in/yaml.v2"
+)
+
+// One state an order goes through, it is reported for the given number of
+// collect calls before moving on to the next step of the script.
+type Step struct {
+	Status   bankid.CollectStatus `yaml:"status"`
+	HintCode bankid.HintCode      `yaml:"hintCode"`
+	Collects int                  `yaml:"collects"`
+}
+
+type User struct {
+	PersonalNumber string `yaml:"personalNumber"`
+	GivenName      string `yaml:"givenName"`
+	Surname        string `yaml:"surname"`
+	// Returned when the RP asks for it, defaults to low
+	Risk bankid.RiskLevel `yaml:"risk"`
+	// The OCSP response says the certificate of the user is revoked
+	Revoked bool `yaml:"revoked"`
+	// Overrides the default script for orders completed by this user
+	Script []Step `yaml:"script"`
+}
+
+func (u User) Name() string {
+	return u.GivenName + " " + u.Surname
+}
+
+type Config struct {
+	Users []User `yaml:"users"`
+	// Script used for users without their own, defaults to DefaultScript
+	Script []Step `yaml:"script"`
+	// QR orders stay outstandingTransaction until a valid QR code is posted to /sim/qr
+	RequireQRScan bool `yaml:"requireQrScan"`
+	// Accepted difference in seconds between the QR time and the order age
+	QRTolerance int `yaml:"qrTolerance"`
+	// Orders not finished after this long fail with expiredTransaction,
+	// defaults to 3 minutes
+	OrderTimeout time.Duration `yaml:"orderTimeout"`
+}
+
+var DefaultUsers = []User{
+	{
+		PersonalNumber: "199001012385",
+		GivenName:      "Test",
+		Surname:        "Testsson",
+	},
+	{
+		PersonalNumber: "198001012395",
+		GivenName:      "Cancel",
+		Surname:        "Cancelsson",
+		Script: []Step{
+			{Status: bankid.PENDING, HintCode: bankid.OUTSTANDING_TRANSACTION, Collects: 1},
+			{Status: bankid.PENDING, HintCode: bankid.USER_SIGN, Collects: 1},
+			{Status: bankid.FAILED, HintCode: bankid.USER_CANCEL},
+		},
+	},
+}
+
+var DefaultScript = []Step{
+	{Status: bankid.PENDING, HintCode: bankid.OUTSTANDING_TRANSACTION, Collects: 2},
+	{Status: bankid.PENDING, HintCode: bankid.STARTED, Collects: 1},
+	{Status: bankid.PENDING, HintCode: bankid.USER_SIGN, Collects: 2},
+	{Status: bankid.COMPLETE},
+}
+
+var phoneScript = []Step{
+	{Status: bankid.PENDING, HintCode: bankid.OUTSTANDING_TRANSACTION, Collects: 1},
+	{Status: bankid.PENDING, HintCode: bankid.USER_CALL_CONFRIRM, Collects: 2},
+	{Status: bankid.PENDING, HintCode: bankid.USER_SIGN, Collects: 2},
+	{Status: bankid.COMPLETE},
+}
+
+const (
+	DEFAULT_QR_TOLERANCE  = 2
+	DEFAULT_ORDER_TIMEOUT = 3 * time.Minute
+	// How long orders can still be collected once they timed out
+	ORDER_RETENTION = 3 * time.Minute
+)
+
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Users) == 0 {
+		c.Users = DefaultUsers
+	}
+	if len(c.Script) == 0 {
+		c.Script = DefaultScript
+	}
+	if c.QRTolerance <= 0 {
+		c.QRTolerance = DEFAULT_QR_TOLERANCE
+	}
+	if c.OrderTimeout <= 0 {
+		c.OrderTimeout = DEFAULT_ORDER_TIMEOUT
+	}
+}
+
+func (c *Config) findUser(personalNumber string) (User, bool) {
+	for _, user := range c.Users {
+		if user.PersonalNumber == personalNumber {
+			return user, true
+		}
+	}
+	return User{}, false
+}
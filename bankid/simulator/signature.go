@@ -0,0 +1,199 @@
+package simulator
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Keys used to sign completion data like BankID does, the root certificate
+// can be given to bankid.NewSignatureVerifier
+type authority struct {
+	rootCert   *x509.Certificate
+	rootKey    *rsa.PrivateKey
+	signerCert *x509.Certificate
+	signerKey  *rsa.PrivateKey
+}
+
+func newAuthority() (*authority, error) {
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"BankID Simulator"}, CommonName: "Simulated BankID Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	rootCert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	signerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	signerTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{Organization: []string{"BankID Simulator"}, CommonName: "Simulated BankID user"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(2, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+	}
+	signerDER, err := x509.CreateCertificate(rand.Reader, signerTemplate, rootCert, &signerKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	signerCert, err := x509.ParseCertificate(signerDER)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authority{
+		rootCert:   rootCert,
+		rootKey:    rootKey,
+		signerCert: signerCert,
+		signerKey:  signerKey,
+	}, nil
+}
+
+func (a *authority) rootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.rootCert.Raw})
+}
+
+// Builds the base64 encoded XML signature returned in the completion data
+func (a *authority) sign(o *order) (string, error) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8" standalone="no"`)
+	signature := doc.CreateElement("Signature")
+	signature.CreateAttr("xmlns", bankid.XMLDSIG_NAMESPACE)
+
+	signedInfo := signature.CreateElement("SignedInfo")
+	signedInfo.CreateAttr("xmlns", bankid.XMLDSIG_NAMESPACE)
+	signedInfo.CreateElement("CanonicalizationMethod").CreateAttr("Algorithm", string(dsig.CanonicalXML10RecAlgorithmId))
+	signedInfo.CreateElement("SignatureMethod").CreateAttr("Algorithm", "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256")
+	signedDataDigest := addReference(signedInfo, bankid.SIGNED_DATA_ID)
+	keyInfoDigest := addReference(signedInfo, bankid.KEY_INFO_ID)
+	signatureValue := signature.CreateElement("SignatureValue")
+
+	keyInfo := signature.CreateElement("KeyInfo")
+	keyInfo.CreateAttr("xmlns", bankid.XMLDSIG_NAMESPACE)
+	keyInfo.CreateAttr("Id", bankid.KEY_INFO_ID)
+	x509Data := keyInfo.CreateElement("X509Data")
+	x509Data.CreateElement("X509Certificate").SetText(base64.StdEncoding.EncodeToString(a.signerCert.Raw))
+	x509Data.CreateElement("X509Certificate").SetText(base64.StdEncoding.EncodeToString(a.rootCert.Raw))
+
+	signedData := signature.CreateElement("Object").CreateElement("bankIdSignedData")
+	signedData.CreateAttr("xmlns", bankid.BANKID_NAMESPACE)
+	signedData.CreateAttr("Id", bankid.SIGNED_DATA_ID)
+	if o.UserVisibleData != "" {
+		usrVisibleData := signedData.CreateElement("usrVisibleData")
+		usrVisibleData.CreateAttr("charset", "UTF-8")
+		usrVisibleData.CreateAttr("visible", "wysiwys")
+		usrVisibleData.SetText(o.UserVisibleData)
+	}
+	if o.UserNonVisibleData != "" {
+		signedData.CreateElement("usrNonVisibleData").SetText(o.UserNonVisibleData)
+	}
+	signedData.CreateElement("srvInfo").CreateElement("nonce").SetText(base64.StdEncoding.EncodeToString([]byte(o.Ref)))
+
+	canonicalizer := dsig.MakeC14N10RecCanonicalizer()
+	for _, ref := range []struct {
+		el     *etree.Element
+		digest *etree.Element
+	}{{signedData, signedDataDigest}, {keyInfo, keyInfoDigest}} {
+		canonical, err := canonicalize(canonicalizer, ref.el)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(canonical)
+		ref.digest.SetText(base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	canonical, err := canonicalize(canonicalizer, signedInfo)
+	if err != nil {
+		return "", err
+	}
+	hashed := sha256.Sum256(canonical)
+	value, err := rsa.SignPKCS1v15(rand.Reader, a.signerKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	signatureValue.SetText(base64.StdEncoding.EncodeToString(value))
+
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Canonicalizer.Canonicalize gives bankIdSignedData the default namespace of
+// Signature instead of its own, so the digest would not match the one of
+// BankID. Declaring the namespaces in scope on a copy first avoids it.
+func canonicalize(canonicalizer dsig.Canonicalizer, el *etree.Element) ([]byte, error) {
+	ctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil, err
+	}
+	detached, err := etreeutils.NSDetatch(ctx, el)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalizer.Canonicalize(detached)
+}
+
+// OCSP response for the signer certificate, signed directly by the root
+func (a *authority) ocspResponse(revoked bool) (string, error) {
+	now := time.Now()
+	response := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: a.signerCert.SerialNumber,
+		ProducedAt:   now,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if revoked {
+		response.Status = ocsp.Revoked
+		response.RevokedAt = now.Add(-time.Hour)
+		response.RevocationReason = ocsp.KeyCompromise
+	}
+	der, err := ocsp.CreateResponse(a.rootCert, a.rootCert, response, a.rootKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// Adds a reference to the element with the given id, returns where to put its digest
+func addReference(signedInfo *etree.Element, id string) *etree.Element {
+	reference := signedInfo.CreateElement("Reference")
+	reference.CreateAttr("URI", "#"+id)
+	if id == bankid.SIGNED_DATA_ID {
+		reference.CreateAttr("Type", bankid.BANKID_NAMESPACE)
+	}
+	reference.CreateElement("Transforms").CreateElement("Transform").CreateAttr("Algorithm", string(dsig.CanonicalXML10RecAlgorithmId))
+	reference.CreateElement("DigestMethod").CreateAttr("Algorithm", "http://www.w3.org/2001/04/xmlenc#sha256")
+	return reference.CreateElement("DigestValue")
+}
@@ -0,0 +1,448 @@
+// Package simulator implements an offline stand-in for the BankID RP API,
+// to be used during local development and in tests.
+package simulator
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/personnummer"
+)
+
+type order struct {
+	Ref                string
+	Phone              bool
+	PersonalNumber     string
+	EndUserIp          string
+	UserVisibleData    string
+	UserNonVisibleData string
+	AutoStartToken     string
+	QrStartToken       string
+	QrStartSecret      string
+	UHI                string
+	ReturnRisk         bool
+	CreatedAt          time.Time
+	Scanned            bool
+	Step               int
+	Collects           int
+	Expired            bool
+	User               User
+}
+
+type Simulator struct {
+	config    Config
+	mutex     sync.Mutex
+	orders    map[string]*order
+	authority *authority
+}
+
+func New(config Config) (*Simulator, error) {
+	config.setDefaults()
+	authority, err := newAuthority()
+	if err != nil {
+		return nil, fmt.Errorf("simulator: could not generate signing keys: %w", err)
+	}
+	return &Simulator{
+		config:    config,
+		orders:    make(map[string]*order),
+		authority: authority,
+	}, nil
+}
+
+// Root CA the completion data signatures chain up to, to be used as the
+// BankID signature root CA when talking to the simulator.
+func (s *Simulator) RootCAPEM() []byte {
+	return s.authority.rootPEM()
+}
+
+// Starts the simulator on a local port, the returned server URL can be used
+// as BankIDConfig.BaseURL.
+func (s *Simulator) Start() *httptest.Server {
+	return httptest.NewServer(s)
+}
+
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == "/sim/root-ca.pem" {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(s.RootCAPEM())
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, 405, bankid.METHOD_NOT_ALLOWED, "Only POST is supported")
+		return
+	}
+	if r.URL.Path == "/sim/qr" {
+		s.handleQRScan(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/rp/v") {
+		writeError(w, 404, bankid.NOT_FOUND, "No such endpoint")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, 415, bankid.UNSUPPORTED_MEDIA_TYPE, "Content-Type must be application/json")
+		return
+	}
+	// Strip /rp/v<version>
+	path := r.URL.Path[len("/rp/v"):]
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[i:]
+	}
+	switch path {
+	case "/auth", "/sign":
+		s.handleStart(w, r, false)
+	case "/phone/auth", "/phone/sign":
+		s.handleStart(w, r, true)
+	case "/collect":
+		s.handleCollect(w, r)
+	case "/cancel":
+		s.handleCancel(w, r)
+	default:
+		writeError(w, 404, bankid.NOT_FOUND, "No such endpoint")
+	}
+}
+
+// Fields shared by all the order creating requests
+type startRequest struct {
+	EndUserIp          string                          `json:"endUserIp"`
+	PersonalNumber     string                          `json:"personalNumber"`
+	CallInitiator      bankid.CallInitiator            `json:"callInitiator"`
+	UserVisibleData    string                          `json:"userVisibleData"`
+	UserNonVisibleData string                          `json:"userNonVisibleData"`
+	Requirement        *bankid.AuthRequestRequirements `json:"requirement"`
+	App                *bankid.AppDevice               `json:"app"`
+	Web                *bankid.WebDevice               `json:"web"`
+	ReturnRisk         bool                            `json:"returnRisk"`
+}
+
+func (s *Simulator) handleStart(w http.ResponseWriter, r *http.Request, phone bool) {
+	var request startRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Invalid JSON")
+		return
+	}
+	personalNumber := request.PersonalNumber
+	if request.Requirement != nil && request.Requirement.PersonalNumber != "" {
+		personalNumber = request.Requirement.PersonalNumber
+	}
+	if personalNumber != "" && !personnummer.Valid(personalNumber) {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Invalid personalNumber")
+		return
+	}
+	if phone {
+		if personalNumber == "" {
+			writeError(w, 400, bankid.INVALID_PARAMETERS, "Missing personalNumber")
+			return
+		}
+		if request.CallInitiator != bankid.UserCallInitiator && request.CallInitiator != bankid.RPCallInitiator {
+			writeError(w, 400, bankid.INVALID_PARAMETERS, "Invalid callInitiator")
+			return
+		}
+	} else if request.EndUserIp == "" {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Missing endUserIp")
+		return
+	}
+	if request.App != nil && request.Web != nil {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Only one of app and web can be given")
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/sign") && request.UserVisibleData == "" {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Missing userVisibleData")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expireOrders()
+	if personalNumber != "" {
+		for ref, o := range s.orders {
+			if o.PersonalNumber == personalNumber && !s.isTerminal(o) {
+				// Like BankID, abort the order in progress without creating a new one
+				delete(s.orders, ref)
+				writeError(w, 400, bankid.ALREADY_IN_PROGRESS, "Order already in progress for personalNumber")
+				return
+			}
+		}
+	}
+	o := &order{
+		Phone:              phone,
+		PersonalNumber:     personalNumber,
+		EndUserIp:          request.EndUserIp,
+		UserVisibleData:    request.UserVisibleData,
+		UserNonVisibleData: request.UserNonVisibleData,
+		ReturnRisk:         request.ReturnRisk,
+		CreatedAt:          time.Now(),
+	}
+	for _, id := range []*string{&o.Ref, &o.AutoStartToken, &o.QrStartToken, &o.QrStartSecret, &o.UHI} {
+		var err error
+		if *id, err = randomUUID(); err != nil {
+			writeError(w, 500, bankid.INTERNAL_ERROR, err.Error())
+			return
+		}
+	}
+	s.orders[o.Ref] = o
+
+	response := bankid.AuthResponse{
+		OrderRef: o.Ref,
+	}
+	if !phone {
+		response.AutoStartToken = o.AutoStartToken
+		response.QrStartToken = o.QrStartToken
+		response.QrStartSecret = o.QrStartSecret
+	}
+	writeJSON(w, 200, response)
+}
+
+func (s *Simulator) handleCollect(w http.ResponseWriter, r *http.Request) {
+	var request bankid.CollectRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Invalid JSON")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expireOrders()
+	o, ok := s.orders[request.OrderRef]
+	if !ok {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "No such order")
+		return
+	}
+	step := s.advance(o)
+	response := bankid.CollectResponse{
+		CollectRequest: bankid.CollectRequest{OrderRef: o.Ref},
+		Status:         step.Status,
+		HintCode:       step.HintCode,
+	}
+	if step.Status == bankid.COMPLETE {
+		completionData, err := s.completionData(o)
+		if err != nil {
+			writeError(w, 500, bankid.INTERNAL_ERROR, err.Error())
+			return
+		}
+		response.HintCode = ""
+		response.CompletionData = completionData
+	}
+	writeJSON(w, 200, response)
+}
+
+func (s *Simulator) handleCancel(w http.ResponseWriter, r *http.Request) {
+	var request bankid.CancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Invalid JSON")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.orders[request.OrderRef]; !ok {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "No such order")
+		return
+	}
+	delete(s.orders, request.OrderRef)
+	writeJSON(w, 200, struct{}{})
+}
+
+type qrScanRequest struct {
+	QrData string `json:"qrData"`
+	// Picks the test user scanning the code, the first configured user otherwise
+	PersonalNumber string `json:"personalNumber"`
+}
+
+// Simulates the BankID app scanning an animated QR code, verifying it the same
+// way BankID does.
+func (s *Simulator) handleQRScan(w http.ResponseWriter, r *http.Request) {
+	var request qrScanRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Invalid JSON")
+		return
+	}
+	parts := strings.Split(request.QrData, ".")
+	if len(parts) != 4 || parts[0] != "bankid" {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Malformed QR data")
+		return
+	}
+	qrTime, err := strconv.Atoi(parts[2])
+	if err != nil {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Malformed QR time")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expireOrders()
+	var o *order
+	for _, candidate := range s.orders {
+		if candidate.QrStartToken == parts[1] {
+			o = candidate
+			break
+		}
+	}
+	if o == nil {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "No order for QR start token")
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(o.QrStartSecret))
+	mac.Write([]byte(parts[2]))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(parts[3])) {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, "Invalid QR auth code")
+		return
+	}
+	age := int(time.Since(o.CreatedAt).Seconds())
+	if qrTime < age-s.config.QRTolerance || qrTime > age+s.config.QRTolerance {
+		writeError(w, 400, bankid.INVALID_PARAMETERS, fmt.Sprintf("QR code is for time %d but order is %d seconds old", qrTime, age))
+		return
+	}
+	if request.PersonalNumber != "" {
+		user, ok := s.config.findUser(request.PersonalNumber)
+		if !ok {
+			writeError(w, 400, bankid.INVALID_PARAMETERS, "Unknown test user")
+			return
+		}
+		o.User = user
+		o.PersonalNumber = user.PersonalNumber
+	}
+	o.Scanned = true
+	writeJSON(w, 200, struct{}{})
+}
+
+// State machine
+
+func (s *Simulator) script(o *order) []Step {
+	if len(s.user(o).Script) > 0 {
+		return s.user(o).Script
+	}
+	if o.Phone {
+		return phoneScript
+	}
+	return s.config.Script
+}
+
+func (s *Simulator) user(o *order) User {
+	if o.User.PersonalNumber != "" {
+		return o.User
+	}
+	if user, ok := s.config.findUser(o.PersonalNumber); ok {
+		return user
+	}
+	return s.config.Users[0]
+}
+
+var expiredStep = Step{Status: bankid.FAILED, HintCode: bankid.EXPIRED_TRANSACTION}
+
+// Reports the current step of the order and moves it forward
+func (s *Simulator) advance(o *order) Step {
+	if o.Expired {
+		return expiredStep
+	}
+	script := s.script(o)
+	if o.Step >= len(script) {
+		o.Step = len(script) - 1
+	}
+	step := script[o.Step]
+	waitingForScan := s.config.RequireQRScan && !o.Phone && !o.Scanned && o.Step == 0
+	if waitingForScan || o.Step == len(script)-1 {
+		return step
+	}
+	o.Collects++
+	if o.Collects >= step.Collects {
+		o.Step++
+		o.Collects = 0
+	}
+	return step
+}
+
+func (s *Simulator) isTerminal(o *order) bool {
+	if o.Expired {
+		return true
+	}
+	script := s.script(o)
+	if o.Step >= len(script) {
+		return true
+	}
+	return script[o.Step].Status != bankid.PENDING
+}
+
+// Like BankID, orders not finished in time fail with expiredTransaction and
+// can still be collected for a while before being forgotten
+func (s *Simulator) expireOrders() {
+	for ref, o := range s.orders {
+		age := time.Since(o.CreatedAt)
+		if age > s.config.OrderTimeout+ORDER_RETENTION {
+			delete(s.orders, ref)
+		} else if age > s.config.OrderTimeout && !s.isTerminal(o) {
+			o.Expired = true
+		}
+	}
+}
+
+func (s *Simulator) completionData(o *order) (bankid.CollectCompletionData, error) {
+	signature, err := s.authority.sign(o)
+	if err != nil {
+		return bankid.CollectCompletionData{}, err
+	}
+	user := s.user(o)
+	ocspResponse, err := s.authority.ocspResponse(user.Revoked)
+	if err != nil {
+		return bankid.CollectCompletionData{}, err
+	}
+	var risk bankid.RiskLevel
+	if o.ReturnRisk {
+		risk = user.Risk
+		if risk == "" {
+			risk = bankid.RISK_LOW
+		}
+	}
+	return bankid.CollectCompletionData{
+		User: bankid.CompletionDataUser{
+			PersonalNumber: user.PersonalNumber,
+			Name:           user.Name(),
+			GivenName:      user.GivenName,
+			Surname:        user.Surname,
+		},
+		Device: bankid.CompletionDataDevice{
+			IpAddress: o.EndUserIp,
+			UHI:       o.UHI,
+		},
+		BankIdIssueDate: time.Now().AddDate(-1, 0, 0).Format("2006-01-02"),
+		Signature:       signature,
+		OcspResponse:    ocspResponse,
+		Risk:            risk,
+	}, nil
+}
+
+// Utils
+
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("simulator: could not generate identifier: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, errorCode bankid.ErrorCode, details string) {
+	writeJSON(w, code, bankid.BankIDResponse{
+		ErrorCode: string(errorCode),
+		Details:   details,
+	})
+}
@@ -0,0 +1,373 @@
+package simulator_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Splinter0/identity/audit"
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/bankid/simulator"
+)
+
+// Orders complete on the first collect, so tests do not wait on the script
+var quickScript = []simulator.Step{
+	{Status: bankid.COMPLETE},
+}
+
+type testProvider struct {
+	*bankid.BankIDProvider
+	url string
+}
+
+// Provider talking to a simulator started for the test, verifying the
+// signatures it returns
+func newTestProvider(t *testing.T, config simulator.Config) testProvider {
+	t.Helper()
+	sim, err := simulator.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := sim.Start()
+	t.Cleanup(server.Close)
+
+	rootCA := filepath.Join(t.TempDir(), "root-ca.pem")
+	if err := os.WriteFile(rootCA, sim.RootCAPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rp := bankid.NewBankIDRPWithClient(&bankid.BankIDConfig{
+		Env:             bankid.TEST,
+		Version:         bankid.LATEST_VERSION,
+		BaseURL:         server.URL,
+		SignatureRootCA: rootCA,
+	}, server.Client())
+	provider := bankid.NewBankIDProviderWithStore(rp, bankid.NewMemoryStore())
+	t.Cleanup(provider.Close)
+	return testProvider{BankIDProvider: provider, url: server.URL}
+}
+
+// Waits for the poller to collect the order until it is no longer pending
+func (p testProvider) wait(t *testing.T, transactionKey string) bankid.BankIDStatusResponse {
+	t.Helper()
+	updates, unsubscribe := p.Subscribe(transactionKey)
+	defer unsubscribe()
+	deadline := time.After(15 * time.Second)
+	for {
+		status, err := p.StatusContext(context.Background(), transactionKey)
+		if err != nil {
+			t.Fatalf("status: %v", err)
+		}
+		if status.Status != bankid.PENDING {
+			return status
+		}
+		select {
+		case <-updates:
+		case <-time.After(time.Second):
+		case <-deadline:
+			t.Fatalf("order still pending, last message %q", status.Message)
+		}
+	}
+}
+
+func (p testProvider) orderRef(t *testing.T, transactionKey string) string {
+	t.Helper()
+	transaction, ok, err := p.Store.Get(context.Background(), transactionKey)
+	if err != nil || !ok {
+		t.Fatalf("transaction not found: %v", err)
+	}
+	return transaction.OrderRef
+}
+
+func (p testProvider) scan(t *testing.T, qrData string) int {
+	t.Helper()
+	resp, err := http.Post(p.url+"/sim/qr", "application/json", bytes.NewBufferString(`{"qrData":"`+qrData+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAuthenticateComplete(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{Script: quickScript})
+	response, err := p.AuthenticateContext(context.Background(), bankid.BankIDAuthenticationRequest{
+		UserIp:         "192.0.2.1",
+		MessageForUser: "Log in to the test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Success || response.QrCodeData == "" || response.TransactionKey == "" {
+		t.Fatalf("unexpected start response %+v", response)
+	}
+
+	status := p.wait(t, response.TransactionKey)
+	if status.Status != bankid.COMPLETE {
+		t.Fatalf("status %s (%s), want complete", status.Status, status.Reason)
+	}
+	if status.Type != bankid.AUTH {
+		t.Errorf("type %s, want auth", status.Type)
+	}
+	completionData, ok := status.Data.(bankid.CollectCompletionData)
+	if !ok {
+		t.Fatalf("data is %T, want completion data", status.Data)
+	}
+	if got := completionData.User.PersonalNumber; got != simulator.DefaultUsers[0].PersonalNumber {
+		t.Errorf("completed by %s, want the first test user", got)
+	}
+	if status.Signature == nil || status.OCSP == nil || status.OCSP.Status != bankid.OCSP_GOOD {
+		t.Errorf("signature and OCSP response were not verified: %+v %+v", status.Signature, status.OCSP)
+	}
+}
+
+func TestSignComplete(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{Script: quickScript})
+	response, err := p.SignContext(context.Background(), bankid.BankIDSignRequest{
+		UserIp:             "192.0.2.1",
+		UserVisibleData:    "Transfer 100 SEK",
+		UserNonVisibleData: "transfer-42",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := p.wait(t, response.TransactionKey)
+	if status.Status != bankid.COMPLETE {
+		t.Fatalf("status %s (%s), want complete", status.Status, status.Reason)
+	}
+	if status.Type != bankid.SIGN {
+		t.Errorf("type %s, want sign", status.Type)
+	}
+	visible := base64.StdEncoding.EncodeToString([]byte("Transfer 100 SEK"))
+	if status.Signature == nil || status.Signature.UserVisibleData != visible {
+		t.Errorf("signed data %+v, want %q", status.Signature, visible)
+	}
+}
+
+// Keeps the audit events in memory
+type auditEvents struct {
+	mutex  sync.Mutex
+	events []audit.Event
+}
+
+func (a *auditEvents) Write(ctx context.Context, event audit.Event) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.events = append(a.events, event)
+	return nil
+}
+
+func (a *auditEvents) Close() error {
+	return nil
+}
+
+func (a *auditEvents) count(eventType audit.EventType) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	n := 0
+	for _, event := range a.events {
+		if event.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCancel(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{})
+	events := &auditEvents{}
+	p.Audit = events
+	response, err := p.AuthenticateContext(context.Background(), bankid.BankIDAuthenticationRequest{
+		UserIp: "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderRef := p.orderRef(t, response.TransactionKey)
+
+	if err := p.CancelContext(context.Background(), response.TransactionKey); err != nil {
+		t.Fatal(err)
+	}
+	status, err := p.StatusContext(context.Background(), response.TransactionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != bankid.FAILED || status.Reason != "cancelled" {
+		t.Errorf("status %s (%s), want failed because cancelled", status.Status, status.Reason)
+	}
+	if cancelled, failed := events.count(audit.ORDER_CANCELLED), events.count(audit.ORDER_FAILED); cancelled != 1 || failed != 0 {
+		t.Errorf("recorded %d cancellations and %d failures, want the cancellation only", cancelled, failed)
+	}
+
+	// The order is gone on the BankID side too
+	_, err = p.Client.DoCollectionContext(context.Background(), orderRef)
+	var bankIDErr *bankid.BankIDError
+	if !errors.As(err, &bankIDErr) || bankIDErr.ErrorCode != bankid.INVALID_PARAMETERS {
+		t.Errorf("collecting a cancelled order returned %v, want invalidParameters", err)
+	}
+}
+
+func TestUserCancel(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{})
+	// The second test user cancels in the app
+	response, err := p.PhoneAuthenticateContext(context.Background(), bankid.BankIDPhoneRequest{
+		PersonalNumber: simulator.DefaultUsers[1].PersonalNumber,
+		CallInitiator:  bankid.UserCallInitiator,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := p.wait(t, response.TransactionKey)
+	if status.Status != bankid.FAILED || status.HintCode != bankid.USER_CANCEL {
+		t.Errorf("status %s (%s), want failed with userCancel", status.Status, status.HintCode)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{OrderTimeout: time.Second})
+	response, err := p.AuthenticateContext(context.Background(), bankid.BankIDAuthenticationRequest{
+		UserIp: "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := p.wait(t, response.TransactionKey)
+	if status.Status != bankid.FAILED || status.HintCode != bankid.EXPIRED_TRANSACTION {
+		t.Errorf("status %s (%s), want failed with expiredTransaction", status.Status, status.HintCode)
+	}
+	if status.Message != bankid.GetLocalizedMessage("RFA8", bankid.DEFAULT_LANGUAGE) {
+		t.Errorf("message %q, want RFA8", status.Message)
+	}
+}
+
+// Outcome the listeners are told about
+func (p testProvider) listen() <-chan bankid.TransactionEvent {
+	events := make(chan bankid.TransactionEvent, 1)
+	p.AddListener(func(event bankid.TransactionEvent) {
+		events <- event
+	})
+	return events
+}
+
+func expectExpired(t *testing.T, events <-chan bankid.TransactionEvent) {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Status != bankid.FAILED || event.HintCode != bankid.EXPIRED_TRANSACTION {
+			t.Errorf("listener told %s (%s), want failed with expiredTransaction", event.Status, event.HintCode)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("listener was not told about the order")
+	}
+}
+
+func TestOrderForgotten(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{})
+	events := p.listen()
+	response, err := p.AuthenticateContext(context.Background(), bankid.BankIDAuthenticationRequest{
+		UserIp: "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Behind the back of the provider, so BankID no longer knows the order
+	if err := p.Client.CancelContext(context.Background(), p.orderRef(t, response.TransactionKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	status := p.wait(t, response.TransactionKey)
+	if status.Status != bankid.FAILED || status.HintCode != bankid.EXPIRED_TRANSACTION {
+		t.Errorf("status %s (%s), want failed with expiredTransaction", status.Status, status.HintCode)
+	}
+	expectExpired(t, events)
+}
+
+func TestTransactionGone(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{})
+	events := p.listen()
+	response, err := p.AuthenticateContext(context.Background(), bankid.BankIDAuthenticationRequest{
+		UserIp: "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Store.Delete(context.Background(), response.TransactionKey); err != nil {
+		t.Fatal(err)
+	}
+	expectExpired(t, events)
+}
+
+func TestAnimatedQR(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, simulator.Config{
+		RequireQRScan: true,
+		Script: []simulator.Step{
+			{Status: bankid.PENDING, HintCode: bankid.OUTSTANDING_TRANSACTION, Collects: 1},
+			{Status: bankid.COMPLETE},
+		},
+	})
+	response, err := p.AuthenticateContext(context.Background(), bankid.BankIDAuthenticationRequest{
+		UserIp: "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction, _, err := p.Store.Get(context.Background(), response.TransactionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	current, ok := p.QRData(response.TransactionKey, now)
+	if !ok {
+		t.Fatal("no QR data for a QR order")
+	}
+	if next, _ := p.QRData(response.TransactionKey, now.Add(time.Second)); next == current {
+		t.Error("QR data does not change every second")
+	}
+	// A code for another time or with another secret is refused
+	if code := p.scan(t, bankid.GenerateQRDataAt(transaction.QrStartToken, transaction.QrStartSecret, 60)); code != 400 {
+		t.Errorf("QR code for a later time returned %d, want 400", code)
+	}
+	if code := p.scan(t, bankid.GenerateQRDataAt(transaction.QrStartToken, "wrong", 0)); code != 400 {
+		t.Errorf("QR code with the wrong secret returned %d, want 400", code)
+	}
+
+	// Nobody scanned it yet
+	time.Sleep(2*bankid.COLLECT_INTERVAL + 500*time.Millisecond)
+	status, err := p.StatusContext(context.Background(), response.TransactionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != bankid.PENDING {
+		t.Fatalf("status %s before scanning, want pending", status.Status)
+	}
+	qrData, ok := status.Data.(map[string]string)
+	if !ok || qrData["qrData"] == "" {
+		t.Fatalf("pending status has no QR data: %+v", status.Data)
+	}
+
+	if code := p.scan(t, qrData["qrData"]); code != 200 {
+		t.Fatalf("scanning the current QR code returned %d", code)
+	}
+	status = p.wait(t, response.TransactionKey)
+	if status.Status != bankid.COMPLETE {
+		t.Errorf("status %s (%s) after scanning, want complete", status.Status, status.Reason)
+	}
+}
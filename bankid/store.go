@@ -0,0 +1,165 @@
+package bankid
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Where ongoing transactions are kept. Anything but the memory store can be
+// shared by several instances of the service and survives restarts.
+type TransactionStore interface {
+	ValueStore
+	Get(ctx context.Context, key string) (BankIDTransaction, bool, error)
+	Set(ctx context.Context, key string, transaction BankIDTransaction, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	// Applies update to the transaction, only storing the result if the
+	// transaction was not changed in the meantime, and keeps its TTL. Returns
+	// false when the transaction does not exist.
+	Update(ctx context.Context, key string, update func(*BankIDTransaction)) (bool, error)
+	// Number of ongoing transactions, leaving out the finished and cancelled
+	// ones kept until they expire
+	Ongoing(ctx context.Context) (int, error)
+	Close() error
+}
+
+// Short lived values of the rest of the service, e.g. OIDC authorization
+// codes, kept apart from the transactions
+type ValueStore interface {
+	SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	GetValue(ctx context.Context, key string) ([]byte, bool, error)
+	// Gets and deletes the value at once, so only one caller ever gets it
+	TakeValue(ctx context.Context, key string) ([]byte, bool, error)
+}
+
+type StoreType string
+
+const (
+	MEMORY_STORE StoreType = "memory"
+	BOLT_STORE   StoreType = "bolt"
+	REDIS_STORE  StoreType = "redis"
+)
+
+type StoreConfig struct {
+	Type StoreType `yaml:"type"`
+	// Database file of the bolt store
+	Path  string      `yaml:"path"`
+	Redis RedisConfig `yaml:"redis"`
+}
+
+func NewTransactionStore(config StoreConfig) (TransactionStore, error) {
+	switch config.Type {
+	case "", MEMORY_STORE:
+		return NewMemoryStore(), nil
+	case BOLT_STORE:
+		return NewBoltStore(config.Path)
+	case REDIS_STORE:
+		return NewRedisStore(config.Redis)
+	default:
+		return nil, fmt.Errorf("unknown transaction store %q, must be 'memory', 'bolt' or 'redis'", config.Type)
+	}
+}
+
+// Process local store, transactions are lost on restart
+type MemoryStore struct {
+	cache  *cache.Cache
+	values *cache.Cache
+	mutex  sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		cache:  cache.New(cache.NoExpiration, 1*time.Minute),
+		values: cache.New(cache.NoExpiration, 1*time.Minute),
+	}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (BankIDTransaction, bool, error) {
+	value, found := s.cache.Get(key)
+	if !found {
+		return BankIDTransaction{}, false, nil
+	}
+	transaction, ok := value.(BankIDTransaction)
+	return transaction, ok, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, transaction BankIDTransaction, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cache.Set(key, transaction, ttl)
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cache.Delete(key)
+	return nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, key string, update func(*BankIDTransaction)) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, expiration, found := s.cache.GetWithExpiration(key)
+	if !found {
+		return false, nil
+	}
+	transaction, ok := value.(BankIDTransaction)
+	if !ok {
+		return false, nil
+	}
+	update(&transaction)
+	ttl := cache.NoExpiration
+	if !expiration.IsZero() {
+		ttl = time.Until(expiration)
+		// Zero or less would store it without expiry
+		if ttl <= 0 {
+			s.cache.Delete(key)
+			return false, nil
+		}
+	}
+	s.cache.Set(key, transaction, ttl)
+	return true, nil
+}
+
+func (s *MemoryStore) Ongoing(ctx context.Context) (int, error) {
+	count := 0
+	// Unlike ItemCount, leaves out expired transactions not removed yet
+	for _, item := range s.cache.Items() {
+		if transaction, ok := item.Object.(BankIDTransaction); ok && transaction.isOngoing() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.values.Set(key, value, ttl)
+	return nil
+}
+
+func (s *MemoryStore) GetValue(ctx context.Context, key string) ([]byte, bool, error) {
+	value, found := s.values.Get(key)
+	if !found {
+		return nil, false, nil
+	}
+	return value.([]byte), true, nil
+}
+
+func (s *MemoryStore) TakeValue(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, found := s.values.Get(key)
+	if !found {
+		return nil, false, nil
+	}
+	s.values.Delete(key)
+	return value.([]byte), true, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
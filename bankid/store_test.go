@@ -0,0 +1,358 @@
+package bankid_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/Splinter0/identity/bankid"
+)
+
+// Every store has to behave the same, time only passes through elapse so
+// Redis can be fast-forwarded
+type storeContract struct {
+	store  bankid.TransactionStore
+	elapse func(time.Duration)
+}
+
+var testStores = map[string]func(t *testing.T) storeContract{
+	"memory": func(t *testing.T) storeContract {
+		return storeContract{store: bankid.NewMemoryStore(), elapse: time.Sleep}
+	},
+	"bolt": func(t *testing.T) storeContract {
+		store, err := bankid.NewBoltStore(filepath.Join(t.TempDir(), "transactions.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storeContract{store: store, elapse: time.Sleep}
+	},
+	"redis": func(t *testing.T) storeContract {
+		server := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		// The clock of the server moves along with the TTLs
+		now := time.Now()
+		server.SetTime(now)
+		elapse := func(d time.Duration) {
+			now = now.Add(d)
+			server.SetTime(now)
+			server.FastForward(d)
+		}
+		return storeContract{store: bankid.NewRedisStoreWithClient(client, ""), elapse: elapse}
+	},
+}
+
+// Runs the test against a fresh store of every type
+func forEachStore(t *testing.T, test func(t *testing.T, s storeContract)) {
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			t.Cleanup(func() {
+				if err := s.store.Close(); err != nil {
+					t.Errorf("close: %v", err)
+				}
+			})
+			test(t, s)
+		})
+	}
+}
+
+func mustGet(t *testing.T, store bankid.TransactionStore, key string) (bankid.BankIDTransaction, bool) {
+	t.Helper()
+	transaction, ok, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	return transaction, ok
+}
+
+func TestStoreGetSetDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		if _, ok := mustGet(t, s.store, "missing"); ok {
+			t.Error("found a transaction never stored")
+		}
+
+		transaction := bankid.BankIDTransaction{
+			Type:     bankid.AUTH,
+			Flow:     bankid.FLOW_QR,
+			OrderRef: "order-1",
+			Collect: &bankid.CollectResponse{
+				Status:   bankid.PENDING,
+				HintCode: bankid.OUTSTANDING_TRANSACTION,
+			},
+			CertificatePolicies: []string{"1.2.752.78.1.5"},
+		}
+		if err := s.store.Set(ctx, "key", transaction, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := mustGet(t, s.store, "key")
+		if !ok {
+			t.Fatal("stored transaction not found")
+		}
+		if got.OrderRef != transaction.OrderRef || got.Flow != transaction.Flow || got.Collect == nil || got.Collect.HintCode != bankid.OUTSTANDING_TRANSACTION || len(got.CertificatePolicies) != 1 {
+			t.Errorf("got %+v, want %+v", got, transaction)
+		}
+
+		transaction.OrderRef = "order-2"
+		if err := s.store.Set(ctx, "key", transaction, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := mustGet(t, s.store, "key"); got.OrderRef != "order-2" {
+			t.Errorf("order %s after overwriting, want order-2", got.OrderRef)
+		}
+
+		if err := s.store.Delete(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := mustGet(t, s.store, "key"); ok {
+			t.Error("deleted transaction still found")
+		}
+		if err := s.store.Delete(ctx, "key"); err != nil {
+			t.Errorf("deleting a missing transaction: %v", err)
+		}
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		updated, err := s.store.Update(ctx, "missing", func(transaction *bankid.BankIDTransaction) {
+			transaction.Cancelled = true
+		})
+		if err != nil || updated {
+			t.Errorf("updating a missing transaction returned %v, %v", updated, err)
+		}
+		if _, ok := mustGet(t, s.store, "missing"); ok {
+			t.Error("update created the transaction")
+		}
+
+		if err := s.store.Set(ctx, "key", bankid.BankIDTransaction{OrderRef: "order"}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		updated, err = s.store.Update(ctx, "key", func(transaction *bankid.BankIDTransaction) {
+			transaction.Cancelled = true
+		})
+		if err != nil || !updated {
+			t.Fatalf("update returned %v, %v", updated, err)
+		}
+		if got, _ := mustGet(t, s.store, "key"); !got.Cancelled || got.OrderRef != "order" {
+			t.Errorf("got %+v after update", got)
+		}
+	})
+}
+
+// Concurrent updates conflict, none of them may be lost
+func TestStoreUpdateConflict(t *testing.T) {
+	const writers = 8
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		if err := s.store.Set(ctx, "key", bankid.BankIDTransaction{}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.store.Update(ctx, "key", func(transaction *bankid.BankIDTransaction) {
+					policies := append(transaction.CertificatePolicies, "policy")
+					// Gives the other writers time to change it in the meantime
+					time.Sleep(time.Millisecond)
+					transaction.CertificatePolicies = policies
+				})
+				if err != nil {
+					t.Errorf("update: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if got, _ := mustGet(t, s.store, "key"); len(got.CertificatePolicies) != writers {
+			t.Errorf("%d updates went through, want %d", len(got.CertificatePolicies), writers)
+		}
+	})
+}
+
+func TestStoreExpiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		if err := s.store.Set(ctx, "short", bankid.BankIDTransaction{}, 200*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.store.Set(ctx, "long", bankid.BankIDTransaction{}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		// Updates keep the TTL
+		if _, err := s.store.Update(ctx, "short", func(transaction *bankid.BankIDTransaction) {
+			transaction.Finished = true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		s.elapse(300 * time.Millisecond)
+
+		if _, ok := mustGet(t, s.store, "short"); ok {
+			t.Error("transaction found after its TTL")
+		}
+		if _, ok := mustGet(t, s.store, "long"); !ok {
+			t.Error("transaction expired before its TTL")
+		}
+		updated, err := s.store.Update(ctx, "short", func(transaction *bankid.BankIDTransaction) {})
+		if err != nil || updated {
+			t.Errorf("updating an expired transaction returned %v, %v", updated, err)
+		}
+	})
+}
+
+// The transaction expires while it is being updated
+func TestStoreUpdateExpiring(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		if err := s.store.Set(ctx, "key", bankid.BankIDTransaction{OrderRef: "order"}, 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		updated, err := s.store.Update(ctx, "key", func(transaction *bankid.BankIDTransaction) {
+			s.elapse(150 * time.Millisecond)
+			transaction.Finished = true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated {
+			t.Error("update of an expired transaction went through")
+		}
+		s.elapse(time.Second)
+		if _, ok := mustGet(t, s.store, "key"); ok {
+			t.Error("transaction kept without expiry after it expired during an update")
+		}
+	})
+}
+
+func TestStoreOngoing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		count := func() int {
+			t.Helper()
+			n, err := s.store.Ongoing(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		set := func(key string, transaction bankid.BankIDTransaction, ttl time.Duration) {
+			t.Helper()
+			if err := s.store.Set(ctx, key, transaction, ttl); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := count(); n != 0 {
+			t.Errorf("empty store has %d ongoing transactions", n)
+		}
+		pending := bankid.BankIDTransaction{Collect: &bankid.CollectResponse{Status: bankid.PENDING}}
+		for _, key := range []string{"a", "b", "c", "d"} {
+			set(key, pending, time.Minute)
+		}
+		set("started", bankid.BankIDTransaction{}, time.Minute)
+		set("short", pending, 200*time.Millisecond)
+		// Kept until they expire, but no longer waiting for the user
+		set("complete", bankid.BankIDTransaction{Collect: &bankid.CollectResponse{Status: bankid.COMPLETE}}, time.Minute)
+		set("failed", bankid.BankIDTransaction{Collect: &bankid.CollectResponse{Status: bankid.FAILED}}, time.Minute)
+		set("cancelled", bankid.BankIDTransaction{Cancelled: true}, time.Minute)
+		if n := count(); n != 6 {
+			t.Errorf("%d ongoing transactions, want 6", n)
+		}
+
+		if err := s.store.Delete(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.store.Update(ctx, "b", func(transaction *bankid.BankIDTransaction) {
+			transaction.Collect = &bankid.CollectResponse{Status: bankid.COMPLETE}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.store.Update(ctx, "c", func(transaction *bankid.BankIDTransaction) {
+			transaction.Cancelled = true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// Replaced by a finished transaction
+		set("d", bankid.BankIDTransaction{Collect: &bankid.CollectResponse{Status: bankid.FAILED}}, time.Minute)
+		s.elapse(300 * time.Millisecond)
+		if n := count(); n != 1 {
+			t.Errorf("%d ongoing transactions after a delete, updates and an expiry, want 1", n)
+		}
+	})
+}
+
+func TestStoreTakeValue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		if err := s.store.SetValue(ctx, "code", []byte("grant"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.store.SetValue(ctx, "short", []byte("grant"), 200*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		// Values are apart from the transactions
+		if _, ok := mustGet(t, s.store, "code"); ok {
+			t.Error("value found as a transaction")
+		}
+		value, ok, err := s.store.GetValue(ctx, "code")
+		if err != nil || !ok || string(value) != "grant" {
+			t.Fatalf("get returned %q, %v, %v", value, ok, err)
+		}
+		value, ok, err = s.store.TakeValue(ctx, "code")
+		if err != nil || !ok || string(value) != "grant" {
+			t.Fatalf("take returned %q, %v, %v", value, ok, err)
+		}
+		if _, ok, err := s.store.TakeValue(ctx, "code"); err != nil || ok {
+			t.Errorf("value taken twice: %v, %v", ok, err)
+		}
+		if _, ok, err := s.store.GetValue(ctx, "code"); err != nil || ok {
+			t.Errorf("value found once taken: %v, %v", ok, err)
+		}
+		s.elapse(300 * time.Millisecond)
+		if _, ok, err := s.store.GetValue(ctx, "short"); err != nil || ok {
+			t.Errorf("value found after its TTL: %v, %v", ok, err)
+		}
+		if _, ok, err := s.store.TakeValue(ctx, "short"); err != nil || ok {
+			t.Errorf("value taken after its TTL: %v, %v", ok, err)
+		}
+	})
+}
+
+// Only one of the instances exchanging the same code gets it
+func TestStoreTakeValueConflict(t *testing.T) {
+	const takers = 8
+	forEachStore(t, func(t *testing.T, s storeContract) {
+		ctx := context.Background()
+		if err := s.store.SetValue(ctx, "code", []byte("grant"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		taken := 0
+		for i := 0; i < takers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, ok, err := s.store.TakeValue(ctx, "code")
+				if err != nil {
+					t.Errorf("take: %v", err)
+				}
+				if ok {
+					mutex.Lock()
+					taken++
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if taken != 1 {
+			t.Errorf("value taken %d times, want once", taken)
+		}
+	})
+}
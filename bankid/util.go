@@ -1,17 +1,24 @@
 package bankid
 
 import (
-	"crypto/md5"
-	"fmt"
-	"io"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
 )
 
-func md5sum(in string) string {
-	hasher := md5.New()
-	io.WriteString(hasher, in)
-	hash := hasher.Sum(nil)
-	return fmt.Sprintf("%x", hash)
+// Hex encoded random bytes from the CSPRNG
+func randomToken(size int) (string, error) {
+	token := make([]byte, size)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+func sha256sum(in string) string {
+	hash := sha256.Sum256([]byte(in))
+	return hex.EncodeToString(hash[:])
 }
 
 func IsMobileUserAgent(userAgent string) bool {
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Splinter0/identity/audit"
+)
+
+func main() {
+	file := flag.String("file", "audit.jsonl", "audit log to verify")
+	head := flag.String("head", "", "optional hash of a record seen before, to detect records removed from the end")
+	flag.Parse()
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+	defer f.Close()
+
+	// Same as the 'key' of the audit config, not a flag to keep it out of the
+	// process list
+	key := []byte(os.Getenv("IDENTITY_AUDIT_KEY"))
+	result, err := audit.Verify(f, key, *head)
+	if err != nil {
+		log.Fatalf("Audit log is not valid: %v", err)
+	}
+	fmt.Printf("Audit log is valid: %d records, the last one is %d with hash %s\n", result.Records, result.Sequence, result.Hash)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Splinter0/identity/bankid/simulator"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8081", "address to listen on")
+	configPath := flag.String("config", "", "optional YAML file with test users and scripts")
+	rootCAOut := flag.String("root-ca-out", "", "optional file to write the signature root CA to, for 'signatureRootCA'")
+	flag.Parse()
+
+	var config simulator.Config
+	var err error
+	if *configPath != "" {
+		config, err = simulator.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Error loading simulator config: %v", err)
+		}
+	}
+
+	sim, err := simulator.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *rootCAOut != "" {
+		if err := os.WriteFile(*rootCAOut, sim.RootCAPEM(), 0644); err != nil {
+			log.Fatalf("Error writing root CA: %v", err)
+		}
+	}
+
+	log.Printf("BankID simulator listening on http://%s, set it as 'baseUrl' in the bankid config", *addr)
+	log.Fatal(http.ListenAndServe(*addr, sim))
+}
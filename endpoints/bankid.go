@@ -1,15 +1,24 @@
 package endpoints
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/Splinter0/identity/audit"
 	"github.com/Splinter0/identity/bankid"
 	"github.com/gin-gonic/gin"
 )
 
-const CSRF_HEADER = "X-BankID-CSRF"
+const (
+	CSRF_HEADER   = "X-BankID-CSRF"
+	DEVICE_COOKIE = "bankidDevice"
+)
 
 // Uses custom header csrf protection
 // https://cheatsheetseries.owasp.org/cheatsheets/Cross-Site_Request_Forgery_Prevention_Cheat_Sheet.html#employing-custom-request-headers-for-ajaxapi
@@ -23,72 +32,229 @@ func csrfProtection() gin.HandlerFunc {
 	}
 }
 
-func RegisterBankIDEndpoints(r *gin.Engine, config *Config) {
+type signStartBody struct {
+	VisibleData    string `json:"visibleData" binding:"required"`
+	NonVisibleData string `json:"nonVisibleData"`
+}
+
+// If had a transaction ongoing, cancel it
+func cancelOngoing(c *gin.Context, config *Config, p *bankid.BankIDProvider) {
+	transactionKey, ok := getTransactionKey(c, config, p)
+	if ok {
+		if err := p.CancelContext(c.Request.Context(), transactionKey); err != nil {
+			log.Printf("Could not cancel ongoing BankID transaction: %v", err)
+		}
+	}
+}
+
+func parseSameDevice(c *gin.Context) bool {
+	sameValue, ok := c.GetQuery("same")
+	if !ok {
+		return true
+	}
+	sameDevice, err := strconv.ParseBool(sameValue)
+	if err != nil {
+		return true
+	}
+	return sameDevice
+}
+
+// Random identifier kept by the browser, so BankID can tell devices apart
+// without us sending the raw value
+func deviceIdentifier(c *gin.Context, config *Config) string {
+	device, err := c.Cookie(DEVICE_COOKIE)
+	if err != nil || len(device) != 64 {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			log.Printf("Could not generate device identifier: %v", err)
+			return ""
+		}
+		device = hex.EncodeToString(random)
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(
+			DEVICE_COOKIE,
+			device,
+			365*24*60*60,
+			"/bankid",
+			*config.BankID.Domain,
+			config.BankID.Env == bankid.PRODUCTION,
+			true,
+		)
+	}
+	sum := sha256.Sum256([]byte(device))
+	return hex.EncodeToString(sum[:])
+}
+
+func deviceInfo(c *gin.Context, config *Config) bankid.BankIDDeviceInfo {
+	return bankid.BankIDDeviceInfo{
+		ReferringDomain:  *config.BankID.Domain,
+		DeviceIdentifier: deviceIdentifier(c, config),
+	}
+}
+
+// The page picks up the ongoing transaction when opened with the nonce
+func returnURL(config *Config, nonce string) string {
+	return "https://" + *config.BankID.Domain + "/bankid?" + RETURN_NONCE_PARAM + "=" + nonce
+}
+
+// Language for user messages, from the Accept-Language header
+func language(c *gin.Context, config *Config) bankid.Language {
+	return bankid.ParseAcceptLanguage(c.GetHeader("Accept-Language"), config.BankID.Language)
+}
+
+func respondStarted(c *gin.Context, config *Config, response bankid.BankIDAuthenticationResponse, err error) {
+	if err != nil {
+		log.Printf("Could not start BankID transaction: %v", err)
+		c.JSON(bankid.GetErrorStatus(err), bankid.BankIDAuthenticationResponse{
+			Success: false,
+			Message: bankid.GetLocalizedErrorMessage(err, language(c, config)),
+		})
+		return
+	}
+	setTransactionCookies(c, config, response)
+	c.JSON(200, response)
+}
+
+func respondStatusError(c *gin.Context, config *Config, err error) {
+	log.Printf("BankID request failed: %v", err)
+	c.JSON(bankid.GetErrorStatus(err), bankid.BankIDStatusResponse{
+		Message: bankid.GetLocalizedErrorMessage(err, language(c, config)),
+		Status:  bankid.FAILED,
+	})
+}
+
+func RegisterBankIDEndpoints(r *gin.Engine, config *Config, sessions *Sessions) {
+	rp, err := bankid.NewBankIDRP(config.BankID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	RegisterBankIDEndpointsWithProvider(r, config, bankid.NewBankIDProviderWithStore(rp, sessions.Store), sessions)
+}
+
+// Same as RegisterBankIDEndpoints but with an already built provider, for
+// example one talking to the BankID simulator.
+func RegisterBankIDEndpointsWithProvider(r *gin.Engine, config *Config, p *bankid.BankIDProvider, sessions *Sessions) {
 	if config.BankID.Domain == nil {
 		log.Fatal("Cannot register BankID provider without a 'domain' in config.yml")
 	}
 	if config.BankID.Env == bankid.TEST {
 		log.Println("BankID is configured for testing, not to use in production")
 	}
-	p := bankid.NewBankIDProvider(config.BankID)
-	r.Use(csrfProtection())
-	r.GET("/bankid", func(c *gin.Context) {
-		c.HTML(200, "bankid.html", gin.H{
+	ensureSecret(config)
+	if err := validateAllowedReturnURLs(config); err != nil {
+		log.Fatalf("Invalid 'allowedReturnUrls': %v", err)
+	}
+	if config.Audit != nil && p.Audit == nil {
+		sink, err := audit.NewFileSink(config.Audit)
+		if err != nil {
+			log.Fatalf("Invalid audit configuration: %v", err)
+		}
+		if config.Audit.Key == "" && !config.Audit.PersonalData {
+			log.Println("No audit 'key' configured, personal numbers are left out of the audit log")
+		}
+		p.Audit = sink
+	}
+	if sessions.Webhooks != nil {
+		p.AddListener(sessions.sendBankIDEvent)
+	}
+	if config.Metrics != nil {
+		p.RegisterMetrics()
+	}
+	group := r.Group("/bankid", csrfProtection())
+	group.GET("", func(c *gin.Context) {
+		page := gin.H{
 			"Service": *config.Service,
-		})
+		}
+		if nonce, ok := c.GetQuery(RETURN_NONCE_PARAM); ok {
+			// Sent back by the BankID app, possibly to another browser
+			returned := false
+			if transactionKey, ok := getTransactionKey(c, config, p); ok {
+				var err error
+				returned, err = p.CheckReturn(c.Request.Context(), transactionKey, nonce)
+				if err != nil {
+					log.Printf("Could not check BankID return nonce: %v", err)
+				}
+			}
+			if returned {
+				page["Returned"] = true
+			} else {
+				page["Message"] = bankid.GetLocalizedMessage("otherBrowser", language(c, config))
+			}
+		} else if _, ok := parseReturn(c, config); !ok {
+			return
+		}
+		c.HTML(200, "bankid.html", page)
 	})
-	r.POST("/bankid/start", func(c *gin.Context) {
-		// If had a transaction ongoing, cancel it
-		transactionKey, err := c.Cookie("bankidTransaction")
-		if err == nil {
-			p.Cancel(transactionKey)
-		}
-		sameValue, ok := c.GetQuery("same")
-		var sameDevice bool
+	group.POST("/start", func(c *gin.Context) {
+		ret, ok := parseReturn(c, config)
 		if !ok {
-			sameDevice = true
-		} else {
-			var err error
-			sameDevice, err = strconv.ParseBool(sameValue)
-			if err != nil {
-				sameDevice = true
-			}
+			return
 		}
-		authResponse := p.Authenticate(bankid.BankIDAuthenticationRequest{
-			SameDevice:     sameDevice,
-			UserIp:         c.ClientIP(),
-			MessageForUser: config.BankID.VisibleMessage,
-			RedirectURL:    "null",
-			UserAgent:      c.Request.UserAgent(),
-		})
-		var code int
-		if !authResponse.Success {
-			code = 401
-		} else {
-			c.SetSameSite(http.SameSiteStrictMode)
-			c.SetCookie(
-				"bankidTransaction",
-				authResponse.TransactionKey,
-				30,
-				"/bankid",
-				*config.BankID.Domain,
-				config.BankID.Env == bankid.PRODUCTION,
-				true,
-			)
-			code = 200
+		nonce, err := returnNonce()
+		if err != nil {
+			respondStarted(c, config, bankid.BankIDAuthenticationResponse{}, err)
+			return
 		}
-		c.JSON(code, authResponse)
+		cancelOngoing(c, config, p)
+		abandonAuthorization(c, config, ret.Flow)
+		sameDevice := parseSameDevice(c)
+		authResponse, err := p.AuthenticateContext(c.Request.Context(), bankid.BankIDAuthenticationRequest{
+			SameDevice:       sameDevice,
+			UserIp:           c.ClientIP(),
+			MessageForUser:   config.BankID.VisibleMessage,
+			ReturnURL:        returnURL(config, nonce),
+			ReturnNonce:      nonce,
+			BankIDReturn:     ret,
+			UserAgent:        c.Request.UserAgent(),
+			BankIDDeviceInfo: deviceInfo(c, config),
+		})
+		respondStarted(c, config, authResponse, err)
 	})
-	r.GET("/bankid/status", func(c *gin.Context) {
-		transactionKey, err := c.Cookie("bankidTransaction")
+	group.POST("/sign/start", func(c *gin.Context) {
+		var body signStartBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(400, gin.H{"message": "Missing data to sign"})
+			return
+		}
+		ret, ok := parseReturn(c, config)
+		if !ok {
+			return
+		}
+		nonce, err := returnNonce()
 		if err != nil {
+			respondStarted(c, config, bankid.BankIDAuthenticationResponse{}, err)
+			return
+		}
+		cancelOngoing(c, config, p)
+		sameDevice := parseSameDevice(c)
+		signResponse, err := p.SignContext(c.Request.Context(), bankid.BankIDSignRequest{
+			SameDevice:         sameDevice,
+			UserIp:             c.ClientIP(),
+			UserVisibleData:    body.VisibleData,
+			UserNonVisibleData: body.NonVisibleData,
+			ReturnURL:          returnURL(config, nonce),
+			ReturnNonce:        nonce,
+			BankIDReturn:       ret,
+			UserAgent:          c.Request.UserAgent(),
+			BankIDDeviceInfo:   deviceInfo(c, config),
+		})
+		respondStarted(c, config, signResponse, err)
+	})
+	group.GET("/status", func(c *gin.Context) {
+		transactionKey, ok := getTransactionKey(c, config, p)
+		if !ok {
 			c.JSON(400, bankid.BankIDStatusResponse{
-				Message: "Transaction expired",
+				Message: bankid.GetLocalizedMessage("transactionExpired", language(c, config)),
 				Status:  bankid.FAILED,
 			})
 			return
 		}
-		statusResponse := p.Status(transactionKey)
+		statusResponse, err := p.LocalizedStatusContext(c.Request.Context(), transactionKey, language(c, config))
+		if err != nil {
+			respondStatusError(c, config, err)
+			return
+		}
+		statusResponse = completeStatus(c, config, p, sessions, transactionKey, statusResponse)
 		var code int
 		if statusResponse.Status == bankid.FAILED {
 			code = 401
@@ -97,16 +263,64 @@ func RegisterBankIDEndpoints(r *gin.Engine, config *Config) {
 		}
 		c.JSON(code, statusResponse)
 	})
-	r.POST("/bankid/cancel", func(c *gin.Context) {
-		transactionKey, err := c.Cookie("bankidTransaction")
-		if err != nil {
+	// Pushes the status every time it changes, and at least every second so
+	// the QR code stays animated
+	group.GET("/events", func(c *gin.Context) {
+		transactionKey, ok := getTransactionKey(c, config, p)
+		if !ok {
 			c.JSON(400, bankid.BankIDStatusResponse{
-				Message: "Transaction not started",
+				Message: bankid.GetLocalizedMessage("transactionExpired", language(c, config)),
 				Status:  bankid.FAILED,
 			})
 			return
 		}
-		p.Cancel(transactionKey)
+		updates, unsubscribe := p.Subscribe(transactionKey)
+		defer unsubscribe()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lang := language(c, config)
+		c.Header("Cache-Control", "no-cache")
+		c.Stream(func(w io.Writer) bool {
+			statusResponse, err := p.LocalizedStatusContext(c.Request.Context(), transactionKey, lang)
+			if err != nil {
+				log.Printf("BankID request failed: %v", err)
+				statusResponse = bankid.BankIDStatusResponse{
+					Message: bankid.GetLocalizedErrorMessage(err, lang),
+					Status:  bankid.FAILED,
+				}
+			}
+			// Cookies cannot be set once streaming, the page gets the
+			// session from /bankid/status
+			if statusResponse.Status == bankid.COMPLETE {
+				statusResponse.Data = nil
+			}
+			c.SSEvent("status", statusResponse)
+			c.Writer.Flush()
+			if statusResponse.Status != bankid.PENDING {
+				return false
+			}
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case <-updates:
+			case <-ticker.C:
+			}
+			return true
+		})
+	})
+	group.POST("/cancel", func(c *gin.Context) {
+		transactionKey, ok := getTransactionKey(c, config, p)
+		if !ok {
+			c.JSON(400, bankid.BankIDStatusResponse{
+				Message: bankid.GetLocalizedMessage("transactionNotStarted", language(c, config)),
+				Status:  bankid.FAILED,
+			})
+			return
+		}
+		if err := p.CancelContext(c.Request.Context(), transactionKey); err != nil {
+			respondStatusError(c, config, err)
+			return
+		}
 		c.JSON(204, nil)
 	})
 }
@@ -0,0 +1,300 @@
+package endpoints
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/bankid/simulator"
+	"github.com/gin-gonic/gin"
+)
+
+type testService struct {
+	server *httptest.Server
+	client *http.Client
+	config *Config
+}
+
+// The service with BankID talking to a simulator, and a browser keeping its
+// cookies
+func newTestService(t *testing.T, simConfig simulator.Config, configure func(*Config)) *testService {
+	t.Helper()
+	sim, err := simulator.New(simConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bankIDServer := sim.Start()
+	t.Cleanup(bankIDServer.Close)
+
+	domain := "127.0.0.1"
+	service := "Test"
+	config := &Config{
+		Providers: []string{"bankid"},
+		Service:   &service,
+		BankID: &bankid.BankIDConfig{
+			Env:     bankid.TEST,
+			Version: bankid.LATEST_VERSION,
+			BaseURL: bankIDServer.URL,
+			Domain:  &domain,
+		},
+		Secret: "test-secret",
+	}
+	if configure != nil {
+		configure(config)
+	}
+	rp := bankid.NewBankIDRPWithClient(config.BankID, bankIDServer.Client())
+	p := bankid.NewBankIDProviderWithStore(rp, bankid.NewMemoryStore())
+	t.Cleanup(p.Close)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	config.Session.Issuer = server.URL
+	sessions := RegisterSessionEndpoints(r, config)
+	if config.OIDC != nil {
+		RegisterOIDCEndpoints(r, config, sessions)
+	}
+	if config.SAML != nil {
+		RegisterSAMLEndpoints(r, config, sessions)
+	}
+	RegisterBankIDEndpointsWithProvider(r, config, p, sessions)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testService{
+		server: server,
+		client: &http.Client{Jar: jar},
+		config: config,
+	}
+}
+
+func (s *testService) do(t *testing.T, method, path string, body interface{}, response interface{}) int {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, s.server.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(CSRF_HEADER, "1")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if response != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatalf("%s %s: could not decode response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type testStatus struct {
+	Message string               `json:"message"`
+	Status  bankid.CollectStatus `json:"status"`
+	Data    struct {
+		QrData string `json:"qrData"`
+		User   struct {
+			Name string `json:"name"`
+		} `json:"user"`
+		RedirectURL string `json:"redirectUrl"`
+	} `json:"data"`
+}
+
+// Polls the status like the page does until the order is no longer pending
+func (s *testService) wait(t *testing.T) (int, testStatus) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		var status testStatus
+		code := s.do(t, "GET", "/bankid/status", nil, &status)
+		if status.Status != bankid.PENDING {
+			return code, status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order still pending, last message %q", status.Message)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func (s *testService) sessionCookie() string {
+	u, _ := url.Parse(s.server.URL)
+	for _, cookie := range s.client.Jar.Cookies(u) {
+		if cookie.Name == s.config.Session.Cookie {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+var quickScript = []simulator.Step{
+	{Status: bankid.PENDING, HintCode: bankid.OUTSTANDING_TRANSACTION, Collects: 1},
+	{Status: bankid.COMPLETE},
+}
+
+func TestBankIDLogin(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t, simulator.Config{Script: quickScript}, nil)
+	var started bankid.BankIDAuthenticationResponse
+	if code := s.do(t, "POST", "/bankid/start?same=false", nil, &started); code != 200 {
+		t.Fatalf("start returned %d: %s", code, started.Message)
+	}
+	if !started.Success || started.QrCodeData == "" {
+		t.Fatalf("QR order started without QR data: %+v", started)
+	}
+
+	var pending testStatus
+	if code := s.do(t, "GET", "/bankid/status", nil, &pending); code != 200 || pending.Status != bankid.PENDING {
+		t.Fatalf("status returned %d %s, want pending", code, pending.Status)
+	}
+	if !strings.HasPrefix(pending.Data.QrData, "bankid.") {
+		t.Errorf("pending QR order has QR data %q", pending.Data.QrData)
+	}
+
+	code, status := s.wait(t)
+	if code != 200 || status.Status != bankid.COMPLETE {
+		t.Fatalf("status returned %d %s (%s), want complete", code, status.Status, status.Message)
+	}
+	if status.Data.User.Name != simulator.DefaultUsers[0].Name() {
+		t.Errorf("logged in as %q", status.Data.User.Name)
+	}
+	if s.sessionCookie() == "" {
+		t.Error("no session cookie after logging in")
+	}
+
+	// The login cannot be replayed
+	var replayed testStatus
+	if code := s.do(t, "GET", "/bankid/status", nil, &replayed); code != 401 || replayed.Status != bankid.FAILED {
+		t.Fatalf("status returned %d %s once logged in, want 401 failed", code, replayed.Status)
+	}
+	if replayed.Message != bankid.GetLocalizedMessage("consumed", bankid.DEFAULT_LANGUAGE) {
+		t.Errorf("message %q, want the transaction to be consumed", replayed.Message)
+	}
+}
+
+func TestBankIDLoginReturnTo(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t, simulator.Config{Script: quickScript}, func(config *Config) {
+		config.AllowedReturnURLs = []string{"https://app.example.com/"}
+	})
+	var started bankid.BankIDAuthenticationResponse
+	if code := s.do(t, "POST", "/bankid/start?same=false&return_to=https://evil.example.com/&state=abc", nil, &started); code != 400 {
+		t.Errorf("start with a return_to not allowed returned %d, want 400", code)
+	}
+	if code := s.do(t, "POST", "/bankid/start?same=false&return_to=https://app.example.com/done&state=abc", nil, &started); code != 200 {
+		t.Fatalf("start returned %d: %s", code, started.Message)
+	}
+
+	_, status := s.wait(t)
+	if !strings.HasPrefix(status.Data.RedirectURL, "https://app.example.com/done?state=abc#token=") {
+		t.Errorf("redirect URL %q, want the return_to with the state and token", status.Data.RedirectURL)
+	}
+}
+
+func TestBankIDSign(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t, simulator.Config{Script: quickScript}, nil)
+	var started bankid.BankIDAuthenticationResponse
+	if code := s.do(t, "POST", "/bankid/sign/start?same=false", gin.H{}, &started); code != 400 {
+		t.Errorf("sign without data returned %d, want 400", code)
+	}
+	if code := s.do(t, "POST", "/bankid/sign/start?same=false", signStartBody{VisibleData: "Transfer 100 SEK"}, &started); code != 200 {
+		t.Fatalf("sign start returned %d: %s", code, started.Message)
+	}
+
+	code, status := s.wait(t)
+	if code != 200 || status.Status != bankid.COMPLETE {
+		t.Fatalf("status returned %d %s (%s), want complete", code, status.Status, status.Message)
+	}
+	if s.sessionCookie() != "" {
+		t.Error("signing started a session")
+	}
+}
+
+func TestBankIDCancel(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t, simulator.Config{}, nil)
+	var started bankid.BankIDAuthenticationResponse
+	if code := s.do(t, "POST", "/bankid/start?same=false", nil, &started); code != 200 {
+		t.Fatalf("start returned %d: %s", code, started.Message)
+	}
+	if code := s.do(t, "POST", "/bankid/cancel", nil, nil); code != 204 {
+		t.Fatalf("cancel returned %d", code)
+	}
+
+	var status testStatus
+	code := s.do(t, "GET", "/bankid/status", nil, &status)
+	if code != 401 || status.Status != bankid.FAILED {
+		t.Fatalf("status returned %d %s after cancelling, want 401 failed", code, status.Status)
+	}
+	if status.Message != bankid.GetLocalizedMessage("RFA3", bankid.DEFAULT_LANGUAGE) {
+		t.Errorf("message %q, want RFA3", status.Message)
+	}
+}
+
+func TestBankIDExpiry(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t, simulator.Config{OrderTimeout: time.Second}, nil)
+	var started bankid.BankIDAuthenticationResponse
+	if code := s.do(t, "POST", "/bankid/start?same=false", nil, &started); code != 200 {
+		t.Fatalf("start returned %d: %s", code, started.Message)
+	}
+
+	code, status := s.wait(t)
+	if code != 401 || status.Status != bankid.FAILED {
+		t.Fatalf("status returned %d %s, want 401 failed", code, status.Status)
+	}
+	if status.Message != bankid.GetLocalizedMessage("RFA8", bankid.DEFAULT_LANGUAGE) {
+		t.Errorf("message %q, want RFA8", status.Message)
+	}
+}
+
+func TestBankIDTransactionBinding(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t, simulator.Config{}, nil)
+	req, err := http.NewRequest("POST", s.server.URL+"/bankid/start", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("start without the CSRF header returned %d, want 401", resp.StatusCode)
+	}
+
+	var started bankid.BankIDAuthenticationResponse
+	if code := s.do(t, "POST", "/bankid/start?same=false", nil, &started); code != 200 {
+		t.Fatalf("start returned %d: %s", code, started.Message)
+	}
+	// Another browser without the cookies of the transaction
+	other := &testService{server: s.server, client: &http.Client{}, config: s.config}
+	var status testStatus
+	if code := other.do(t, "GET", "/bankid/status", nil, &status); code != 400 {
+		t.Errorf("status from another browser returned %d, want 400", code)
+	}
+}
@@ -4,7 +4,12 @@ import (
 	"log"
 	"os"
 
+	"github.com/Splinter0/identity/audit"
 	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/oidc"
+	"github.com/Splinter0/identity/samlidp"
+	"github.com/Splinter0/identity/session"
+	"github.com/Splinter0/identity/webhook"
 	"gopkg.in/yaml.v2"
 )
 
@@ -12,6 +17,19 @@ type Config struct {
 	Providers []string             `yaml:"providers"`
 	Service   *string              `yaml:"service"`
 	BankID    *bankid.BankIDConfig `yaml:"bankid,omitempty"`
+	OIDC      *oidc.Config         `yaml:"oidc,omitempty"`
+	SAML      *samlidp.Config      `yaml:"saml,omitempty"`
+	Webhooks  *webhook.Config      `yaml:"webhooks,omitempty"`
+	// Signs cookies, has to be the same for all instances of the service
+	Secret  string         `yaml:"secret"`
+	Session session.Config `yaml:"session"`
+	// Pages of the service users can be sent back to after logging in, with
+	// return_to
+	AllowedReturnURLs []string `yaml:"allowedReturnUrls"`
+	// Tamper-evident log of what happens to orders
+	Audit *audit.Config `yaml:"audit,omitempty"`
+	// Serves Prometheus metrics at /metrics
+	Metrics *MetricsConfig `yaml:"metrics,omitempty"`
 }
 
 func LoadConfig() *Config {
@@ -25,6 +43,16 @@ func LoadConfig() *Config {
 		log.Fatalf("Error unmarshalling YAML: %v", err)
 	}
 
+	if secret, ok := os.LookupEnv("IDENTITY_SECRET"); ok {
+		config.Secret = secret
+	}
+	if key, ok := os.LookupEnv("IDENTITY_AUDIT_KEY"); ok && config.Audit != nil {
+		config.Audit.Key = key
+	}
+	if token, ok := os.LookupEnv("IDENTITY_METRICS_TOKEN"); ok && config.Metrics != nil {
+		config.Metrics.Token = token
+	}
+
 	if config.Service == nil {
 		log.Fatal("Must choose a name for 'service' in config")
 	}
@@ -0,0 +1,96 @@
+package endpoints
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TRANSACTION_COOKIE = "bankidTransaction"
+	// Binds the transaction to the browser that started it
+	BINDING_COOKIE = "bankidBinding"
+)
+
+// Used to sign cookies, random when not configured which only works with a
+// single instance and invalidates cookies on restart
+func ensureSecret(config *Config) {
+	if config.Secret != "" {
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Could not generate cookie secret: %v", err)
+	}
+	config.Secret = hex.EncodeToString(secret)
+	log.Println("No 'secret' configured, using a random one for this run only")
+}
+
+// Cookies not tied to a provider are only sent over TLS in production
+func secureCookies(config *Config) bool {
+	return config.BankID != nil && config.BankID.Env == bankid.PRODUCTION
+}
+
+func signValue(config *Config, value string) string {
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyValue(config *Config, signed string) (string, bool) {
+	value, _, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", false
+	}
+	return value, hmac.Equal([]byte(signValue(config, value)), []byte(signed))
+}
+
+func setTransactionCookies(c *gin.Context, config *Config, response bankid.BankIDAuthenticationResponse) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	for name, value := range map[string]string{
+		TRANSACTION_COOKIE: signValue(config, response.TransactionKey),
+		BINDING_COOKIE:     response.BindingNonce,
+	} {
+		c.SetCookie(
+			name,
+			value,
+			bankid.SESSION_TIMEOUT,
+			"/bankid",
+			*config.BankID.Domain,
+			config.BankID.Env == bankid.PRODUCTION,
+			true,
+		)
+	}
+}
+
+// Key of the transaction started by this browser, only if the cookie was
+// signed by us and the browser holds the binding nonce of the transaction
+func getTransactionKey(c *gin.Context, config *Config, p *bankid.BankIDProvider) (string, bool) {
+	signed, err := c.Cookie(TRANSACTION_COOKIE)
+	if err != nil {
+		return "", false
+	}
+	transactionKey, ok := verifyValue(config, signed)
+	if !ok {
+		log.Println("BankID transaction cookie with an invalid signature")
+		return "", false
+	}
+	nonce, err := c.Cookie(BINDING_COOKIE)
+	if err != nil {
+		return "", false
+	}
+	bound, err := p.CheckBinding(c.Request.Context(), transactionKey, nonce)
+	if err != nil {
+		log.Printf("Could not check BankID transaction binding: %v", err)
+		return "", false
+	}
+	return transactionKey, bound
+}
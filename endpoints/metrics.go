@@ -0,0 +1,26 @@
+package endpoints
+
+import (
+	"crypto/subtle"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type MetricsConfig struct {
+	// Optional token scrapers have to send as "Authorization: Bearer <token>"
+	Token string `yaml:"token"`
+}
+
+func RegisterMetricsEndpoints(r *gin.Engine, config *Config) {
+	handler := promhttp.Handler()
+	r.GET("/metrics", func(c *gin.Context) {
+		token := config.Metrics.Token
+		if token != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+token)) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.JSON(401, gin.H{"message": "Invalid metrics token"})
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	})
+}
@@ -0,0 +1,198 @@
+package endpoints
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Splinter0/identity/oidc"
+	"github.com/Splinter0/identity/session"
+	"github.com/gin-gonic/gin"
+)
+
+// Keeps the authorization request while the user logs in
+const AUTHORIZATION_COOKIE = "oidcAuthorization"
+
+// Long enough to pick a provider and finish a BankID order
+const AUTHORIZATION_TIMEOUT = 10 * 60
+
+// Authorization request waiting for the user to log in, only continued by a
+// login started for the same flow
+type authorizationFlow struct {
+	ID      string                    `json:"id"`
+	Request oidc.AuthorizationRequest `json:"request"`
+}
+
+func setAuthorizationCookie(c *gin.Context, config *Config, flow *authorizationFlow) error {
+	encoded, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		AUTHORIZATION_COOKIE,
+		signValue(config, base64.RawURLEncoding.EncodeToString(encoded)),
+		AUTHORIZATION_TIMEOUT,
+		"/",
+		"",
+		secureCookies(config),
+		true,
+	)
+	return nil
+}
+
+func getAuthorizationCookie(c *gin.Context, config *Config) (*authorizationFlow, bool) {
+	signed, err := c.Cookie(AUTHORIZATION_COOKIE)
+	if err != nil {
+		return nil, false
+	}
+	value, ok := verifyValue(config, signed)
+	if !ok {
+		log.Println("OIDC authorization cookie with an invalid signature")
+		return nil, false
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false
+	}
+	var flow authorizationFlow
+	if err := json.Unmarshal(encoded, &flow); err != nil || flow.ID == "" {
+		return nil, false
+	}
+	return &flow, true
+}
+
+func clearAuthorizationCookie(c *gin.Context, config *Config) {
+	c.SetCookie(AUTHORIZATION_COOKIE, "", -1, "/", "", secureCookies(config), true)
+}
+
+// Forgets the authorization request unless the login is started for it, so
+// an abandoned request is never continued by a later plain login
+func abandonAuthorization(c *gin.Context, config *Config, flow string) {
+	if pending, ok := getAuthorizationCookie(c, config); ok && pending.ID != flow {
+		clearAuthorizationCookie(c, config)
+	}
+}
+
+func respondOIDCError(c *gin.Context, err error) {
+	var oidcError *oidc.Error
+	if !errors.As(err, &oidcError) {
+		log.Printf("OIDC request failed: %v", err)
+		oidcError = &oidc.Error{Code: oidc.SERVER_ERROR}
+	}
+	if oidcError.Code == oidc.INVALID_TOKEN {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	} else if oidcError.Code == oidc.INVALID_CLIENT {
+		c.Header("WWW-Authenticate", `Basic realm="token"`)
+	}
+	c.JSON(oidcError.Status(), oidcError)
+}
+
+// Client credentials, from HTTP basic authentication or the form
+func clientCredentials(c *gin.Context) (string, string) {
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		// Encoded as form values before being put in the header, RFC 6749 2.3.1
+		decodedID, errID := url.QueryUnescape(id)
+		decodedSecret, errSecret := url.QueryUnescape(secret)
+		if errID == nil && errSecret == nil {
+			return decodedID, decodedSecret
+		}
+		return id, secret
+	}
+	return c.PostForm("client_id"), c.PostForm("client_secret")
+}
+
+func RegisterOIDCEndpoints(r *gin.Engine, config *Config, sessions *Sessions) {
+	op, err := oidc.NewOpenIDProvider(config.OIDC, sessions.Issuer, sessions.Store)
+	if err != nil {
+		log.Fatalf("Invalid OIDC configuration: %v", err)
+	}
+	sessions.addContinuation(func(c *gin.Context, identity session.Identity, flow string) (string, bool, error) {
+		pending, ok := getAuthorizationCookie(c, config)
+		if !ok || flow == "" || pending.ID != flow {
+			return "", false, nil
+		}
+		clearAuthorizationCookie(c, config)
+		redirectURL, err := op.Authorize(c.Request.Context(), &pending.Request, identity)
+		return redirectURL, err == nil, err
+	})
+
+	r.GET("/.well-known/openid-configuration", func(c *gin.Context) {
+		c.JSON(200, op.Discovery())
+	})
+	authorize := func(c *gin.Context) {
+		if err := c.Request.ParseForm(); err != nil {
+			c.JSON(400, &oidc.Error{Code: oidc.INVALID_REQUEST})
+			return
+		}
+		request, err := op.ParseAuthorizationRequest(c.Request.Form)
+		if err != nil {
+			var oidcError *oidc.Error
+			if request == nil || !errors.As(err, &oidcError) {
+				// Never redirect to a URI that was not validated
+				c.JSON(400, err)
+				return
+			}
+			c.Redirect(302, op.ErrorRedirect(request, oidcError))
+			return
+		}
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			respondOIDCError(c, err)
+			return
+		}
+		flow := &authorizationFlow{ID: hex.EncodeToString(random), Request: *request}
+		if err := setAuthorizationCookie(c, config, flow); err != nil {
+			respondOIDCError(c, err)
+			return
+		}
+		// The providers pass the flow on to the login they start
+		c.HTML(200, "index.html", gin.H{
+			"Providers": config.Providers,
+			"Flow":      flow.ID,
+		})
+	}
+	r.GET("/authorize", authorize)
+	r.POST("/authorize", authorize)
+	r.POST("/token", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		if c.PostForm("grant_type") != "authorization_code" {
+			respondOIDCError(c, &oidc.Error{Code: oidc.UNSUPPORTED_GRANT_TYPE})
+			return
+		}
+		clientID, clientSecret := clientCredentials(c)
+		response, err := op.Exchange(c.Request.Context(), oidc.TokenRequest{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Code:         c.PostForm("code"),
+			RedirectURI:  c.PostForm("redirect_uri"),
+			CodeVerifier: c.PostForm("code_verifier"),
+		})
+		if err != nil {
+			respondOIDCError(c, err)
+			return
+		}
+		c.JSON(200, response)
+	})
+	userInfo := func(c *gin.Context) {
+		accessToken, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			respondOIDCError(c, &oidc.Error{Code: oidc.INVALID_TOKEN})
+			return
+		}
+		claims, err := op.UserInfo(accessToken)
+		if err != nil {
+			respondOIDCError(c, err)
+			return
+		}
+		c.JSON(200, claims)
+	}
+	r.GET("/userinfo", userInfo)
+	r.POST("/userinfo", userInfo)
+}
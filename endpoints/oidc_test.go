@@ -0,0 +1,228 @@
+package endpoints
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/bankid/simulator"
+	"github.com/Splinter0/identity/oidc"
+)
+
+const (
+	testClientID     = "app"
+	testClientSecret = "client-secret"
+	testRedirectURI  = "https://app.example.com/callback"
+	testVerifier     = "a-code-verifier-long-enough-to-be-random-0123456789"
+)
+
+var flowLink = regexp.MustCompile(`/bankid\?flow=([0-9a-f]+)`)
+
+func newOIDCTestService(t *testing.T) *testService {
+	t.Helper()
+	return newTestService(t, simulator.Config{Script: quickScript}, func(config *Config) {
+		config.OIDC = &oidc.Config{
+			Clients: []oidc.Client{
+				{ID: testClientID, Secret: testClientSecret, RedirectURIs: []string{testRedirectURI}},
+				{ID: "spa", RedirectURIs: []string{"http://localhost:3000/callback"}},
+			},
+		}
+	})
+}
+
+func authorizeParams(scope string) url.Values {
+	challenge := sha256.Sum256([]byte(testVerifier))
+	return url.Values{
+		"client_id":             {testClientID},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {scope},
+		"state":                 {"client-state"},
+		"nonce":                 {"client-nonce"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// Starts an authorization request, returns the flow the provider links carry
+func (s *testService) authorize(t *testing.T, params url.Values) string {
+	t.Helper()
+	resp, err := s.client.Get(s.server.URL + "/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("authorize returned %d: %s", resp.StatusCode, page)
+	}
+	match := flowLink.FindSubmatch(page)
+	if match == nil {
+		t.Fatalf("no link to BankID with the flow in %s", page)
+	}
+	return string(match[1])
+}
+
+// Logs in with BankID, returns where the page sends the user
+func (s *testService) loginWithFlow(t *testing.T, flow string) string {
+	t.Helper()
+	path := "/bankid/start?same=false"
+	if flow != "" {
+		path += "&flow=" + flow
+	}
+	var started bankid.BankIDAuthenticationResponse
+	if code := s.do(t, "POST", path, nil, &started); code != 200 {
+		t.Fatalf("start returned %d: %s", code, started.Message)
+	}
+	code, status := s.wait(t)
+	if code != 200 || status.Status != bankid.COMPLETE {
+		t.Fatalf("status returned %d %s (%s), want complete", code, status.Status, status.Message)
+	}
+	return status.Data.RedirectURL
+}
+
+func (s *testService) hasCookie(name string) bool {
+	u, _ := url.Parse(s.server.URL)
+	for _, cookie := range s.client.Jar.Cookies(u) {
+		if cookie.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Posts to the token endpoint like a client would, authenticating with basic
+// authentication when basic is set
+func (s *testService) token(t *testing.T, form url.Values, basic bool, response interface{}) *http.Response {
+	t.Helper()
+	if basic {
+		form.Del("client_id")
+		form.Del("client_secret")
+	}
+	req, err := http.NewRequest("POST", s.server.URL+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(testClientID), url.QueryEscape(testClientSecret))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatalf("could not decode token response: %v", err)
+	}
+	return resp
+}
+
+func (s *testService) userInfo(t *testing.T, accessToken string, response interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest("GET", s.server.URL+"/userinfo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatalf("could not decode userinfo response: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestOIDCFlow(t *testing.T) {
+	t.Parallel()
+	s := newOIDCTestService(t)
+	flow := s.authorize(t, authorizeParams("openid profile "+oidc.SCOPE_PERSONAL_NUMBER))
+	redirectURL := s.loginWithFlow(t, flow)
+	if !strings.HasPrefix(redirectURL, testRedirectURI+"?") {
+		t.Fatalf("redirect URL %q, want the client", redirectURL)
+	}
+	if s.hasCookie(AUTHORIZATION_COOKIE) {
+		t.Error("authorization request kept after it was answered")
+	}
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("state") != "client-state" || u.Query().Get("iss") != s.server.URL {
+		t.Errorf("redirect URL %q, want the state and issuer", redirectURL)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {u.Query().Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testVerifier},
+		"client_id":     {testClientID},
+		"client_secret": {"guessed"},
+	}
+
+	var failed oidc.Error
+	resp := s.token(t, form, false, &failed)
+	if resp.StatusCode != 401 || failed.Code != oidc.INVALID_CLIENT || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("wrong secret returned %d %s", resp.StatusCode, failed.Code)
+	}
+	var tokens oidc.TokenResponse
+	resp = s.token(t, form, true, &tokens)
+	if resp.StatusCode != 200 || tokens.AccessToken == "" || tokens.IDToken == "" {
+		t.Fatalf("token returned %d %+v", resp.StatusCode, tokens)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Error("tokens may be cached")
+	}
+	resp = s.token(t, form, true, &failed)
+	if resp.StatusCode != 400 || failed.Code != oidc.INVALID_GRANT {
+		t.Errorf("second exchange returned %d %s, want invalid_grant", resp.StatusCode, failed.Code)
+	}
+
+	var userInfo oidc.UserInfo
+	if code := s.userInfo(t, tokens.AccessToken, &userInfo); code != 200 {
+		t.Fatalf("userinfo returned %d", code)
+	}
+	user := simulator.DefaultUsers[0]
+	if userInfo.Name != user.Name() || userInfo.PersonalNumber != user.PersonalNumber {
+		t.Errorf("got userinfo %+v", userInfo)
+	}
+	if code := s.userInfo(t, tokens.IDToken, &failed); code != 401 || failed.Code != oidc.INVALID_TOKEN {
+		t.Errorf("userinfo with the ID token returned %d %s", code, failed.Code)
+	}
+}
+
+// A plain login after an abandoned authorization request is not sent to the
+// client
+func TestOIDCAbandonedFlow(t *testing.T) {
+	t.Parallel()
+	s := newOIDCTestService(t)
+	s.authorize(t, authorizeParams("openid"))
+	if !s.hasCookie(AUTHORIZATION_COOKIE) {
+		t.Fatal("authorization request not kept")
+	}
+	if redirectURL := s.loginWithFlow(t, ""); strings.HasPrefix(redirectURL, testRedirectURI) {
+		t.Errorf("plain login sent to the client: %q", redirectURL)
+	}
+	if s.hasCookie(AUTHORIZATION_COOKIE) {
+		t.Error("abandoned authorization request kept")
+	}
+
+	// Nor a login started for another flow
+	s.authorize(t, authorizeParams("openid"))
+	if redirectURL := s.loginWithFlow(t, "0123456789abcdef"); strings.HasPrefix(redirectURL, testRedirectURI) {
+		t.Errorf("login of another flow sent to the client: %q", redirectURL)
+	}
+}
@@ -0,0 +1,147 @@
+package endpoints
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RETURN_TO_PARAM    = "return_to"
+	STATE_PARAM        = "state"
+	FLOW_PARAM         = "flow"
+	RETURN_NONCE_PARAM = "return"
+	MAX_STATE_LENGTH   = 512
+)
+
+// Entries of 'allowedReturnUrls' have to be absolute https URLs, or http on
+// localhost, without query or fragment
+func validateAllowedReturnURLs(config *Config) error {
+	for _, allowed := range config.AllowedReturnURLs {
+		u, err := url.Parse(allowed)
+		if err != nil {
+			return fmt.Errorf("invalid return URL %q: %w", allowed, err)
+		}
+		if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("return URL %q has to be an absolute URL without query or fragment", allowed)
+		}
+		if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+			return fmt.Errorf("return URL %q has to use https", allowed)
+		}
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Allowed when it has the scheme, host and port of an allowed URL, and the
+// same path or one under it when the allowed path ends with a slash
+func allowedReturnTo(config *Config, returnTo string) bool {
+	u, err := url.Parse(returnTo)
+	if err != nil || u.User != nil || u.Fragment != "" || u.Opaque != "" {
+		return false
+	}
+	// Browsers resolve these, so they could leave the allowed path
+	if strings.Contains(u.Path, "..") || strings.Contains(returnTo, "\\") {
+		return false
+	}
+	for _, entry := range config.AllowedReturnURLs {
+		allowed, err := url.Parse(entry)
+		if err != nil || u.Scheme != allowed.Scheme || u.Host != allowed.Host {
+			continue
+		}
+		if u.Path == allowed.Path || (strings.HasSuffix(allowed.Path, "/") && strings.HasPrefix(u.Path, allowed.Path)) {
+			return true
+		}
+		if allowed.Path == "" && (u.Path == "" || strings.HasPrefix(u.Path, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func validState(state string) bool {
+	if len(state) > MAX_STATE_LENGTH {
+		return false
+	}
+	for _, r := range state {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Where to send the user once the transaction completed, answers with an
+// error when return_to is not allowed
+func parseReturn(c *gin.Context, config *Config) (bankid.BankIDReturn, bool) {
+	ret := bankid.BankIDReturn{
+		ReturnTo: c.Query(RETURN_TO_PARAM),
+		State:    c.Query(STATE_PARAM),
+		Flow:     c.Query(FLOW_PARAM),
+	}
+	if ret.ReturnTo != "" && !allowedReturnTo(config, ret.ReturnTo) {
+		c.JSON(400, gin.H{"message": "Return URL not allowed"})
+		return ret, false
+	}
+	if !validState(ret.State) || !validState(ret.Flow) {
+		c.JSON(400, gin.H{"message": "Invalid state"})
+		return ret, false
+	}
+	return ret, true
+}
+
+// The return_to of the transaction with its state, empty without return_to
+func finalReturnURL(ret bankid.BankIDReturn) string {
+	if ret.ReturnTo == "" {
+		return ""
+	}
+	u, err := url.Parse(ret.ReturnTo)
+	if err != nil {
+		return ""
+	}
+	if ret.State != "" {
+		query := u.Query()
+		query.Set(STATE_PARAM, ret.State)
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// Adds the session token to the fragment of the URL, after what is already
+// there, so it never ends up in server logs
+func withToken(redirectURL, token string) (string, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", err
+	}
+	fragment := url.Values{"token": {token}}.Encode()
+	if u.Fragment != "" {
+		fragment = u.Fragment + "&" + fragment
+	}
+	u.Fragment = fragment
+	return u.String(), nil
+}
+
+// Nonce the BankID app gives back in the return URL, so the page only picks
+// up the transaction in the browser that started it
+func returnNonce() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
@@ -0,0 +1,160 @@
+package endpoints
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/samlidp"
+	"github.com/Splinter0/identity/session"
+	"github.com/gin-gonic/gin"
+)
+
+// Identifies the SAML request waiting for this browser to log in
+const SAML_COOKIE = "samlRequest"
+
+// Prepended to pending SAML logins in the store
+const SAML_LOGIN_KEY_PREFIX = "saml:login:"
+
+type samlLogin struct {
+	Request *samlidp.PendingRequest `json:"request"`
+	// Set once the user logged in
+	Identity *session.Identity `json:"identity,omitempty"`
+}
+
+// Pending logins are kept in the shared store, so the user can come back to
+// any instance
+type samlLogins struct {
+	store bankid.ValueStore
+}
+
+func (l samlLogins) set(ctx context.Context, id string, login *samlLogin) error {
+	encoded, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	return l.store.SetValue(ctx, SAML_LOGIN_KEY_PREFIX+id, encoded, AUTHORIZATION_TIMEOUT*time.Second)
+}
+
+func (l samlLogins) decode(encoded []byte, found bool, err error) (*samlLogin, bool, error) {
+	if err != nil || !found {
+		return nil, false, err
+	}
+	var login samlLogin
+	if err := json.Unmarshal(encoded, &login); err != nil {
+		return nil, false, err
+	}
+	return &login, true, nil
+}
+
+func (l samlLogins) get(ctx context.Context, id string) (*samlLogin, bool, error) {
+	return l.decode(l.store.GetValue(ctx, SAML_LOGIN_KEY_PREFIX+id))
+}
+
+// Only one caller gets the login, so the assertion is only sent once
+func (l samlLogins) take(ctx context.Context, id string) (*samlLogin, bool, error) {
+	return l.decode(l.store.TakeValue(ctx, SAML_LOGIN_KEY_PREFIX+id))
+}
+
+func RegisterSAMLEndpoints(r *gin.Engine, config *Config, sessions *Sessions) {
+	p, err := samlidp.NewIdentityProvider(config.SAML, sessions.Issuer, sessions.Issuer.Config.Issuer)
+	if err != nil {
+		log.Fatalf("Invalid SAML configuration: %v", err)
+	}
+	logins := samlLogins{store: sessions.Store}
+
+	getLoginID := func(c *gin.Context) (string, bool) {
+		signed, err := c.Cookie(SAML_COOKIE)
+		if err != nil {
+			return "", false
+		}
+		id, ok := verifyValue(config, signed)
+		if !ok {
+			log.Println("SAML request cookie with an invalid signature")
+			return "", false
+		}
+		return id, true
+	}
+	sessions.addContinuation(func(c *gin.Context, identity session.Identity, flow string) (string, bool, error) {
+		id, ok := getLoginID(c)
+		if !ok {
+			return "", false, nil
+		}
+		login, ok, err := logins.get(c.Request.Context(), id)
+		if err != nil || !ok {
+			return "", false, err
+		}
+		login.Identity = &identity
+		if err := logins.set(c.Request.Context(), id, login); err != nil {
+			return "", false, err
+		}
+		return "/saml/continue", true, nil
+	})
+	// Only taken once the user logged in
+	takeLogin := func(c *gin.Context) (*samlLogin, bool) {
+		id, ok := getLoginID(c)
+		if !ok {
+			return nil, false
+		}
+		login, ok, err := logins.get(c.Request.Context(), id)
+		if err == nil && ok && login.Identity != nil {
+			login, ok, err = logins.take(c.Request.Context(), id)
+		}
+		if err != nil {
+			log.Printf("Could not get SAML login: %v", err)
+			return nil, false
+		}
+		return login, ok && login.Identity != nil
+	}
+
+	r.GET("/saml/metadata", func(c *gin.Context) {
+		p.ServeMetadata(c.Writer, c.Request)
+	})
+	sso := func(c *gin.Context) {
+		request, err := p.ParseRequest(c.Request)
+		if err != nil {
+			log.Printf("Refused SAML request: %v", err)
+			c.JSON(400, gin.H{"message": "Invalid SAML request"})
+			return
+		}
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			log.Printf("Could not generate SAML request identifier: %v", err)
+			c.JSON(500, gin.H{"message": "Could not start login"})
+			return
+		}
+		id := hex.EncodeToString(random)
+		if err := logins.set(c.Request.Context(), id, &samlLogin{Request: request}); err != nil {
+			log.Printf("Could not store SAML request: %v", err)
+			c.JSON(500, gin.H{"message": "Could not start login"})
+			return
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(SAML_COOKIE, signValue(config, id), AUTHORIZATION_TIMEOUT, "/", "", secureCookies(config), true)
+		c.HTML(200, "index.html", gin.H{
+			"Providers": config.Providers,
+		})
+	}
+	r.GET("/saml/sso", sso)
+	r.POST("/saml/sso", sso)
+	// Posts the assertion to the service provider once the user logged in
+	r.GET("/saml/continue", func(c *gin.Context) {
+		login, ok := takeLogin(c)
+		if !ok {
+			c.JSON(400, gin.H{"message": "No SAML login in progress"})
+			return
+		}
+		c.SetCookie(SAML_COOKIE, "", -1, "/", "", secureCookies(config), true)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Header("Cache-Control", "no-store")
+		if err := p.Respond(c.Writer, c.Request, login.Request, *login.Identity); err != nil {
+			log.Printf("Could not answer SAML request: %v", err)
+			c.JSON(400, gin.H{"message": "Invalid SAML request"})
+		}
+	})
+}
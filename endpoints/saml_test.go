@@ -0,0 +1,146 @@
+package endpoints
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"html"
+	"io"
+	"math/big"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Splinter0/identity/bankid/simulator"
+	"github.com/Splinter0/identity/samlidp"
+	"github.com/crewjam/saml"
+)
+
+var samlResponseField = regexp.MustCompile(`name="SAMLResponse" value="([^"]+)"`)
+
+func newTestServiceProvider(t *testing.T) *saml.ServiceProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadataURL, _ := url.Parse("https://sp.example.com/metadata")
+	acsURL, _ := url.Parse("https://sp.example.com/acs")
+	return &saml.ServiceProvider{
+		EntityID:    metadataURL.String(),
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		AcsURL:      *acsURL,
+	}
+}
+
+func (s *testService) get(t *testing.T, path string) (int, []byte) {
+	t.Helper()
+	resp, err := s.client.Get(s.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestSAMLLogin(t *testing.T) {
+	t.Parallel()
+	sp := newTestServiceProvider(t)
+	metadata, err := xml.Marshal(sp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, simulator.Config{Script: quickScript}, func(config *Config) {
+		config.SAML = &samlidp.Config{
+			ServiceProviders: []samlidp.ServiceProvider{{Metadata: string(metadata)}},
+		}
+	})
+	code, body := s.get(t, "/saml/metadata")
+	if code != 200 {
+		t.Fatalf("metadata returned %d", code)
+	}
+	sp.IDPMetadata = &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(body, sp.IDPMetadata); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := s.get(t, "/saml/continue"); code != 400 {
+		t.Errorf("continue without a request returned %d", code)
+	}
+	request, err := sp.MakeAuthenticationRequest(s.server.URL+"/saml/sso", saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectURL, err := request.Redirect("relay-state", sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := s.get(t, "/saml/sso?"+redirectURL.RawQuery); code != 200 {
+		t.Fatalf("sso returned %d: %s", code, body)
+	}
+	// Not logged in yet
+	if code, _ := s.get(t, "/saml/continue"); code != 400 {
+		t.Errorf("continue before logging in returned %d", code)
+	}
+
+	if next := s.loginWithFlow(t, ""); next != "/saml/continue" {
+		t.Fatalf("sent to %q after logging in, want /saml/continue", next)
+	}
+	code, body = s.get(t, "/saml/continue")
+	if code != 200 {
+		t.Fatalf("continue returned %d: %s", code, body)
+	}
+	match := samlResponseField.FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("no SAMLResponse in %s", body)
+	}
+	response, err := base64.StdEncoding.DecodeString(html.UnescapeString(string(match[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := sp.ParseXMLResponse(response, []string{request.ID}, sp.AcsURL)
+	if err != nil {
+		if invalid, ok := err.(*saml.InvalidResponseError); ok {
+			err = invalid.PrivateErr
+		}
+		t.Fatalf("service provider refused the response: %v", err)
+	}
+	personalNumber := ""
+	for _, attribute := range assertion.AttributeStatements[0].Attributes {
+		if attribute.Name == samlidp.ATTRIBUTE_PERSONAL_IDENTITY_NUMBER {
+			personalNumber = attribute.Values[0].Value
+		}
+	}
+	if personalNumber != simulator.DefaultUsers[0].PersonalNumber {
+		t.Errorf("personal number %q in the assertion", personalNumber)
+	}
+
+	// The assertion is only posted once
+	if code, _ := s.get(t, "/saml/continue"); code != 400 {
+		t.Errorf("second continue returned %d", code)
+	}
+}
@@ -0,0 +1,214 @@
+package endpoints
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Splinter0/identity/bankid"
+	"github.com/Splinter0/identity/session"
+	"github.com/Splinter0/identity/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+// Issues sessions once users logged in with a provider, hands the login over
+// to whatever was waiting for it, e.g. an OIDC client, and tells backends
+// about finished transactions
+type Sessions struct {
+	Issuer *session.Issuer
+	// Shared by every instance, holds the BankID transactions and what OIDC
+	// and SAML keep while users log in
+	Store bankid.TransactionStore
+	// Only set when webhooks are configured
+	Webhooks      *webhook.Dispatcher
+	continuations []continuation
+}
+
+// Called after a login started for flow, returns where to send the user if it
+// was waiting for it
+type continuation func(c *gin.Context, identity session.Identity, flow string) (string, bool, error)
+
+// Builds the issuer of session tokens and publishes its keys
+func RegisterSessionEndpoints(r *gin.Engine, config *Config) *Sessions {
+	pseudonyms := config.Session.Subject == "" || config.Session.Subject == session.SUBJECT_PSEUDONYM
+	if pseudonyms && config.Session.PseudonymSecret == "" && config.Secret == "" {
+		// Pseudonyms change with the secret, so a random one is not good enough
+		log.Fatal("Pseudonymous subjects need a 'secret' or 'session.pseudonymSecret' that stays the same, or set 'session.subject' to 'personalNumber'")
+	}
+	ensureSecret(config)
+	if config.Session.PseudonymSecret == "" {
+		config.Session.PseudonymSecret = config.Secret
+	}
+	if config.Session.Issuer == "" && config.BankID != nil && config.BankID.Domain != nil {
+		config.Session.Issuer = "https://" + *config.BankID.Domain
+	}
+	issuer, err := session.NewIssuer(&config.Session)
+	if err != nil {
+		log.Fatalf("Invalid session configuration: %v", err)
+	}
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.JSON(200, issuer.JWKS())
+	})
+	var storeConfig bankid.StoreConfig
+	if config.BankID != nil {
+		storeConfig = config.BankID.Store
+	}
+	store, err := bankid.NewTransactionStore(storeConfig)
+	if err != nil {
+		log.Fatalf("Could not create transaction store: %v", err)
+	}
+	sessions := &Sessions{Issuer: issuer, Store: store}
+	if config.Webhooks != nil {
+		sessions.Webhooks, err = webhook.NewDispatcher(config.Webhooks)
+		if err != nil {
+			log.Fatalf("Invalid webhooks configuration: %v", err)
+		}
+	}
+	return sessions
+}
+
+// Queues a webhook event for the outcome of a BankID transaction
+func (s *Sessions) sendBankIDEvent(event bankid.TransactionEvent) {
+	webhookEvent := webhook.Event{
+		Type:          webhook.TRANSACTION_FAILED,
+		Provider:      "bankid",
+		TransactionID: event.OrderRef,
+		OrderType:     string(event.Type),
+		Flow:          string(event.Flow),
+		Status:        string(event.Status),
+		HintCode:      string(event.HintCode),
+		Reason:        event.Reason,
+		StartedAt:     event.StartedAt,
+		FinishedAt:    event.FinishedAt,
+	}
+	if event.Status == bankid.COMPLETE && event.CompletionData != nil {
+		user := event.CompletionData.User
+		// Same claims as the session tokens
+		claims := s.Issuer.Claims(session.Identity{
+			Method:         "bankid",
+			PersonalNumber: user.PersonalNumber,
+			Name:           user.Name,
+			GivenName:      user.GivenName,
+			FamilyName:     user.Surname,
+			AuthTime:       event.FinishedAt,
+		})
+		webhookEvent.Type = webhook.TRANSACTION_COMPLETED
+		webhookEvent.User = &webhook.User{
+			Subject:        claims.Subject,
+			Name:           claims.Name,
+			GivenName:      claims.GivenName,
+			FamilyName:     claims.FamilyName,
+			PersonalNumber: claims.PersonalNumber,
+		}
+	}
+	if err := s.Webhooks.Send(webhookEvent); err != nil {
+		log.Printf("Could not queue webhook for BankID order %s: %v", event.OrderRef, err)
+	}
+}
+
+func (s *Sessions) addContinuation(next continuation) {
+	s.continuations = append(s.continuations, next)
+}
+
+// Starts a session for the user, returns where to send them next if anywhere:
+// to what was waiting for the login, or else to returnTo or the configured
+// redirect URL with the token
+func (s *Sessions) login(c *gin.Context, config *Config, identity session.Identity, flow, returnTo string) (string, error) {
+	token, _, err := s.Issuer.Issue(identity)
+	if err != nil {
+		return "", err
+	}
+	setSessionCookie(c, config, token)
+	for _, next := range s.continuations {
+		if redirectURL, ok, err := next(c, identity, flow); err != nil {
+			return "", err
+		} else if ok {
+			return redirectURL, nil
+		}
+	}
+	redirectURL := config.Session.RedirectURL
+	if returnTo != "" {
+		redirectURL = returnTo
+	}
+	if redirectURL != "" {
+		return withToken(redirectURL, token)
+	}
+	return "", nil
+}
+
+func setSessionCookie(c *gin.Context, config *Config, token string) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		config.Session.Cookie,
+		token,
+		int(config.Session.Lifetime.Seconds()),
+		"/",
+		"",
+		secureCookies(config),
+		true,
+	)
+}
+
+// Replaces the completion data of a finished transaction with what the page
+// needs, and starts a session when it was a login. Only done once per
+// transaction, later calls fail so a login cannot be replayed.
+func completeStatus(c *gin.Context, config *Config, p *bankid.BankIDProvider, sessions *Sessions, transactionKey string, statusResponse bankid.BankIDStatusResponse) bankid.BankIDStatusResponse {
+	completionData, ok := statusResponse.Data.(bankid.CollectCompletionData)
+	if statusResponse.Status != bankid.COMPLETE || !ok {
+		return statusResponse
+	}
+	first, err := p.ConsumeContext(c.Request.Context(), transactionKey)
+	if err != nil {
+		log.Printf("Could not consume BankID transaction: %v", err)
+		return bankid.BankIDStatusResponse{
+			Message: bankid.GetLocalizedMessage("unexpectedStatus", language(c, config)),
+			Status:  bankid.FAILED,
+		}
+	}
+	if !first {
+		return bankid.BankIDStatusResponse{
+			Message: bankid.GetLocalizedMessage("consumed", language(c, config)),
+			Status:  bankid.FAILED,
+		}
+	}
+	user := completionData.User
+	data := gin.H{
+		"user": gin.H{
+			"name":      user.Name,
+			"givenName": user.GivenName,
+			"surname":   user.Surname,
+		},
+	}
+	if config.Session.ExposeCompletionData {
+		data["user"] = user
+		data["completionData"] = completionData
+	}
+	statusResponse.Data = data
+	returnTo := finalReturnURL(statusResponse.BankIDReturn)
+	if statusResponse.Type != bankid.AUTH {
+		if returnTo != "" {
+			data["redirectUrl"] = returnTo
+		}
+		return statusResponse
+	}
+
+	redirectURL, err := sessions.login(c, config, session.Identity{
+		Method:         "bankid",
+		PersonalNumber: user.PersonalNumber,
+		Name:           user.Name,
+		GivenName:      user.GivenName,
+		FamilyName:     user.Surname,
+		AuthTime:       time.Now(),
+	}, statusResponse.Flow, returnTo)
+	if err != nil {
+		log.Printf("Could not start session: %v", err)
+		return bankid.BankIDStatusResponse{
+			Message: bankid.GetLocalizedMessage("unexpectedStatus", language(c, config)),
+			Status:  bankid.FAILED,
+		}
+	}
+	if redirectURL != "" {
+		data["redirectUrl"] = redirectURL
+	}
+	return statusResponse
+}
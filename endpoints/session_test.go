@@ -0,0 +1,53 @@
+package endpoints
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWithToken(t *testing.T) {
+	tests := []struct {
+		redirectURL string
+		want        string
+	}{
+		{"https://app.example.com/", "https://app.example.com/#token=abc.def"},
+		{"https://app.example.com/done?state=abc", "https://app.example.com/done?state=abc#token=abc.def"},
+		// Single page apps routing on the fragment keep their route
+		{"https://app.example.com/#/login", "https://app.example.com/#/login&token=abc.def"},
+		{"https://app.example.com/#tab=2", "https://app.example.com/#tab=2&token=abc.def"},
+	}
+	for _, test := range tests {
+		got, err := withToken(test.redirectURL, "abc.def")
+		if err != nil {
+			t.Errorf("withToken(%q): %v", test.redirectURL, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("withToken(%q) = %q, want %q", test.redirectURL, got, test.want)
+		}
+	}
+	if _, err := withToken("https://app.example.com/%zz", "abc.def"); err == nil {
+		t.Error("invalid redirect URL accepted")
+	}
+}
+
+// The shipped configuration has to start, RegisterSessionEndpoints exits
+// when it does not
+func TestDefaultSessionConfig(t *testing.T) {
+	data, err := os.ReadFile("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	sessions := RegisterSessionEndpoints(gin.New(), &config)
+	if sessions.Issuer.Config.Issuer != "https://example.app" {
+		t.Errorf("issuer %q, want the BankID domain", sessions.Issuer.Config.Issuer)
+	}
+}
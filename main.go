@@ -10,9 +10,19 @@ func main() {
 	r.LoadHTMLGlob("templates/*")
 	r.Static("/js/", "static/js/")
 	config := endpoints.LoadConfig()
+	sessions := endpoints.RegisterSessionEndpoints(r, config)
+	if config.OIDC != nil {
+		endpoints.RegisterOIDCEndpoints(r, config, sessions)
+	}
+	if config.SAML != nil {
+		endpoints.RegisterSAMLEndpoints(r, config, sessions)
+	}
+	if config.Metrics != nil {
+		endpoints.RegisterMetricsEndpoints(r, config)
+	}
 	for _, provider := range config.Providers {
 		if provider == "bankid" {
-			endpoints.RegisterBankIDEndpoints(r, config)
+			endpoints.RegisterBankIDEndpoints(r, config, sessions)
 		}
 	}
 	r.GET("/", func(c *gin.Context) {
@@ -0,0 +1,127 @@
+// Package metrics holds the Prometheus metrics of the identity providers,
+// registered with the default registry and served at /metrics by the service.
+package metrics
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const NAMESPACE = "identity"
+
+var (
+	TransactionsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "transactions_started_total",
+		Help:      "Transactions started, by provider and flow.",
+	}, []string{"provider", "flow"})
+	TransactionsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "transactions_completed_total",
+		Help:      "Transactions completed, by provider and flow.",
+	}, []string{"provider", "flow"})
+	// Reason is set when the provider succeeded but the result was refused,
+	// e.g. because of an invalid signature
+	TransactionsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "transactions_failed_total",
+		Help:      "Transactions failed, by provider, flow, hint code and reason.",
+	}, []string{"provider", "flow", "hint_code", "reason"})
+	TransactionsCancelled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "transactions_cancelled_total",
+		Help:      "Transactions cancelled before they finished, by provider and flow.",
+	}, []string{"provider", "flow"})
+	TransactionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "transaction_duration_seconds",
+		Help:      "Time from the start of transactions until they finished, by provider, flow and status.",
+		Buckets:   []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180},
+	}, []string{"provider", "flow", "status"})
+	// Error code is "ok" on success, the code of the provider or "timeout"
+	// and "network" otherwise
+	RPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "rp_request_duration_seconds",
+		Help:      "Latency of every attempt at calling the API of a provider, by provider, endpoint and error code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"provider", "endpoint", "error_code"})
+)
+
+var (
+	activeTransactionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "", "transactions_active"),
+		"Transactions of a provider waiting for the user, neither finished nor cancelled.",
+		[]string{"provider"}, nil,
+	)
+	certificateExpiryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "", "rp_certificate_expiry_days"),
+		"Days until the certificate authenticating against the API of a provider expires.",
+		[]string{"provider"}, nil,
+	)
+)
+
+// Gauges read from the providers on every scrape
+type providerGauges struct {
+	mutex              sync.Mutex
+	activeTransactions map[string]func(ctx context.Context) (int, error)
+	certificateExpiry  map[string]func() (time.Time, bool)
+}
+
+var gauges = &providerGauges{
+	activeTransactions: make(map[string]func(ctx context.Context) (int, error)),
+	certificateExpiry:  make(map[string]func() (time.Time, bool)),
+}
+
+func init() {
+	prometheus.MustRegister(gauges)
+}
+
+// Reports the transactions of the provider with count, replacing the
+// previous one
+func SetActiveTransactions(provider string, count func(ctx context.Context) (int, error)) {
+	gauges.mutex.Lock()
+	defer gauges.mutex.Unlock()
+	gauges.activeTransactions[provider] = count
+}
+
+// Reports the expiry of the certificate of the provider, false when it has
+// none
+func SetCertificateExpiry(provider string, notAfter func() (time.Time, bool)) {
+	gauges.mutex.Lock()
+	defer gauges.mutex.Unlock()
+	gauges.certificateExpiry[provider] = notAfter
+}
+
+func (g *providerGauges) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeTransactionsDesc
+	ch <- certificateExpiryDesc
+}
+
+func (g *providerGauges) Collect(ch chan<- prometheus.Metric) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for provider, count := range g.activeTransactions {
+		active, err := count(ctx)
+		if err != nil {
+			log.Printf("Could not count %s transactions: %v", provider, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(activeTransactionsDesc, prometheus.GaugeValue, float64(active), provider)
+	}
+	for provider, notAfter := range g.certificateExpiry {
+		expiry, ok := notAfter()
+		if !ok {
+			continue
+		}
+		days := time.Until(expiry).Hours() / 24
+		ch <- prometheus.MustNewConstMetric(certificateExpiryDesc, prometheus.GaugeValue, days, provider)
+	}
+}
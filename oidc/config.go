@@ -0,0 +1,103 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	DEFAULT_CODE_LIFETIME         = 1 * time.Minute
+	DEFAULT_ACCESS_TOKEN_LIFETIME = 10 * time.Minute
+)
+
+type Config struct {
+	Clients []Client `yaml:"clients"`
+	// How long authorization codes and access tokens can be used
+	CodeLifetime        time.Duration `yaml:"codeLifetime"`
+	AccessTokenLifetime time.Duration `yaml:"accessTokenLifetime"`
+}
+
+// Application allowed to log users in through the service
+type Client struct {
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+	// Clients without a secret are public, e.g. single page apps
+	Secret       string   `yaml:"secret"`
+	RedirectURIs []string `yaml:"redirectUris"`
+}
+
+func (c *Config) validate() error {
+	if len(c.Clients) == 0 {
+		return errors.New("oidc: no client configured")
+	}
+	ids := make(map[string]bool, len(c.Clients))
+	for _, client := range c.Clients {
+		if client.ID == "" {
+			return errors.New("oidc: client without an 'id'")
+		}
+		if ids[client.ID] {
+			return fmt.Errorf("oidc: client %q is configured twice", client.ID)
+		}
+		ids[client.ID] = true
+		if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("oidc: client %q has no 'redirectUris'", client.ID)
+		}
+		for _, redirectURI := range client.RedirectURIs {
+			if err := validateRedirectURI(redirectURI); err != nil {
+				return fmt.Errorf("oidc: client %q: %w", client.ID, err)
+			}
+		}
+	}
+	if c.CodeLifetime <= 0 {
+		c.CodeLifetime = DEFAULT_CODE_LIFETIME
+	}
+	if c.AccessTokenLifetime <= 0 {
+		c.AccessTokenLifetime = DEFAULT_ACCESS_TOKEN_LIFETIME
+	}
+	return nil
+}
+
+// Codes are sent to redirect URIs, so they have to be absolute and use TLS
+// unless they point to the machine itself
+func validateRedirectURI(redirectURI string) error {
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("redirect URI %q is not an absolute URL", redirectURI)
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("redirect URI %q cannot have a fragment", redirectURI)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return fmt.Errorf("redirect URI %q has to use https", redirectURI)
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+func (c *Config) client(id string) (*Client, bool) {
+	for i := range c.Clients {
+		if c.Clients[i].ID == id {
+			return &c.Clients[i], true
+		}
+	}
+	return nil, false
+}
+
+func (c *Client) public() bool {
+	return c.Secret == ""
+}
+
+// Redirect URIs are compared as strings, as required by OAuth 2.0 Security BCP
+func (c *Client) allowsRedirect(redirectURI string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == redirectURI {
+			return true
+		}
+	}
+	return false
+}
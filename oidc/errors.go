@@ -0,0 +1,45 @@
+package oidc
+
+// Error codes from RFC 6749 and OpenID Connect Core
+type ErrorCode string
+
+const (
+	INVALID_REQUEST           ErrorCode = "invalid_request"
+	INVALID_CLIENT            ErrorCode = "invalid_client"
+	INVALID_GRANT             ErrorCode = "invalid_grant"
+	INVALID_TOKEN             ErrorCode = "invalid_token"
+	UNSUPPORTED_GRANT_TYPE    ErrorCode = "unsupported_grant_type"
+	UNSUPPORTED_RESPONSE_TYPE ErrorCode = "unsupported_response_type"
+	INVALID_SCOPE             ErrorCode = "invalid_scope"
+	LOGIN_REQUIRED            ErrorCode = "login_required"
+	ACCESS_DENIED             ErrorCode = "access_denied"
+	SERVER_ERROR              ErrorCode = "server_error"
+)
+
+type Error struct {
+	Code        ErrorCode `json:"error"`
+	Description string    `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return "oidc: " + string(e.Code)
+	}
+	return "oidc: " + string(e.Code) + ": " + e.Description
+}
+
+func newError(code ErrorCode, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
+
+// HTTP status to answer the error with on the token and userinfo endpoints
+func (e *Error) Status() int {
+	switch e.Code {
+	case INVALID_CLIENT, INVALID_TOKEN:
+		return 401
+	case SERVER_ERROR:
+		return 500
+	default:
+		return 400
+	}
+}
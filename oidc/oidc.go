@@ -0,0 +1,356 @@
+// Package oidc is an OpenID Connect provider supporting the authorization
+// code flow with PKCE, so that any OIDC capable application can log users in
+// with the eID providers of this service.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Splinter0/identity/session"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	SCOPE_OPENID  = "openid"
+	SCOPE_PROFILE = "profile"
+	// Personal identity number, from the Swedish OpenID Connect profile
+	SCOPE_PERSONAL_NUMBER = "https://id.oidc.se/scope/naturalPersonNumber"
+
+	PKCE_S256 = "S256"
+
+	// Types in the header of the tokens, see session.SESSION_TOKEN_TYPE.
+	// Access tokens follow RFC 9068.
+	ID_TOKEN_TYPE     = "JWT"
+	ACCESS_TOKEN_TYPE = "at+jwt"
+)
+
+// Prepended to authorization codes in the store
+const CODE_KEY_PREFIX = "oidc:code:"
+
+var SCOPES = []string{SCOPE_OPENID, SCOPE_PROFILE, SCOPE_PERSONAL_NUMBER}
+
+// Where authorization codes wait to be exchanged, has to be shared by every
+// instance of the service. The BankID transaction stores are one.
+type Store interface {
+	SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Gets and deletes the value at once, so only one caller ever gets it
+	TakeValue(ctx context.Context, key string) ([]byte, bool, error)
+}
+
+type OpenIDProvider struct {
+	Config *Config
+	Issuer *session.Issuer
+	// Authorization codes not exchanged yet
+	Store Store
+}
+
+func NewOpenIDProvider(config *Config, issuer *session.Issuer, store Store) (*OpenIDProvider, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &OpenIDProvider{
+		Config: config,
+		Issuer: issuer,
+		Store:  store,
+	}, nil
+}
+
+func (op *OpenIDProvider) url(path string) string {
+	return strings.TrimSuffix(op.Issuer.Config.Issuer, "/") + path
+}
+
+// Where applications find the endpoints and what is supported
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	ACRValuesSupported                []string `json:"acr_values_supported"`
+	AuthorizationResponseISS          bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+func (op *OpenIDProvider) Discovery() Discovery {
+	return Discovery{
+		Issuer:                            op.Issuer.Config.Issuer,
+		AuthorizationEndpoint:             op.url("/authorize"),
+		TokenEndpoint:                     op.url("/token"),
+		UserinfoEndpoint:                  op.url("/userinfo"),
+		JWKSURI:                           op.url("/.well-known/jwks.json"),
+		ScopesSupported:                   SCOPES,
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{op.Issuer.Algorithm()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{PKCE_S256},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr",
+			"name", "given_name", "family_name", session.PERSONAL_NUMBER_CLAIM,
+		},
+		ACRValuesSupported:       []string{op.Issuer.Config.LoA},
+		AuthorizationResponseISS: true,
+	}
+}
+
+// Authorization request of a client, kept while the user logs in
+type AuthorizationRequest struct {
+	ClientID      string `json:"clientId"`
+	RedirectURI   string `json:"redirectUri"`
+	Scope         string `json:"scope"`
+	State         string `json:"state,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"codeChallenge"`
+}
+
+// Validates an authorization request. The request is returned with the error
+// once the client and redirect URI are known to be valid, meaning the error
+// can be sent to the client with ErrorRedirect, otherwise it must only be
+// shown to the user.
+func (op *OpenIDProvider) ParseAuthorizationRequest(values url.Values) (*AuthorizationRequest, error) {
+	client, ok := op.Config.client(values.Get("client_id"))
+	if !ok {
+		return nil, newError(INVALID_CLIENT, "unknown client")
+	}
+	redirectURI := values.Get("redirect_uri")
+	if !client.allowsRedirect(redirectURI) {
+		return nil, newError(INVALID_REQUEST, "redirect_uri is not registered for the client")
+	}
+	request := &AuthorizationRequest{
+		ClientID:    client.ID,
+		RedirectURI: redirectURI,
+		State:       values.Get("state"),
+		Nonce:       values.Get("nonce"),
+	}
+	if values.Get("response_type") != "code" {
+		return request, newError(UNSUPPORTED_RESPONSE_TYPE, "only the code response type is supported")
+	}
+	var scopes []string
+	for _, scope := range strings.Fields(values.Get("scope")) {
+		for _, supported := range SCOPES {
+			if scope == supported {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	request.Scope = strings.Join(scopes, " ")
+	if !hasScope(request.Scope, SCOPE_OPENID) {
+		return request, newError(INVALID_SCOPE, "the openid scope is required")
+	}
+	request.CodeChallenge = values.Get("code_challenge")
+	if request.CodeChallenge == "" || values.Get("code_challenge_method") != PKCE_S256 {
+		return request, newError(INVALID_REQUEST, "PKCE with S256 is required")
+	}
+	if values.Get("prompt") == "none" {
+		// Users always log in with an eID, there are no sessions to reuse
+		return request, newError(LOGIN_REQUIRED, "")
+	}
+	return request, nil
+}
+
+func hasScope(scope, wanted string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+func (op *OpenIDProvider) redirect(request *AuthorizationRequest, params url.Values) string {
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+	params.Set("iss", op.Issuer.Config.Issuer)
+	separator := "?"
+	if strings.Contains(request.RedirectURI, "?") {
+		separator = "&"
+	}
+	return request.RedirectURI + separator + params.Encode()
+}
+
+// Where to send the user to report the error to the client
+func (op *OpenIDProvider) ErrorRedirect(request *AuthorizationRequest, err *Error) string {
+	params := url.Values{"error": {string(err.Code)}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	return op.redirect(request, params)
+}
+
+type grant struct {
+	Request  AuthorizationRequest `json:"request"`
+	Identity session.Identity     `json:"identity"`
+}
+
+// Completes the request once the user logged in, returns where to send the
+// user with the authorization code
+func (op *OpenIDProvider) Authorize(ctx context.Context, request *AuthorizationRequest, identity session.Identity) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(random)
+	encoded, err := json.Marshal(grant{Request: *request, Identity: identity})
+	if err != nil {
+		return "", err
+	}
+	if err := op.Store.SetValue(ctx, CODE_KEY_PREFIX+code, encoded, op.Config.CodeLifetime); err != nil {
+		return "", fmt.Errorf("could not store authorization code: %w", err)
+	}
+	return op.redirect(request, url.Values{"code": {code}}), nil
+}
+
+type TokenRequest struct {
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+type IDTokenClaims struct {
+	session.Claims
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// Access tokens are only meant for the userinfo endpoint
+type AccessTokenClaims struct {
+	session.Claims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+// Exchanges an authorization code for tokens
+func (op *OpenIDProvider) Exchange(ctx context.Context, request TokenRequest) (*TokenResponse, error) {
+	client, ok := op.Config.client(request.ClientID)
+	if !ok {
+		return nil, newError(INVALID_CLIENT, "unknown client")
+	}
+	if !client.public() && subtle.ConstantTimeCompare([]byte(client.Secret), []byte(request.ClientSecret)) != 1 {
+		return nil, newError(INVALID_CLIENT, "invalid client credentials")
+	}
+
+	// Codes can only be used once
+	if request.Code == "" {
+		return nil, newError(INVALID_GRANT, "unknown or expired code")
+	}
+	encoded, found, err := op.Store.TakeValue(ctx, CODE_KEY_PREFIX+request.Code)
+	if err != nil {
+		return nil, fmt.Errorf("could not get authorization code: %w", err)
+	}
+	if !found {
+		return nil, newError(INVALID_GRANT, "unknown or expired code")
+	}
+	var grant grant
+	if err := json.Unmarshal(encoded, &grant); err != nil {
+		return nil, fmt.Errorf("could not decode authorization code: %w", err)
+	}
+	if grant.Request.ClientID != client.ID || grant.Request.RedirectURI != request.RedirectURI {
+		return nil, newError(INVALID_GRANT, "code was issued to another client or redirect_uri")
+	}
+	challenge := sha256.Sum256([]byte(request.CodeVerifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(grant.Request.CodeChallenge)) != 1 {
+		return nil, newError(INVALID_GRANT, "invalid code_verifier")
+	}
+
+	now := time.Now()
+	claims := op.claims(grant.Identity, grant.Request.Scope)
+	idClaims := IDTokenClaims{Claims: claims, Nonce: grant.Request.Nonce}
+	idClaims.Audience = jwt.ClaimStrings{client.ID}
+	idClaims.ExpiresAt = jwt.NewNumericDate(now.Add(op.Issuer.Config.Lifetime))
+	idToken, err := op.Issuer.Sign(idClaims, ID_TOKEN_TYPE)
+	if err != nil {
+		return nil, newError(SERVER_ERROR, err.Error())
+	}
+	accessClaims := AccessTokenClaims{Claims: claims, ClientID: client.ID, Scope: grant.Request.Scope}
+	accessClaims.Audience = jwt.ClaimStrings{op.url("/userinfo")}
+	accessClaims.ExpiresAt = jwt.NewNumericDate(now.Add(op.Config.AccessTokenLifetime))
+	accessToken, err := op.Issuer.Sign(accessClaims, ACCESS_TOKEN_TYPE)
+	if err != nil {
+		return nil, newError(SERVER_ERROR, err.Error())
+	}
+
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(op.Config.AccessTokenLifetime.Seconds()),
+		IDToken:     idToken,
+		Scope:       grant.Request.Scope,
+	}, nil
+}
+
+// Standard claims of the user for the granted scopes
+func (op *OpenIDProvider) claims(identity session.Identity, scope string) session.Claims {
+	now := time.Now()
+	claims := session.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   op.Issuer.Config.Issuer,
+			Subject:  op.Issuer.Subject(identity.PersonalNumber),
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		AMR:      []string{identity.Method},
+		AuthTime: identity.AuthTime.Unix(),
+		ACR:      op.Issuer.Config.LoA,
+	}
+	if hasScope(scope, SCOPE_PROFILE) {
+		claims.Name = identity.Name
+		claims.GivenName = identity.GivenName
+		claims.FamilyName = identity.FamilyName
+	}
+	if hasScope(scope, SCOPE_PERSONAL_NUMBER) {
+		claims.PersonalNumber = identity.PersonalNumber
+	}
+	return claims
+}
+
+type UserInfo struct {
+	Subject        string `json:"sub"`
+	Name           string `json:"name,omitempty"`
+	GivenName      string `json:"given_name,omitempty"`
+	FamilyName     string `json:"family_name,omitempty"`
+	PersonalNumber string `json:"https://id.oidc.se/claim/personalIdentityNumber,omitempty"`
+}
+
+// Claims for the userinfo endpoint, from an access token
+func (op *OpenIDProvider) UserInfo(accessToken string) (*UserInfo, error) {
+	var claims AccessTokenClaims
+	if err := op.Issuer.Parse(accessToken, &claims, ACCESS_TOKEN_TYPE, op.url("/userinfo")); err != nil {
+		return nil, newError(INVALID_TOKEN, "invalid access token")
+	}
+	return &UserInfo{
+		Subject:        claims.Subject,
+		Name:           claims.Name,
+		GivenName:      claims.GivenName,
+		FamilyName:     claims.FamilyName,
+		PersonalNumber: claims.PersonalNumber,
+	}, nil
+}
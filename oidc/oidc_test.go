@@ -0,0 +1,370 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Splinter0/identity/session"
+)
+
+const (
+	clientID     = "app"
+	clientSecret = "client-secret"
+	redirectURI  = "https://app.example.com/callback"
+	verifier     = "a-code-verifier-long-enough-to-be-random-0123456789"
+)
+
+var identity = session.Identity{
+	Method:         "bankid",
+	PersonalNumber: "199001012385",
+	Name:           "Anna Andersson",
+	GivenName:      "Anna",
+	FamilyName:     "Andersson",
+	AuthTime:       time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC),
+}
+
+type memoryStore struct {
+	values map[string][]byte
+	mutex  sync.Mutex
+}
+
+func (s *memoryStore) SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+func (s *memoryStore) TakeValue(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.values[key]
+	delete(s.values, key)
+	return value, ok, nil
+}
+
+func newTestProvider(t *testing.T) *OpenIDProvider {
+	t.Helper()
+	issuer, err := session.NewIssuer(&session.Config{Issuer: "https://id.example.com", PseudonymSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := NewOpenIDProvider(&Config{
+		Clients: []Client{
+			{ID: clientID, Secret: clientSecret, RedirectURIs: []string{redirectURI, "http://localhost:3000/callback"}},
+			{ID: "spa", RedirectURIs: []string{"https://spa.example.com/callback"}},
+		},
+	}, issuer, &memoryStore{values: map[string][]byte{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authorizeValues() url.Values {
+	return url.Values{
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"state":                 {"client-state"},
+		"nonce":                 {"client-nonce"},
+		"code_challenge":        {challenge(verifier)},
+		"code_challenge_method": {PKCE_S256},
+	}
+}
+
+// Authorizes a request with the values changed by change, returns the code
+func authorize(t *testing.T, op *OpenIDProvider, change func(url.Values)) string {
+	t.Helper()
+	values := authorizeValues()
+	if change != nil {
+		change(values)
+	}
+	request, err := op.ParseAuthorizationRequest(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectURL, err := op.Authorize(context.Background(), request, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("state") != "client-state" || query.Get("iss") != "https://id.example.com" || query.Get("code") == "" {
+		t.Fatalf("redirect URL %s, want the code with the state and issuer", redirectURL)
+	}
+	return query.Get("code")
+}
+
+func tokenRequest(code string) TokenRequest {
+	return TokenRequest{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Code:         code,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+	}
+}
+
+func expectError(t *testing.T, err error, code ErrorCode) {
+	t.Helper()
+	var oidcError *Error
+	if !errors.As(err, &oidcError) || oidcError.Code != code {
+		t.Errorf("got %v, want %s", err, code)
+	}
+}
+
+func TestParseAuthorizationRequest(t *testing.T) {
+	op := newTestProvider(t)
+	tests := []struct {
+		name   string
+		change func(url.Values)
+		// Errors about the client and redirect URI cannot be sent to it
+		redirect bool
+		err      ErrorCode
+	}{
+		{name: "unknown client", change: func(v url.Values) { v.Set("client_id", "other") }, err: INVALID_CLIENT},
+		{name: "unregistered redirect_uri", change: func(v url.Values) { v.Set("redirect_uri", "https://evil.example.com/callback") }, err: INVALID_REQUEST},
+		// Redirect URIs are compared exactly
+		{name: "trailing slash", change: func(v url.Values) { v.Set("redirect_uri", redirectURI+"/") }, err: INVALID_REQUEST},
+		{name: "other case", change: func(v url.Values) { v.Set("redirect_uri", strings.ToUpper(redirectURI)) }, err: INVALID_REQUEST},
+		{name: "added query", change: func(v url.Values) { v.Set("redirect_uri", redirectURI+"?next=/") }, err: INVALID_REQUEST},
+		{name: "sub path", change: func(v url.Values) { v.Set("redirect_uri", redirectURI+"/more") }, err: INVALID_REQUEST},
+		{name: "other port", change: func(v url.Values) { v.Set("redirect_uri", "http://localhost:3001/callback") }, err: INVALID_REQUEST},
+		{name: "redirect_uri of another client", change: func(v url.Values) { v.Set("redirect_uri", "https://spa.example.com/callback") }, err: INVALID_REQUEST},
+		{name: "implicit flow", change: func(v url.Values) { v.Set("response_type", "id_token") }, redirect: true, err: UNSUPPORTED_RESPONSE_TYPE},
+		{name: "no openid scope", change: func(v url.Values) { v.Set("scope", "profile") }, redirect: true, err: INVALID_SCOPE},
+		{name: "no PKCE", change: func(v url.Values) { v.Del("code_challenge") }, redirect: true, err: INVALID_REQUEST},
+		{name: "plain PKCE", change: func(v url.Values) { v.Set("code_challenge_method", "plain") }, redirect: true, err: INVALID_REQUEST},
+		{name: "no login", change: func(v url.Values) { v.Set("prompt", "none") }, redirect: true, err: LOGIN_REQUIRED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := authorizeValues()
+			test.change(values)
+			request, err := op.ParseAuthorizationRequest(values)
+			expectError(t, err, test.err)
+			if (request != nil) != test.redirect {
+				t.Errorf("request returned: %v, want %v", request != nil, test.redirect)
+			}
+		})
+	}
+
+	values := authorizeValues()
+	values.Set("scope", "openid email "+SCOPE_PERSONAL_NUMBER)
+	request, err := op.ParseAuthorizationRequest(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Scope != "openid "+SCOPE_PERSONAL_NUMBER {
+		t.Errorf("scope %q, want the unsupported scopes left out", request.Scope)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	op := newTestProvider(t)
+	response, err := op.Exchange(context.Background(), tokenRequest(authorize(t, op, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.TokenType != "Bearer" || response.Scope != "openid" || response.ExpiresIn != int(DEFAULT_ACCESS_TOKEN_LIFETIME.Seconds()) {
+		t.Errorf("got %+v", response)
+	}
+	var claims IDTokenClaims
+	if err := op.Issuer.Parse(response.IDToken, &claims, ID_TOKEN_TYPE, clientID); err != nil {
+		t.Fatalf("invalid ID token: %v", err)
+	}
+	if claims.Nonce != "client-nonce" || claims.Subject != op.Issuer.Pseudonym(identity.PersonalNumber) || claims.AuthTime != identity.AuthTime.Unix() {
+		t.Errorf("got ID token claims %+v", claims)
+	}
+	// Tokens for the client are not sessions of the service
+	if _, err := op.Issuer.Verify(response.IDToken); err == nil {
+		t.Error("ID token accepted as a session token")
+	}
+	if _, err := op.Issuer.Verify(response.AccessToken); err == nil {
+		t.Error("access token accepted as a session token")
+	}
+}
+
+func TestExchangeSingleUse(t *testing.T) {
+	op := newTestProvider(t)
+	code := authorize(t, op, nil)
+	if _, err := op.Exchange(context.Background(), tokenRequest(code)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := op.Exchange(context.Background(), tokenRequest(code))
+	expectError(t, err, INVALID_GRANT)
+
+	_, err = op.Exchange(context.Background(), tokenRequest("unknown"))
+	expectError(t, err, INVALID_GRANT)
+	_, err = op.Exchange(context.Background(), tokenRequest(""))
+	expectError(t, err, INVALID_GRANT)
+}
+
+func TestExchangePKCE(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier string
+	}{
+		{"missing", ""},
+		{"wrong", "another-code-verifier-long-enough-to-be-random-0123"},
+		// The challenge itself, as with the plain method
+		{"challenge", challenge(verifier)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			op := newTestProvider(t)
+			code := authorize(t, op, nil)
+			request := tokenRequest(code)
+			request.CodeVerifier = test.verifier
+			_, err := op.Exchange(context.Background(), request)
+			expectError(t, err, INVALID_GRANT)
+
+			// The code is spent even though the exchange failed
+			_, err = op.Exchange(context.Background(), tokenRequest(code))
+			expectError(t, err, INVALID_GRANT)
+		})
+	}
+}
+
+func TestExchangeRedirectURI(t *testing.T) {
+	for _, other := range []string{"", redirectURI + "/", "http://localhost:3000/callback"} {
+		op := newTestProvider(t)
+		request := tokenRequest(authorize(t, op, nil))
+		request.RedirectURI = other
+		_, err := op.Exchange(context.Background(), request)
+		expectError(t, err, INVALID_GRANT)
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*TokenRequest)
+		err    ErrorCode
+	}{
+		{name: "wrong secret", change: func(r *TokenRequest) { r.ClientSecret = "guessed" }, err: INVALID_CLIENT},
+		{name: "no secret", change: func(r *TokenRequest) { r.ClientSecret = "" }, err: INVALID_CLIENT},
+		{name: "unknown client", change: func(r *TokenRequest) { r.ClientID = "other" }, err: INVALID_CLIENT},
+		// Public clients have no secret to check, but the code is not theirs
+		{name: "other client", change: func(r *TokenRequest) { r.ClientID, r.ClientSecret = "spa", "" }, err: INVALID_GRANT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			op := newTestProvider(t)
+			request := tokenRequest(authorize(t, op, nil))
+			test.change(&request)
+			_, err := op.Exchange(context.Background(), request)
+			expectError(t, err, test.err)
+		})
+	}
+
+	op := newTestProvider(t)
+	code := authorize(t, op, func(v url.Values) {
+		v.Set("client_id", "spa")
+		v.Set("redirect_uri", "https://spa.example.com/callback")
+	})
+	_, err := op.Exchange(context.Background(), TokenRequest{
+		ClientID:     "spa",
+		Code:         code,
+		RedirectURI:  "https://spa.example.com/callback",
+		CodeVerifier: verifier,
+	})
+	if err != nil {
+		t.Errorf("public client: %v", err)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	tests := []struct {
+		scope          string
+		name           bool
+		personalNumber bool
+	}{
+		{"openid", false, false},
+		{"openid profile", true, false},
+		{"openid " + SCOPE_PERSONAL_NUMBER, false, true},
+		{"openid profile " + SCOPE_PERSONAL_NUMBER, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.scope, func(t *testing.T) {
+			op := newTestProvider(t)
+			code := authorize(t, op, func(v url.Values) { v.Set("scope", test.scope) })
+			response, err := op.Exchange(context.Background(), tokenRequest(code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims IDTokenClaims
+			if err := op.Issuer.Parse(response.IDToken, &claims, ID_TOKEN_TYPE, clientID); err != nil {
+				t.Fatal(err)
+			}
+			userInfo, err := op.UserInfo(response.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := claims.Name == identity.Name && claims.GivenName == identity.GivenName && claims.FamilyName == identity.FamilyName; got != test.name {
+				t.Errorf("names in the ID token: %v, want %v", got, test.name)
+			}
+			if got := userInfo.Name == identity.Name && userInfo.GivenName == identity.GivenName && userInfo.FamilyName == identity.FamilyName; got != test.name {
+				t.Errorf("names in the userinfo: %v, want %v", got, test.name)
+			}
+			if got := claims.PersonalNumber == identity.PersonalNumber; got != test.personalNumber {
+				t.Errorf("personal number in the ID token: %v, want %v", got, test.personalNumber)
+			}
+			if got := userInfo.PersonalNumber == identity.PersonalNumber; got != test.personalNumber {
+				t.Errorf("personal number in the userinfo: %v, want %v", got, test.personalNumber)
+			}
+			if !test.personalNumber && (claims.PersonalNumber != "" || userInfo.PersonalNumber != "") {
+				t.Error("personal number released without its scope")
+			}
+		})
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	op := newTestProvider(t)
+	response, err := op.Exchange(context.Background(), tokenRequest(authorize(t, op, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userInfo, err := op.UserInfo(response.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.Subject != op.Issuer.Pseudonym(identity.PersonalNumber) {
+		t.Errorf("subject %q, want the pseudonym", userInfo.Subject)
+	}
+
+	sessionToken, _, err := op.Issuer.Issue(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{
+		"ID token":      response.IDToken,
+		"session token": sessionToken,
+		"tampered":      response.AccessToken[:len(response.AccessToken)-2],
+		"empty":         "",
+	} {
+		_, err := op.UserInfo(token)
+		var oidcError *Error
+		if !errors.As(err, &oidcError) || oidcError.Code != INVALID_TOKEN {
+			t.Errorf("%s: got %v, want an invalid token", name, err)
+		}
+	}
+}
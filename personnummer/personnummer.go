@@ -0,0 +1,183 @@
+// Package personnummer parses and validates Swedish personal identity numbers
+// (personnummer) and coordination numbers (samordningsnummer).
+package personnummer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalid = errors.New("personnummer: invalid personal identity number")
+
+type Gender string
+
+const (
+	FEMALE Gender = "female"
+	MALE   Gender = "male"
+)
+
+// Coordination numbers have 60 added to the day of birth
+const COORDINATION_OFFSET = 60
+
+// Serial numbers Skatteverket sets aside for test personal identity numbers,
+// never given to real people. Source: Skatteverket, "Testpersonnummer", the
+// open data set of test numbers published by Skatteverket, which only uses
+// serials 980-999.
+const (
+	TEST_SERIAL_MIN = 980
+	TEST_SERIAL_MAX = 999
+)
+
+var pattern = regexp.MustCompile(`^(\d{2})?(\d{2})(\d{2})(\d{2})([-+]?)(\d{3})(\d)$`)
+
+type Personnummer struct {
+	Year   int
+	Month  int
+	Day    int
+	Serial int
+	Check  int
+	// Samordningsnummer, Day is the actual day of birth
+	Coordination bool
+}
+
+// Parses YYMMDD-NNNC, YYMMDD+NNNC, YYYYMMDD-NNNC or the same without the
+// separator, the century of 10 digit forms is inferred from the current date
+func Parse(s string) (Personnummer, error) {
+	return ParseAt(s, time.Now())
+}
+
+// Same as Parse with the century inferred relative to now
+func ParseAt(s string, now time.Time) (Personnummer, error) {
+	match := pattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return Personnummer{}, invalid("expected YYMMDD-NNNC or YYYYMMDD-NNNC")
+	}
+	year, _ := strconv.Atoi(match[2])
+	month, _ := strconv.Atoi(match[3])
+	day, _ := strconv.Atoi(match[4])
+	serial, _ := strconv.Atoi(match[6])
+	check, _ := strconv.Atoi(match[7])
+
+	if !luhnValid(match[2] + match[3] + match[4] + match[6] + match[7]) {
+		return Personnummer{}, invalid("wrong check digit")
+	}
+
+	p := Personnummer{
+		Month:  month,
+		Day:    day,
+		Serial: serial,
+		Check:  check,
+	}
+	if day > COORDINATION_OFFSET {
+		p.Day -= COORDINATION_OFFSET
+		p.Coordination = true
+	}
+
+	if match[1] != "" {
+		century, _ := strconv.Atoi(match[1])
+		p.Year = century*100 + year
+	} else {
+		p.Year = inferYear(year, month, p.Day, match[5] == "+", now)
+	}
+
+	birth := time.Date(p.Year, time.Month(p.Month), p.Day, 0, 0, 0, 0, time.UTC)
+	if birth.Year() != p.Year || int(birth.Month()) != p.Month || birth.Day() != p.Day {
+		return Personnummer{}, invalid("no such date %04d-%02d-%02d", p.Year, p.Month, p.Day)
+	}
+	if birth.After(now) {
+		return Personnummer{}, invalid("date of birth is in the future")
+	}
+	return p, nil
+}
+
+// Most recent year ending in yy for which the person is not born in the
+// future, and at least 100 years ago with the + separator
+func inferYear(yy, month, day int, centenarian bool, now time.Time) int {
+	year := now.Year() - (now.Year()-yy+100)%100
+	if time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).After(now) {
+		year -= 100
+	}
+	if centenarian && time.Date(year+100, time.Month(month), day, 0, 0, 0, 0, time.UTC).After(now) {
+		year -= 100
+	}
+	return year
+}
+
+func Valid(s string) bool {
+	_, err := Parse(s)
+	return err == nil
+}
+
+// The 12 digit form without separator, YYYYMMDDNNNC, as expected by BankID
+func (p Personnummer) String() string {
+	return fmt.Sprintf("%04d%02d%02d%03d%d", p.Year, p.Month, p.day(), p.Serial, p.Check)
+}
+
+// The 10 digit form, YYMMDD-NNNC or YYMMDD+NNNC from the year the person turns 100
+func (p Personnummer) Short(now time.Time) string {
+	separator := "-"
+	if p.AgeAt(now) >= 100 {
+		separator = "+"
+	}
+	return fmt.Sprintf("%02d%02d%02d%s%03d%d", p.Year%100, p.Month, p.day(), separator, p.Serial, p.Check)
+}
+
+// Day as written in the number
+func (p Personnummer) day() int {
+	if p.Coordination {
+		return p.Day + COORDINATION_OFFSET
+	}
+	return p.Day
+}
+
+func (p Personnummer) BirthDate() time.Time {
+	return time.Date(p.Year, time.Month(p.Month), p.Day, 0, 0, 0, 0, time.UTC)
+}
+
+func (p Personnummer) Age() int {
+	return p.AgeAt(time.Now())
+}
+
+func (p Personnummer) AgeAt(now time.Time) int {
+	age := now.Year() - p.Year
+	if now.Month() < time.Month(p.Month) || (now.Month() == time.Month(p.Month) && now.Day() < p.Day) {
+		age--
+	}
+	return age
+}
+
+// Legal gender, from the parity of the last serial digit
+func (p Personnummer) Gender() Gender {
+	if p.Serial%2 == 0 {
+		return FEMALE
+	}
+	return MALE
+}
+
+// Whether the number is in the range reserved for testing
+func (p Personnummer) IsTestNumber() bool {
+	return p.Serial >= TEST_SERIAL_MIN && p.Serial <= TEST_SERIAL_MAX
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	for i, digit := range digits {
+		d := int(digit - '0')
+		if i%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
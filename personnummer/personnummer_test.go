@@ -0,0 +1,200 @@
+package personnummer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+func TestParseAt(t *testing.T) {
+	tests := []struct {
+		input        string
+		want         string
+		coordination bool
+	}{
+		{"199001012385", "199001012385", false},
+		{"19900101-2385", "199001012385", false},
+		{"900101-2385", "199001012385", false},
+		{"9001012385", "199001012385", false},
+		{" 900101-2385 ", "199001012385", false},
+		// The + separator is for people aged 100 or more
+		{"900101+2385", "189001012385", false},
+		// Not born in the future, so the previous century
+		{"250101-1239", "192501011239", false},
+		{"240615-1239", "202406151239", false},
+		{"240616-1238", "192406161238", false},
+		{"240615+1239", "192406151239", false},
+		{"240616+1238", "182406161238", false},
+		// Coordination numbers have 60 added to the day
+		{"900161-1236", "199001611236", true},
+		{"20000229-1235", "200002291235", false},
+	}
+	for _, test := range tests {
+		p, err := ParseAt(test.input, now)
+		if err != nil {
+			t.Errorf("ParseAt(%q): %v", test.input, err)
+			continue
+		}
+		if got := p.String(); got != test.want {
+			t.Errorf("ParseAt(%q) = %s, want %s", test.input, got, test.want)
+		}
+		if p.Coordination != test.coordination {
+			t.Errorf("ParseAt(%q) coordination = %v, want %v", test.input, p.Coordination, test.coordination)
+		}
+	}
+}
+
+func TestParseAtInvalid(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"199001012386", "wrong check digit"},
+		{"900101-2386", "wrong check digit"},
+		{"9001012", "expected"},
+		{"19900101/2385", "expected"},
+		{"abcdef-ghij", "expected"},
+		{"", "expected"},
+		// Only 2000 is a leap year of the two
+		{"19000229-1235", "no such date"},
+		{"230229-1238", "no such date"},
+		{"901301-1235", "no such date"},
+		{"900132-1232", "no such date"},
+		{"20300101-1232", "in the future"},
+		{"20240616-1238", "in the future"},
+	}
+	for _, test := range tests {
+		_, err := ParseAt(test.input, now)
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("ParseAt(%q) = %v, want an invalid number", test.input, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseAt(%q) = %q, want %q", test.input, err, test.err)
+		}
+	}
+}
+
+func TestCoordinationNumber(t *testing.T) {
+	p, err := ParseAt("900161-1236", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Day != 1 {
+		t.Errorf("day %d, want the actual day of birth", p.Day)
+	}
+	if birth := p.BirthDate(); !birth.Equal(time.Date(1990, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("born %s, want 1990-01-01", birth)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, input := range []string{"199001012385", "189001012385", "192406161238", "199001611236", "200002291235"} {
+		p, err := ParseAt(input, now)
+		if err != nil {
+			t.Fatalf("ParseAt(%q): %v", input, err)
+		}
+		short := p.Short(now)
+		fromShort, err := ParseAt(short, now)
+		if err != nil {
+			t.Errorf("ParseAt(%q), short form of %s: %v", short, input, err)
+			continue
+		}
+		if fromShort != p {
+			t.Errorf("%s is %s in short form, which parses to %s", input, short, fromShort)
+		}
+		fromString, err := ParseAt(p.String(), now)
+		if err != nil || fromString != p {
+			t.Errorf("%s does not parse back to itself: %s, %v", p, fromString, err)
+		}
+	}
+}
+
+func TestShort(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"199001012385", "900101-2385"},
+		{"189001012385", "900101+2385"},
+		// Turns 100 tomorrow
+		{"192406161238", "240616-1238"},
+		{"192406151239", "240615+1239"},
+		{"199001611236", "900161-1236"},
+	}
+	for _, test := range tests {
+		p, err := ParseAt(test.input, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Short(now); got != test.want {
+			t.Errorf("%s.Short() = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestAgeAt(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"199001012385", 34},
+		{"192406161238", 99},
+		{"192406151239", 100},
+		{"200002291235", 24},
+	}
+	for _, test := range tests {
+		p, err := ParseAt(test.input, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.AgeAt(now); got != test.want {
+			t.Errorf("%s.AgeAt() = %d, want %d", test.input, got, test.want)
+		}
+	}
+}
+
+func TestIsTestNumber(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"199001019802", true},
+		{"199001019992", true},
+		{"199001019794", false},
+		{"199001012385", false},
+		// Coordination numbers can be test numbers too
+		{"199001619825", true},
+	}
+	for _, test := range tests {
+		p, err := ParseAt(test.input, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.IsTestNumber(); got != test.want {
+			t.Errorf("%s.IsTestNumber() = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestGender(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Gender
+	}{
+		{"199001012385", FEMALE},
+		{"199001012393", MALE},
+	}
+	for _, test := range tests {
+		p, err := ParseAt(test.input, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Gender(); got != test.want {
+			t.Errorf("%s.Gender() = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package samlidp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+type Config struct {
+	// Defaults to the metadata URL
+	EntityID string `yaml:"entityId"`
+	// PEM encoded certificate and RSA or P-256 key signing assertions
+	CertificateFile string `yaml:"certificateFile"`
+	KeyFile         string `yaml:"keyFile"`
+	// Metadata of the service providers allowed to log users in
+	ServiceProviders []ServiceProvider `yaml:"serviceProviders"`
+}
+
+// Metadata of a service provider, from a file or inline XML
+type ServiceProvider struct {
+	MetadataFile string `yaml:"metadataFile"`
+	Metadata     string `yaml:"metadata"`
+}
+
+func (c *Config) validate() error {
+	if len(c.ServiceProviders) == 0 {
+		return errors.New("saml: no service provider configured")
+	}
+	if (c.CertificateFile == "") != (c.KeyFile == "") {
+		return errors.New("saml: both 'certificateFile' and 'keyFile' are needed")
+	}
+	return nil
+}
+
+func (sp ServiceProvider) load() (*saml.EntityDescriptor, error) {
+	data := []byte(sp.Metadata)
+	if sp.MetadataFile != "" {
+		var err error
+		data, err = os.ReadFile(sp.MetadataFile)
+		if err != nil {
+			return nil, fmt.Errorf("saml: could not read service provider metadata: %w", err)
+		}
+	}
+	var metadata saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("saml: invalid service provider metadata: %w", err)
+	}
+	if metadata.EntityID == "" || len(metadata.SPSSODescriptors) == 0 {
+		return nil, errors.New("saml: service provider metadata without an entityID or SPSSODescriptor")
+	}
+	return &metadata, nil
+}
+
+// Loads the configured signing certificate, or generates a self-signed one
+// that only lives as long as the process when none is configured
+func (c *Config) loadCertificate(entityID string) (*x509.Certificate, crypto.Signer, error) {
+	if c.CertificateFile == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("saml: could not generate key: %w", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: entityID},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(1, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("saml: could not generate certificate: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Println("No SAML certificate configured, using a random one for this run only")
+		return cert, key, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(c.CertificateFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("saml: could not load certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("saml: could not parse certificate: %w", err)
+	}
+	switch key := pair.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return cert, key, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, nil, errors.New("saml: only P-256 EC keys are supported")
+		}
+		return cert, key, nil
+	default:
+		return nil, nil, fmt.Errorf("saml: unsupported key type %T", pair.PrivateKey)
+	}
+}
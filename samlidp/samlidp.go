@@ -0,0 +1,208 @@
+// Package samlidp is a SAML 2.0 identity provider releasing the attributes of
+// the Sweden Connect attribute specification, so that systems only speaking
+// SAML can log users in with the eID providers of this service.
+package samlidp
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Splinter0/identity/personnummer"
+	"github.com/Splinter0/identity/session"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Attributes from the Sweden Connect attribute specification
+const (
+	ATTRIBUTE_PERSONAL_IDENTITY_NUMBER = "urn:oid:1.2.752.29.4.13"
+	ATTRIBUTE_GIVEN_NAME               = "urn:oid:2.5.4.42"
+	ATTRIBUTE_SURNAME                  = "urn:oid:2.5.4.4"
+	ATTRIBUTE_DISPLAY_NAME             = "urn:oid:2.16.840.1.113730.3.1.241"
+	ATTRIBUTE_DATE_OF_BIRTH            = "urn:oid:1.3.6.1.5.5.7.9.1"
+
+	NAME_FORMAT_URI        = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	NAME_ID_FORMAT_PERSIST = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+)
+
+type IdentityProvider struct {
+	Config *Config
+	Issuer *session.Issuer
+	idp    *saml.IdentityProvider
+}
+
+// Authentication request of a service provider, kept while the user logs in
+type PendingRequest struct {
+	RequestBuffer []byte
+	RelayState    string
+	ReceivedAt    time.Time
+}
+
+// The SSO endpoint has to be served at <baseURL>/saml/sso, the entity ID
+// defaults to <baseURL>/saml/metadata
+func NewIdentityProvider(config *Config, issuer *session.Issuer, baseURL string) (*IdentityProvider, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("saml: invalid base URL: %w", err)
+	}
+	if config.EntityID == "" {
+		config.EntityID = base.JoinPath("/saml/metadata").String()
+	}
+	// Used by the library as entity ID, the metadata is served by the caller
+	entityID, err := url.Parse(config.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("saml: invalid entity ID: %w", err)
+	}
+	serviceProviders := make(serviceProviders, len(config.ServiceProviders))
+	for _, sp := range config.ServiceProviders {
+		metadata, err := sp.load()
+		if err != nil {
+			return nil, err
+		}
+		serviceProviders[metadata.EntityID] = metadata
+	}
+	cert, signer, err := config.loadCertificate(config.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	signatureMethod := dsig.RSASHA256SignatureMethod
+	if _, ok := signer.(*ecdsa.PrivateKey); ok {
+		signatureMethod = dsig.ECDSASHA256SignatureMethod
+	}
+
+	p := &IdentityProvider{
+		Config: config,
+		Issuer: issuer,
+	}
+	p.idp = &saml.IdentityProvider{
+		Signer:                  signer,
+		Certificate:             cert,
+		Logger:                  log.Default(),
+		MetadataURL:             *entityID,
+		SSOURL:                  *base.JoinPath("/saml/sso"),
+		ServiceProviderProvider: serviceProviders,
+		AssertionMaker:          assertionMaker{p},
+		SignatureMethod:         signatureMethod,
+	}
+	return p, nil
+}
+
+type serviceProviders map[string]*saml.EntityDescriptor
+
+func (s serviceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	metadata, ok := s[serviceProviderID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return metadata, nil
+}
+
+func (p *IdentityProvider) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	p.idp.ServeMetadata(w, r)
+}
+
+// Validates an authentication request sent with the HTTP-Redirect or
+// HTTP-POST binding
+func (p *IdentityProvider) ParseRequest(r *http.Request) (*PendingRequest, error) {
+	req, err := saml.NewIdpAuthnRequest(p.idp, r)
+	if err != nil {
+		return nil, fmt.Errorf("saml: could not parse request: %w", err)
+	}
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("saml: invalid request: %w", err)
+	}
+	return &PendingRequest{
+		RequestBuffer: req.RequestBuffer,
+		RelayState:    req.RelayState,
+		ReceivedAt:    req.Now,
+	}, nil
+}
+
+// Sends the signed assertion for the user to the service provider, with the
+// HTTP-POST binding
+func (p *IdentityProvider) Respond(w http.ResponseWriter, r *http.Request, pending *PendingRequest, identity session.Identity) error {
+	req := &saml.IdpAuthnRequest{
+		IDP:           p.idp,
+		HTTPRequest:   r,
+		RequestBuffer: pending.RequestBuffer,
+		RelayState:    pending.RelayState,
+		// The request was valid when received, logging in takes longer than
+		// requests are valid for
+		Now: pending.ReceivedAt,
+	}
+	if err := req.Validate(); err != nil {
+		return fmt.Errorf("saml: invalid request: %w", err)
+	}
+	req.Now = saml.TimeNow()
+	index := make([]byte, 16)
+	if _, err := rand.Read(index); err != nil {
+		return err
+	}
+	if err := p.idp.AssertionMaker.MakeAssertion(req, &saml.Session{
+		ID:               hex.EncodeToString(index),
+		CreateTime:       identity.AuthTime,
+		Index:            hex.EncodeToString(index),
+		NameID:           p.Issuer.Subject(identity.PersonalNumber),
+		NameIDFormat:     NAME_ID_FORMAT_PERSIST,
+		CustomAttributes: attributes(identity),
+	}); err != nil {
+		return err
+	}
+	return req.WriteResponse(w)
+}
+
+type assertionMaker struct {
+	p *IdentityProvider
+}
+
+func (m assertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, s *saml.Session) error {
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, s); err != nil {
+		return err
+	}
+	if len(req.Assertion.AuthnStatements) == 0 {
+		return errors.New("saml: assertion without an authentication statement")
+	}
+	// Level of assurance of the eID
+	req.Assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value = m.p.Issuer.Config.LoA
+	// Only the Sweden Connect attributes, not the ones guessed from the
+	// requested attributes of the service provider
+	req.Assertion.AttributeStatements = []saml.AttributeStatement{{Attributes: s.CustomAttributes}}
+	return nil
+}
+
+func attributes(identity session.Identity) []saml.Attribute {
+	attributes := []saml.Attribute{
+		attribute(ATTRIBUTE_PERSONAL_IDENTITY_NUMBER, "personalIdentityNumber", identity.PersonalNumber),
+		attribute(ATTRIBUTE_GIVEN_NAME, "givenName", identity.GivenName),
+		attribute(ATTRIBUTE_SURNAME, "sn", identity.FamilyName),
+		attribute(ATTRIBUTE_DISPLAY_NAME, "displayName", identity.Name),
+	}
+	if pnr, err := personnummer.Parse(identity.PersonalNumber); err == nil {
+		attributes = append(attributes, attribute(ATTRIBUTE_DATE_OF_BIRTH, "dateOfBirth", pnr.BirthDate().Format(time.DateOnly)))
+	}
+	return attributes
+}
+
+func attribute(name, friendlyName, value string) saml.Attribute {
+	return saml.Attribute{
+		FriendlyName: friendlyName,
+		Name:         name,
+		NameFormat:   NAME_FORMAT_URI,
+		Values: []saml.AttributeValue{{
+			Type:  "xs:string",
+			Value: value,
+		}},
+	}
+}
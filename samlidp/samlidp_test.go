@@ -0,0 +1,287 @@
+package samlidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Splinter0/identity/session"
+	"github.com/crewjam/saml"
+)
+
+const baseURL = "https://id.example.com"
+
+var identity = session.Identity{
+	Method:         "bankid",
+	PersonalNumber: "199001012385",
+	Name:           "Anna Andersson",
+	GivenName:      "Anna",
+	FamilyName:     "Andersson",
+	AuthTime:       time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC),
+}
+
+var responseField = regexp.MustCompile(`name="SAMLResponse" value="([^"]+)"`)
+
+// Service provider with its own key, so assertions are encrypted for it
+func newServiceProvider(t *testing.T, entityID string) *saml.ServiceProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: entityID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadataURL, _ := url.Parse(entityID)
+	return &saml.ServiceProvider{
+		EntityID:    entityID,
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		AcsURL:      *metadataURL.JoinPath("/acs"),
+	}
+}
+
+func spMetadata(t *testing.T, sp *saml.ServiceProvider) string {
+	t.Helper()
+	data, err := xml.Marshal(sp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func newTestIdentityProvider(t *testing.T, sps ...*saml.ServiceProvider) *IdentityProvider {
+	t.Helper()
+	issuer, err := session.NewIssuer(&session.Config{Issuer: baseURL, PseudonymSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{}
+	for _, sp := range sps {
+		config.ServiceProviders = append(config.ServiceProviders, ServiceProvider{Metadata: spMetadata(t, sp)})
+	}
+	p, err := NewIdentityProvider(config, issuer, baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The service providers trust the metadata it publishes
+	for _, sp := range sps {
+		sp.IDPMetadata = metadata(t, p)
+	}
+	return p
+}
+
+func metadata(t *testing.T, p *IdentityProvider) *saml.EntityDescriptor {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	p.ServeMetadata(recorder, httptest.NewRequest("GET", baseURL+"/saml/metadata", nil))
+	var descriptor saml.EntityDescriptor
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &descriptor); err != nil {
+		t.Fatalf("invalid metadata: %v", err)
+	}
+	return &descriptor
+}
+
+// Authentication request of the service provider with the HTTP-Redirect
+// binding, with its ID
+func authnRequest(t *testing.T, sp *saml.ServiceProvider) (*http.Request, string) {
+	t.Helper()
+	request, err := sp.MakeAuthenticationRequest(baseURL+"/saml/sso", saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectURL, err := request.Redirect("relay-state", sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest("GET", redirectURL.String(), nil), request.ID
+}
+
+func TestMetadata(t *testing.T) {
+	p := newTestIdentityProvider(t, newServiceProvider(t, "https://sp.example.com"))
+	descriptor := metadata(t, p)
+	if descriptor.EntityID != baseURL+"/saml/metadata" {
+		t.Errorf("entity ID %q, want the metadata URL", descriptor.EntityID)
+	}
+	if len(descriptor.IDPSSODescriptors) != 1 {
+		t.Fatalf("%d IdP descriptors, want 1", len(descriptor.IDPSSODescriptors))
+	}
+	idp := descriptor.IDPSSODescriptors[0]
+	bindings := map[string]bool{}
+	for _, service := range idp.SingleSignOnServices {
+		if service.Location != baseURL+"/saml/sso" {
+			t.Errorf("%s served at %q", service.Binding, service.Location)
+		}
+		bindings[service.Binding] = true
+	}
+	if !bindings[saml.HTTPRedirectBinding] || !bindings[saml.HTTPPostBinding] {
+		t.Errorf("bindings %v, want HTTP-Redirect and HTTP-POST", bindings)
+	}
+	signing := false
+	for _, key := range idp.KeyDescriptors {
+		for _, cert := range key.KeyInfo.X509Data.X509Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(cert.Data), ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Use == "signing" && string(der) == string(p.idp.Certificate.Raw) {
+				signing = true
+			}
+		}
+	}
+	if !signing {
+		t.Error("signing certificate not published")
+	}
+}
+
+func TestEntityID(t *testing.T) {
+	issuer, err := session.NewIssuer(&session.Config{Issuer: baseURL, PseudonymSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := newServiceProvider(t, "https://sp.example.com")
+	config := &Config{EntityID: "urn:example:idp", ServiceProviders: []ServiceProvider{{Metadata: spMetadata(t, sp)}}}
+	p, err := NewIdentityProvider(config, issuer, baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metadata(t, p).EntityID; got != "urn:example:idp" {
+		t.Errorf("entity ID %q, want the configured one", got)
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	sp := newServiceProvider(t, "https://sp.example.com")
+	p := newTestIdentityProvider(t, sp)
+	r, _ := authnRequest(t, sp)
+	pending, err := p.ParseRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.RelayState != "relay-state" || len(pending.RequestBuffer) == 0 {
+		t.Errorf("got %+v", pending)
+	}
+
+	// Not in the configuration, even though it trusts the identity provider
+	unknown := newServiceProvider(t, "https://unknown.example.com")
+	unknown.IDPMetadata = sp.IDPMetadata
+	r, _ = authnRequest(t, unknown)
+	if _, err := p.ParseRequest(r); err == nil {
+		t.Error("request of an unknown service provider accepted")
+	}
+
+	// Assertions may only go to the ACS URLs of the metadata
+	moved := *sp
+	moved.AcsURL = *moved.AcsURL.JoinPath("/other")
+	r, _ = authnRequest(t, &moved)
+	if _, err := p.ParseRequest(r); err == nil || !strings.Contains(err.Error(), "assertion consumer service") {
+		t.Errorf("request with another ACS URL returned %v", err)
+	}
+
+	r = httptest.NewRequest("GET", baseURL+"/saml/sso?SAMLRequest=garbage", nil)
+	if _, err := p.ParseRequest(r); err == nil {
+		t.Error("invalid request accepted")
+	}
+}
+
+func TestRespond(t *testing.T) {
+	sp := newServiceProvider(t, "https://sp.example.com")
+	p := newTestIdentityProvider(t, sp)
+	r, requestID := authnRequest(t, sp)
+	pending, err := p.ParseRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	if err := p.Respond(recorder, httptest.NewRequest("GET", baseURL+"/saml/continue", nil), pending, identity); err != nil {
+		t.Fatal(err)
+	}
+	page := recorder.Body.String()
+	match := responseField.FindStringSubmatch(page)
+	if match == nil {
+		t.Fatalf("no SAMLResponse in %s", page)
+	}
+	if !strings.Contains(page, sp.AcsURL.String()) || !strings.Contains(page, "relay-state") {
+		t.Errorf("response not posted to the ACS URL with the relay state: %s", page)
+	}
+	response, err := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(response), identity.PersonalNumber) {
+		t.Error("personal number readable in the response, assertion not encrypted")
+	}
+	// Checks the signature, audience, recipient and request ID
+	assertion, err := sp.ParseXMLResponse(response, []string{requestID}, sp.AcsURL)
+	if err != nil {
+		if invalid, ok := err.(*saml.InvalidResponseError); ok {
+			err = invalid.PrivateErr
+		}
+		t.Fatalf("service provider refused the response: %v", err)
+	}
+
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		t.Fatal("assertion without a NameID")
+	}
+	nameID := assertion.Subject.NameID
+	if nameID.Value != p.Issuer.Pseudonym(identity.PersonalNumber) || nameID.Format != NAME_ID_FORMAT_PERSIST {
+		t.Errorf("NameID %q (%s), want the persistent pseudonym", nameID.Value, nameID.Format)
+	}
+	if len(assertion.AuthnStatements) != 1 || assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef == nil {
+		t.Fatal("assertion without an authentication context")
+	}
+	if loa := assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value; loa != session.DEFAULT_LOA {
+		t.Errorf("level of assurance %q, want %q", loa, session.DEFAULT_LOA)
+	}
+
+	want := map[string]string{
+		ATTRIBUTE_PERSONAL_IDENTITY_NUMBER: identity.PersonalNumber,
+		ATTRIBUTE_GIVEN_NAME:               identity.GivenName,
+		ATTRIBUTE_SURNAME:                  identity.FamilyName,
+		ATTRIBUTE_DISPLAY_NAME:             identity.Name,
+		ATTRIBUTE_DATE_OF_BIRTH:            "1990-01-01",
+	}
+	got := map[string]string{}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.NameFormat != NAME_FORMAT_URI || len(attribute.Values) != 1 {
+				t.Errorf("attribute %s with format %q and %d values", attribute.Name, attribute.NameFormat, len(attribute.Values))
+				continue
+			}
+			got[attribute.Name] = attribute.Values[0].Value
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got attributes %v, want %v", got, want)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("attribute %s is %q, want %q", name, got[name], value)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package session
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+// Loads the configured key, or generates one that only lives as long as the
+// process when none is configured
+func loadKey(config *Config) (*signingKey, error) {
+	var data []byte
+	switch {
+	case config.KeyFile != "":
+		var err error
+		data, err = os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("session: could not read key: %w", err)
+		}
+	case config.KeyPEM != "":
+		data = []byte(config.KeyPEM)
+	default:
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("session: could not generate key: %w", err)
+		}
+		log.Println("No session key configured, using a random one for this run only")
+		return newSigningKey(private, config.KeyID)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("session: key is not PEM encoded")
+	}
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("session: could not parse key: %w", err)
+	}
+	return newSigningKey(private, config.KeyID)
+}
+
+func newSigningKey(private interface{}, id string) (*signingKey, error) {
+	key := &signingKey{id: id}
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return nil, errors.New("session: RSA keys must be at least 2048 bits")
+		}
+		key.method = jwt.SigningMethodRS256
+		key.private = private
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return nil, errors.New("session: only P-256 EC keys are supported")
+		}
+		key.method = jwt.SigningMethodES256
+		key.private = private
+	case ed25519.PrivateKey:
+		key.method = jwt.SigningMethodEdDSA
+		key.private = private
+	default:
+		return nil, fmt.Errorf("session: unsupported key type %T", private)
+	}
+	if key.id == "" {
+		der, err := x509.MarshalPKIXPublicKey(key.private.Public())
+		if err != nil {
+			return nil, fmt.Errorf("session: could not encode public key: %w", err)
+		}
+		sum := sha256.Sum256(der)
+		key.id = base64.RawURLEncoding.EncodeToString(sum[:16])
+	}
+	return key, nil
+}
+
+// Public key in JSON Web Key format, see RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Keys to verify tokens with, to be published so others can check them
+func (i *Issuer) JWKS() JWKS {
+	key := JWK{
+		Use: "sig",
+		Kid: i.key.id,
+		Alg: i.key.method.Alg(),
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	switch public := i.key.private.Public().(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = encode(public.N.Bytes())
+		key.E = encode(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key.Kty = "EC"
+		key.Crv = "P-256"
+		key.X = encode(public.X.FillBytes(make([]byte, 32)))
+		key.Y = encode(public.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		key.Kty = "OKP"
+		key.Crv = "Ed25519"
+		key.X = encode(public)
+	}
+	return JWKS{Keys: []JWK{key}}
+}
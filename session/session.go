@@ -0,0 +1,269 @@
+// Package session issues signed tokens (JWT) proving that a user logged in,
+// so that other services can trust the outcome of an identification without
+// talking to the eID providers themselves.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidToken = errors.New("session: invalid token")
+
+const (
+	DEFAULT_LIFETIME = 1 * time.Hour
+	DEFAULT_COOKIE   = "identitySession"
+	// Substantial level of assurance as defined by Sweden Connect, which is
+	// what BankID is certified for
+	DEFAULT_LOA = "http://id.elegnamnden.se/loa/1.0/loa3"
+
+	PERSONAL_NUMBER_CLAIM = "https://id.oidc.se/claim/personalIdentityNumber"
+
+	// Type in the header of session tokens, so that other tokens signed with
+	// the same key, like OpenID Connect ID tokens, are never accepted as
+	// session tokens (RFC 8725, explicit typing)
+	SESSION_TOKEN_TYPE = "session+jwt"
+)
+
+type SubjectType string
+
+const (
+	// Keyed hash of the personal number, stable for the same secret
+	SUBJECT_PSEUDONYM       SubjectType = "pseudonym"
+	SUBJECT_PERSONAL_NUMBER SubjectType = "personalNumber"
+)
+
+// Optional claims that can be added to tokens
+type Claim string
+
+const (
+	CLAIM_NAME            Claim = "name"
+	CLAIM_GIVEN_NAME      Claim = "givenName"
+	CLAIM_FAMILY_NAME     Claim = "familyName"
+	CLAIM_PERSONAL_NUMBER Claim = "personalNumber"
+)
+
+type Config struct {
+	Issuer   string        `yaml:"issuer"`
+	Audience []string      `yaml:"audience"`
+	Lifetime time.Duration `yaml:"lifetime"`
+	// PEM encoded RSA, P-256 or Ed25519 private key, only one can be set
+	KeyFile string `yaml:"keyFile"`
+	KeyPEM  string `yaml:"keyPem"`
+	// Defaults to a hash of the public key
+	KeyID           string      `yaml:"keyId"`
+	Subject         SubjectType `yaml:"subject"`
+	PseudonymSecret string      `yaml:"pseudonymSecret"`
+	Claims          []Claim     `yaml:"claims"`
+	LoA             string      `yaml:"loa"`
+
+	// How the token is given to the user
+	Cookie      string `yaml:"cookie"`
+	RedirectURL string `yaml:"redirectUrl"`
+	// Sends the whole completion data of the provider to the page, including
+	// the personal number, signature and OCSP response
+	ExposeCompletionData bool `yaml:"exposeCompletionData"`
+}
+
+func (c *Config) validate() error {
+	switch c.Subject {
+	case "":
+		c.Subject = SUBJECT_PSEUDONYM
+	case SUBJECT_PSEUDONYM, SUBJECT_PERSONAL_NUMBER:
+	default:
+		return fmt.Errorf("session: unknown subject %q", c.Subject)
+	}
+	if c.Subject == SUBJECT_PSEUDONYM && c.PseudonymSecret == "" {
+		return errors.New("session: 'pseudonymSecret' is needed to use pseudonyms as subject")
+	}
+	for _, claim := range c.Claims {
+		switch claim {
+		case CLAIM_NAME, CLAIM_GIVEN_NAME, CLAIM_FAMILY_NAME, CLAIM_PERSONAL_NUMBER:
+		default:
+			return fmt.Errorf("session: unknown claim %q", claim)
+		}
+	}
+	if c.Claims == nil {
+		c.Claims = []Claim{CLAIM_NAME}
+	}
+	if c.KeyFile != "" && c.KeyPEM != "" {
+		return errors.New("session: only one of 'keyFile' and 'keyPem' can be set")
+	}
+	if c.Issuer == "" {
+		return errors.New("session: 'issuer' is required")
+	}
+	if c.Lifetime <= 0 {
+		c.Lifetime = DEFAULT_LIFETIME
+	}
+	if c.LoA == "" {
+		c.LoA = DEFAULT_LOA
+	}
+	if c.Cookie == "" {
+		c.Cookie = DEFAULT_COOKIE
+	}
+	return nil
+}
+
+func (c *Config) hasClaim(claim Claim) bool {
+	for _, c := range c.Claims {
+		if c == claim {
+			return true
+		}
+	}
+	return false
+}
+
+// Who logged in and how, as reported by the provider
+type Identity struct {
+	// Authentication method, e.g. bankid
+	Method         string
+	PersonalNumber string
+	Name           string
+	GivenName      string
+	FamilyName     string
+	AuthTime       time.Time
+}
+
+type Claims struct {
+	jwt.RegisteredClaims
+	Name           string   `json:"name,omitempty"`
+	GivenName      string   `json:"given_name,omitempty"`
+	FamilyName     string   `json:"family_name,omitempty"`
+	PersonalNumber string   `json:"https://id.oidc.se/claim/personalIdentityNumber,omitempty"`
+	AMR            []string `json:"amr"`
+	AuthTime       int64    `json:"auth_time"`
+	ACR            string   `json:"acr,omitempty"`
+}
+
+type Issuer struct {
+	Config *Config
+	key    *signingKey
+}
+
+func NewIssuer(config *Config) (*Issuer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	key, err := loadKey(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		Config: config,
+		key:    key,
+	}, nil
+}
+
+// Pseudonym of a personal number, the same for every login
+func (i *Issuer) Pseudonym(personalNumber string) string {
+	mac := hmac.New(sha256.New, []byte(i.Config.PseudonymSecret))
+	mac.Write([]byte(personalNumber))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Subject of tokens for the personal number
+func (i *Issuer) Subject(personalNumber string) string {
+	if i.Config.Subject == SUBJECT_PSEUDONYM {
+		return i.Pseudonym(personalNumber)
+	}
+	return personalNumber
+}
+
+// Algorithm tokens are signed with
+func (i *Issuer) Algorithm() string {
+	return i.key.method.Alg()
+}
+
+// Claims the token for the identity would have
+func (i *Issuer) Claims(identity Identity) *Claims {
+	now := time.Now()
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.Config.Issuer,
+			Subject:   i.Subject(identity.PersonalNumber),
+			Audience:  i.Config.Audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(i.Config.Lifetime)),
+		},
+		AMR:      []string{identity.Method},
+		AuthTime: identity.AuthTime.Unix(),
+		ACR:      i.Config.LoA,
+	}
+	if i.Config.hasClaim(CLAIM_NAME) {
+		claims.Name = identity.Name
+	}
+	if i.Config.hasClaim(CLAIM_GIVEN_NAME) {
+		claims.GivenName = identity.GivenName
+	}
+	if i.Config.hasClaim(CLAIM_FAMILY_NAME) {
+		claims.FamilyName = identity.FamilyName
+	}
+	if i.Config.hasClaim(CLAIM_PERSONAL_NUMBER) {
+		claims.PersonalNumber = identity.PersonalNumber
+	}
+	return claims
+}
+
+func (i *Issuer) Issue(identity Identity) (string, *Claims, error) {
+	claims := i.Claims(identity)
+	token, err := i.Sign(claims, SESSION_TOKEN_TYPE)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+// Signs any claims with the session key, with the type in the typ header
+func (i *Issuer) Sign(claims jwt.Claims, tokenType string) (string, error) {
+	token := jwt.NewWithClaims(i.key.method, claims)
+	token.Header["kid"] = i.key.id
+	token.Header["typ"] = tokenType
+	signed, err := token.SignedString(i.key.private)
+	if err != nil {
+		return "", fmt.Errorf("session: could not sign token: %w", err)
+	}
+	return signed, nil
+}
+
+// Checks a token is a session token issued by us and is still valid
+func (i *Issuer) Verify(token string) (*Claims, error) {
+	audience := ""
+	if len(i.Config.Audience) > 0 {
+		audience = i.Config.Audience[0]
+	}
+	var claims Claims
+	if err := i.Parse(token, &claims, SESSION_TOKEN_TYPE, audience); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// Same as Verify for other types of tokens, the audience is only checked
+// when not empty
+func (i *Issuer) Parse(token string, claims jwt.Claims, tokenType, audience string) error {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{i.key.method.Alg()}),
+		jwt.WithIssuer(i.Config.Issuer),
+		jwt.WithExpirationRequired(),
+	}
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return i.key.private.Public(), nil
+	}, options...)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if typ, _ := parsed.Header["typ"].(string); typ != tokenType {
+		return fmt.Errorf("%w: token of type %q, want %q", ErrInvalidToken, typ, tokenType)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var identity = Identity{
+	Method:         "bankid",
+	PersonalNumber: "199001012385",
+	Name:           "Anna Andersson",
+	GivenName:      "Anna",
+	FamilyName:     "Andersson",
+	AuthTime:       time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC),
+}
+
+func newTestIssuer(t *testing.T, config Config) *Issuer {
+	t.Helper()
+	if config.Issuer == "" {
+		config.Issuer = "https://id.example.com"
+	}
+	if config.PseudonymSecret == "" {
+		config.PseudonymSecret = "pseudonym-secret"
+	}
+	issuer, err := NewIssuer(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func TestClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims []Claim
+		want   Claims
+	}{
+		{
+			name: "name by default",
+			want: Claims{Name: identity.Name},
+		},
+		{
+			name:   "every claim",
+			claims: []Claim{CLAIM_NAME, CLAIM_GIVEN_NAME, CLAIM_FAMILY_NAME, CLAIM_PERSONAL_NUMBER},
+			want: Claims{
+				Name:           identity.Name,
+				GivenName:      identity.GivenName,
+				FamilyName:     identity.FamilyName,
+				PersonalNumber: identity.PersonalNumber,
+			},
+		},
+		{
+			name:   "personal number only",
+			claims: []Claim{CLAIM_PERSONAL_NUMBER},
+			want:   Claims{PersonalNumber: identity.PersonalNumber},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newTestIssuer(t, Config{Claims: test.claims, Audience: []string{"backend"}})
+			claims := issuer.Claims(identity)
+			if claims.Name != test.want.Name || claims.GivenName != test.want.GivenName || claims.FamilyName != test.want.FamilyName || claims.PersonalNumber != test.want.PersonalNumber {
+				t.Errorf("got %+v, want %+v", claims, test.want)
+			}
+			if len(claims.AMR) != 1 || claims.AMR[0] != "bankid" || claims.ACR != DEFAULT_LOA || claims.AuthTime != identity.AuthTime.Unix() {
+				t.Errorf("got amr %v, acr %q and auth_time %d", claims.AMR, claims.ACR, claims.AuthTime)
+			}
+			if len(claims.Audience) != 1 || claims.Audience[0] != "backend" || claims.Issuer != "https://id.example.com" {
+				t.Errorf("got aud %v and iss %q", claims.Audience, claims.Issuer)
+			}
+			if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != DEFAULT_LIFETIME {
+				t.Errorf("valid for %s, want %s", lifetime, DEFAULT_LIFETIME)
+			}
+		})
+	}
+}
+
+func TestUnknownClaim(t *testing.T) {
+	config := Config{Issuer: "https://id.example.com", PseudonymSecret: "secret", Claims: []Claim{"email"}}
+	if _, err := NewIssuer(&config); err == nil {
+		t.Error("unknown claim accepted")
+	}
+}
+
+func TestPseudonym(t *testing.T) {
+	issuer := newTestIssuer(t, Config{})
+	mac := hmac.New(sha256.New, []byte("pseudonym-secret"))
+	mac.Write([]byte(identity.PersonalNumber))
+	want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	if got := issuer.Subject(identity.PersonalNumber); got != want {
+		t.Errorf("subject %q, want the HMAC of the personal number %q", got, want)
+	}
+	if issuer.Pseudonym(identity.PersonalNumber) != issuer.Pseudonym(identity.PersonalNumber) {
+		t.Error("pseudonym changes between logins")
+	}
+	if issuer.Pseudonym(identity.PersonalNumber) == issuer.Pseudonym("199001012393") {
+		t.Error("two people have the same pseudonym")
+	}
+	other := newTestIssuer(t, Config{PseudonymSecret: "other-secret"})
+	if other.Pseudonym(identity.PersonalNumber) == want {
+		t.Error("pseudonym does not depend on the secret")
+	}
+
+	plain := newTestIssuer(t, Config{Subject: SUBJECT_PERSONAL_NUMBER})
+	if got := plain.Subject(identity.PersonalNumber); got != identity.PersonalNumber {
+		t.Errorf("subject %q, want the personal number", got)
+	}
+	if _, err := NewIssuer(&Config{Issuer: "https://id.example.com"}); err == nil {
+		t.Error("pseudonyms accepted without a secret")
+	}
+}
+
+func pemKey(t *testing.T, private interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// Verifies a session token with the key published in the JWKS, like another
+// service would
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(t *testing.T, value string) []byte {
+		t.Helper()
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatalf("%q is not base64url: %v", value, err)
+		}
+		return data
+	}
+	tests := []struct {
+		name   string
+		keyPEM string
+		kty    string
+		alg    string
+		public func(t *testing.T, key JWK) interface{}
+	}{
+		{
+			name: "generated P-256",
+			kty:  "EC",
+			alg:  "ES256",
+			public: func(t *testing.T, key JWK) interface{} {
+				if key.Crv != "P-256" || len(decode(t, key.X)) != 32 || len(decode(t, key.Y)) != 32 {
+					t.Errorf("unexpected EC key %+v", key)
+				}
+				return &ecdsa.PublicKey{
+					Curve: elliptic.P256(),
+					X:     new(big.Int).SetBytes(decode(t, key.X)),
+					Y:     new(big.Int).SetBytes(decode(t, key.Y)),
+				}
+			},
+		},
+		{
+			name:   "RSA",
+			keyPEM: pemKey(t, rsaKey),
+			kty:    "RSA",
+			alg:    "RS256",
+			public: func(t *testing.T, key JWK) interface{} {
+				return &rsa.PublicKey{
+					N: new(big.Int).SetBytes(decode(t, key.N)),
+					E: int(new(big.Int).SetBytes(decode(t, key.E)).Int64()),
+				}
+			},
+		},
+		{
+			name:   "Ed25519",
+			keyPEM: pemKey(t, edKey),
+			kty:    "OKP",
+			alg:    "EdDSA",
+			public: func(t *testing.T, key JWK) interface{} {
+				if key.Crv != "Ed25519" {
+					t.Errorf("curve %q, want Ed25519", key.Crv)
+				}
+				return ed25519.PublicKey(decode(t, key.X))
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newTestIssuer(t, Config{KeyPEM: test.keyPEM, KeyID: "key-1"})
+			jwks := issuer.JWKS()
+			if len(jwks.Keys) != 1 {
+				t.Fatalf("%d keys, want 1", len(jwks.Keys))
+			}
+			key := jwks.Keys[0]
+			if key.Kty != test.kty || key.Alg != test.alg || key.Use != "sig" || key.Kid != "key-1" {
+				t.Errorf("got %+v, want a %s signing key for %s", key, test.kty, test.alg)
+			}
+			token, _, err := issuer.Issue(identity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+				if token.Header["kid"] != key.Kid {
+					return nil, errors.New("unknown kid")
+				}
+				return test.public(t, key), nil
+			}, jwt.WithValidMethods([]string{key.Alg}))
+			if err != nil || !parsed.Valid {
+				t.Errorf("token does not verify with the published key: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer := newTestIssuer(t, Config{Audience: []string{"backend"}})
+	token, _, err := issuer.Issue(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := issuer.Verify(token)
+	if err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if claims.Subject != issuer.Pseudonym(identity.PersonalNumber) || claims.Name != identity.Name {
+		t.Errorf("got %+v", claims)
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	issuer := newTestIssuer(t, Config{Audience: []string{"backend"}})
+	// Same key, other settings
+	sameKey := func(config Config) *Issuer {
+		config.Issuer = issuer.Config.Issuer
+		config.PseudonymSecret = "pseudonym-secret"
+		other := newTestIssuer(t, config)
+		other.key = issuer.key
+		return other
+	}
+	issue := func(issuer *Issuer) string {
+		token, _, err := issuer.Issue(identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	sign := func(claims jwt.Claims, tokenType string) string {
+		token, err := issuer.Sign(claims, tokenType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	otherIssuer := sameKey(Config{Audience: []string{"backend"}})
+	otherIssuer.Config.Issuer = "https://evil.example.com"
+	expired := issuer.Claims(identity)
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	noExpiry := issuer.Claims(identity)
+	noExpiry.ExpiresAt = nil
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, issuer.Claims(identity))
+	hmacToken.Header["typ"] = SESSION_TOKEN_TYPE
+	hmacSigned, err := hmacToken.SignedString([]byte("guessed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, issuer.Claims(identity)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"wrong alg", hmacSigned},
+		{"alg none", unsigned},
+		{"other key", issue(newTestIssuer(t, Config{Audience: []string{"backend"}}))},
+		{"wrong iss", issue(otherIssuer)},
+		{"wrong aud", issue(sameKey(Config{Audience: []string{"other-backend"}}))},
+		{"no aud", issue(sameKey(Config{}))},
+		{"expired", sign(expired, SESSION_TOKEN_TYPE)},
+		{"no exp", sign(noExpiry, SESSION_TOKEN_TYPE)},
+		// Tokens of the OpenID provider are signed with the same key
+		{"ID token", sign(issuer.Claims(identity), "JWT")},
+		{"access token", sign(issuer.Claims(identity), "at+jwt")},
+		{"tampered", issue(issuer) + "x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := issuer.Verify(test.token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got %v, want an invalid token", err)
+			}
+		})
+	}
+
+	// Without an audience the type still tells tokens apart
+	noAudience := sameKey(Config{})
+	if _, err := noAudience.Verify(sign(noAudience.Claims(identity), "JWT")); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ID token accepted as a session without audience: %v", err)
+	}
+	if _, err := noAudience.Verify(issue(noAudience)); err != nil {
+		t.Errorf("session token refused without audience: %v", err)
+	}
+}
@@ -18,57 +18,98 @@ function renderQrCode(data) {
         colorLight: "#ffffff",
     });
 }
-function collect() {
-    count = 0;
+let stopUpdates = () => {};
+// Updates the page with a status, returns true once the transaction is over
+function handleStatus(json, qr) {
+    console.log(json);
+    if (json.status === "failed") {
+        setMessage(json.message);
+        cancelButton.style.display = "none";
+        // QR orders expire if never scanned, offer a new one
+        extendButton.style.display = qr ? "block" : "none";
+        qrCodeElement.style.display = "none";
+        manualLink.style.display = "none";
+        return true;
+    } else if (json.status === "complete")  {
+        setMessage("");
+        cancelButton.style.display = "none";
+        extendButton.style.display = "none";
+        qrCodeElement.style.display = "none";
+        if (!json.data) {
+            // Streamed completion, the session comes with the status
+            fetch("/bankid/status")
+                .then((r) => r.json())
+                .then((json) => handleStatus(json, qr));
+            return true;
+        }
+        if (json.data.redirectUrl) {
+            window.location = json.data.redirectUrl;
+            return true;
+        }
+        document.getElementById("userData").textContent = "Logged in as: " + json.data.user.name;
+        return true;
+    }
+    if (json.data && json.data.qrData) {
+        renderQrCode(json.data.qrData);
+    }
+    setMessage(json.message);
+    return false;
+}
+function poll(qr) {
     var timer = setInterval(
         async () => {
             await fetch("/bankid/status")
                 .then((r) => r.json())
                 .then((json) => {
-                    count++;
-                    console.log(json);
-                    if (json.status === "failed") {
-                        setMessage(json.message);
-                        clearTimeout(timer);
-                        cancelButton.style.display = "none";
-                        extendButton.style.display = "none";
-                        qrCodeElement.style.display = "none";
-                        manualLink.style.display = "none";
-                    } else if (json.status === "complete")  {
-                        setMessage("");
+                    if (handleStatus(json, qr)) {
                         clearTimeout(timer);
-                        cancelButton.style.display = "none";
-                        extendButton.style.display = "none";
-                        qrCodeElement.style.display = "none";
-                        document.getElementById("userData").textContent = "Logged in as: " + json.data.user.name;
-                    } else {
-                        message = json.message;
-                        if (json.data && json.data.qrData) {
-                            renderQrCode(json.data.qrData);
-                            if (count >= 25) {
-                                extendButton.style.display = "block";
-                                message += "\nQR code is about to expire, extend if you wish to continue";
-                            }
-                        }
-                        setMessage(message);
                     }
                 })
         },
         1000
     );
+    stopUpdates = () => clearTimeout(timer);
+}
+function collect(qr) {
     cancelButton.style.display = "block";
-    cancelButton.addEventListener("click", () => {
-        clearTimeout(timer);
-        cancel();
-    });
-    extendButton.addEventListener("click", () => {
-        clearTimeout(timer);
-        extend();
+    if (!window.EventSource) {
+        poll(qr);
+        return;
+    }
+    var finished = false;
+    var source = new EventSource("/bankid/events");
+    source.addEventListener("status", (event) => {
+        if (handleStatus(JSON.parse(event.data), qr)) {
+            finished = true;
+            source.close();
+        }
     });
+    // Streaming not possible, e.g. blocked by a proxy
+    source.onerror = () => {
+        source.close();
+        if (!finished) {
+            poll(qr);
+        }
+    };
+    stopUpdates = () => {
+        finished = true;
+        source.close();
+    };
+}
+// Where to go once logged in, checked against the allow-list by the server
+function startParams(same) {
+    let page = new URLSearchParams(window.location.search);
+    let params = new URLSearchParams({ same: same });
+    for (const name of ["return_to", "state", "flow"]) {
+        if (page.has(name)) {
+            params.set(name, page.get(name));
+        }
+    }
+    return params;
 }
 function start(same) {
     fetch(
-        `/bankid/start?same=${same}`, 
+        `/bankid/start?${startParams(same)}`, 
         {
             method: "POST",
             headers: {
@@ -78,6 +119,10 @@ function start(same) {
     )
         .then((r) => r.json())
         .then((json) => {
+            if (!json.success) {
+                setMessage(json.message);
+                return;
+            }
             sameDeviceButton.style.display = "none";
             otherDeviceButton.style.display = "none";
             if (json.qrCodeData) {
@@ -87,7 +132,7 @@ function start(same) {
                 manualLink.style.display = "block";
                 manualLink.href = json.launchUrl;
             }
-            collect();
+            collect(!!json.qrCodeData);
         });
 }
 function cancel() {
@@ -110,7 +155,20 @@ function cancel() {
 function extend() {
     cancelButton.style.display = "none";
     extendButton.style.display = "none";
+    qrCodeElement.style.display = "block";
     start(0);
 }
+extendButton.addEventListener("click", () => extend());
+cancelButton.addEventListener("click", () => {
+    stopUpdates();
+    cancel();
+});
+// Sent back here by the BankID app, keep following the same transaction
+// once the server checked this browser started it
+if (document.body.dataset.returned === "true") {
+    sameDeviceButton.style.display = "none";
+    otherDeviceButton.style.display = "none";
+    collect(false);
+}
 sameDeviceButton.addEventListener("click", () => start(1));
 otherDeviceButton.addEventListener("click", () => start(0));
\ No newline at end of file
@@ -0,0 +1,266 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var outboxBucket = []byte("outbox")
+
+// Retrying would not help, the event is dropped
+var errUndeliverable = errors.New("webhook: undeliverable event")
+
+const (
+	POLL_INTERVAL = 1 * time.Second
+	BASE_DELAY    = 5 * time.Second
+	MAX_DELAY     = 1 * time.Hour
+)
+
+// Delivers events to every target, one at a time in the background
+type Dispatcher struct {
+	Config *Config
+	Client *http.Client
+	db     *bolt.DB
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Event waiting to be delivered to a target
+type outboxRecord struct {
+	Target        string          `json:"target"`
+	Event         json.RawMessage `json:"event"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+}
+
+func NewDispatcher(config *Config) (*Dispatcher, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(config.OutboxPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("webhook: could not open outbox %s: %w", config.OutboxPath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(outboxBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	d := &Dispatcher{
+		Config: config,
+		Client: &http.Client{Timeout: config.Timeout},
+		db:     db,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go d.run()
+	return d, nil
+}
+
+// Queues the event for every target, it is delivered even if the service
+// restarts in the meantime
+func (d *Dispatcher) Send(event Event) error {
+	if event.ID == "" {
+		id, err := newEventID()
+		if err != nil {
+			return err
+		}
+		event.ID = id
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("webhook: could not encode event: %w", err)
+	}
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+		for i, target := range d.Config.Targets {
+			record, err := json.Marshal(outboxRecord{
+				Target:        target.URL,
+				Event:         body,
+				NextAttemptAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+			// Keys sort by creation, so events are delivered in order
+			key := fmt.Sprintf("%020d-%s-%d", event.CreatedAt.UnixNano(), event.ID, i)
+			if err := bucket.Put([]byte(key), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("webhook: could not queue event: %w", err)
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		d.deliverDue()
+	}
+}
+
+type dueRecord struct {
+	key    string
+	record outboxRecord
+}
+
+func (d *Dispatcher) deliverDue() {
+	var due []dueRecord
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(key, value []byte) error {
+			var record outboxRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				log.Printf("Dropping undecodable webhook event %s: %v", key, err)
+				due = append(due, dueRecord{key: string(key)})
+				return nil
+			}
+			if !time.Now().Before(record.NextAttemptAt) {
+				due = append(due, dueRecord{key: string(key), record: record})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Could not read webhook outbox: %v", err)
+		return
+	}
+	for _, next := range due {
+		key, record := next.key, next.record
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		if record.Target == "" {
+			d.remove(key)
+			continue
+		}
+		target, ok := d.Config.target(record.Target)
+		if !ok {
+			log.Printf("Dropping webhook event for %s, it is not a target anymore", record.Target)
+			d.remove(key)
+			continue
+		}
+		err := d.deliver(target, record.Event)
+		if errors.Is(err, errUndeliverable) {
+			log.Printf("Dropping webhook event %s for %s: %v", key, record.Target, err)
+			d.remove(key)
+		} else if err != nil {
+			d.retry(key, record, err)
+		} else {
+			d.remove(key)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(target Target, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Config.Timeout)
+	defer cancel()
+	var event struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("%w: could not decode it: %v", errUndeliverable, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EVENT_HEADER, event.ID)
+	req.Header.Set(TIMESTAMP_HEADER, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SIGNATURE_HEADER, Sign(target.Secret, now, body))
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Exponential backoff, gives up after the maximum number of attempts
+func (d *Dispatcher) retry(key string, record outboxRecord, cause error) {
+	record.Attempts++
+	if record.Attempts >= d.Config.MaxAttempts {
+		log.Printf("Giving up on webhook event %s for %s after %d attempts: %v", key, record.Target, record.Attempts, cause)
+		d.remove(key)
+		return
+	}
+	delay := retryDelay(record.Attempts)
+	record.NextAttemptAt = time.Now().Add(delay)
+	log.Printf("Could not deliver webhook event %s to %s, retrying in %s: %v", key, record.Target, delay, cause)
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(outboxBucket).Put([]byte(key), value)
+	})
+	if err != nil {
+		log.Printf("Could not update webhook outbox: %v", err)
+	}
+}
+
+// Doubles from BASE_DELAY with every failed attempt, up to MAX_DELAY
+func retryDelay(attempts int) time.Duration {
+	delay := BASE_DELAY << (attempts - 1)
+	if delay > MAX_DELAY || delay <= 0 {
+		return MAX_DELAY
+	}
+	return delay
+}
+
+func (d *Dispatcher) remove(key string) {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		log.Printf("Could not update webhook outbox: %v", err)
+	}
+}
+
+// Stops delivering events, the ones left are delivered on the next start
+func (d *Dispatcher) Close() error {
+	close(d.stop)
+	<-d.done
+	return d.db.Close()
+}
@@ -0,0 +1,280 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const secret = "shared-with-the-backend"
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// Backend answering with the statuses in turn, then 200
+func newBackend(t *testing.T, statuses ...int) (*httptest.Server, chan delivery) {
+	t.Helper()
+	deliveries := make(chan delivery, 16)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{header: r.Header, body: body}
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend, deliveries
+}
+
+func testConfig(t *testing.T, url string) *Config {
+	return &Config{
+		Targets:    []Target{{URL: url, Secret: secret}},
+		OutboxPath: filepath.Join(t.TempDir(), "webhooks.db"),
+	}
+}
+
+func receive(t *testing.T, deliveries chan delivery) delivery {
+	t.Helper()
+	select {
+	case received := <-deliveries:
+		return received
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+		return delivery{}
+	}
+}
+
+// Reads the records left in the outbox of a closed dispatcher
+func outbox(t *testing.T, path string) map[string]outboxRecord {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	records := map[string]outboxRecord{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(key, value []byte) error {
+			var record outboxRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			records[string(key)] = record
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func putRecord(t *testing.T, path, key string, record outboxRecord) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(outboxBucket)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Events that cannot be decoded are dropped instead of retried forever
+func TestUndecodableEvent(t *testing.T) {
+	backend, deliveries := newBackend(t)
+	config := testConfig(t, backend.URL)
+	putRecord(t, config.OutboxPath, "0-broken-0", outboxRecord{
+		Target: backend.URL,
+		// Valid JSON for the record, but not an event
+		Event:         json.RawMessage(`"not an event"`),
+		NextAttemptAt: time.Now(),
+	})
+	d, err := NewDispatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Send(Event{Type: TRANSACTION_COMPLETED}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, deliveries)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deliveries:
+		t.Error("undecodable event delivered")
+	default:
+	}
+	if records := outbox(t, config.OutboxPath); len(records) != 0 {
+		t.Errorf("%d records left in the outbox, want none", len(records))
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	backend, deliveries := newBackend(t)
+	d, err := NewDispatcher(testConfig(t, backend.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Send(Event{Type: TRANSACTION_COMPLETED, TransactionID: "order"}); err != nil {
+		t.Fatal(err)
+	}
+	received := receive(t, deliveries)
+	var event Event
+	if err := json.Unmarshal(received.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.ID == "" || event.TransactionID != "order" || event.CreatedAt.IsZero() {
+		t.Errorf("got event %+v", event)
+	}
+	if received.header.Get(EVENT_HEADER) != event.ID {
+		t.Errorf("event header %q, want %q", received.header.Get(EVENT_HEADER), event.ID)
+	}
+	err = Verify(secret, received.header.Get(TIMESTAMP_HEADER), received.header.Get(SIGNATURE_HEADER), received.body, time.Minute)
+	if err != nil {
+		t.Errorf("backend cannot verify the event: %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, BASE_DELAY},
+		{2, 2 * BASE_DELAY},
+		{3, 4 * BASE_DELAY},
+		{10, 512 * BASE_DELAY},
+		{11, MAX_DELAY},
+		{40, MAX_DELAY},
+		// Shifted past the size of the duration
+		{64, MAX_DELAY},
+		{100, MAX_DELAY},
+	}
+	for _, test := range tests {
+		got := retryDelay(test.attempts)
+		if got != test.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+		if got <= 0 || got > MAX_DELAY {
+			t.Errorf("retryDelay(%d) = %s, out of bounds", test.attempts, got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	backend, deliveries := newBackend(t, 500)
+	config := testConfig(t, backend.URL)
+	d, err := NewDispatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Send(Event{Type: TRANSACTION_FAILED}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, deliveries)
+	failedAt := time.Now()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	records := outbox(t, config.OutboxPath)
+	if len(records) != 1 {
+		t.Fatalf("%d records in the outbox, want the failed event", len(records))
+	}
+	for _, record := range records {
+		if record.Attempts != 1 {
+			t.Errorf("%d attempts recorded, want 1", record.Attempts)
+		}
+		if delay := record.NextAttemptAt.Sub(failedAt); delay < BASE_DELAY-time.Second || delay > BASE_DELAY+time.Second {
+			t.Errorf("retried in %s, want %s", delay, BASE_DELAY)
+		}
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	backend, deliveries := newBackend(t, 500)
+	config := testConfig(t, backend.URL)
+	config.MaxAttempts = 1
+	d, err := NewDispatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Send(Event{Type: TRANSACTION_FAILED}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, deliveries)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if records := outbox(t, config.OutboxPath); len(records) != 0 {
+		t.Errorf("%d records left after the last attempt", len(records))
+	}
+}
+
+// Events not delivered yet are kept in the outbox and delivered once the
+// service is back
+func TestRedeliveryAfterRestart(t *testing.T) {
+	backend, deliveries := newBackend(t, 503)
+	config := testConfig(t, backend.URL)
+	d, err := NewDispatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Send(Event{Type: TRANSACTION_COMPLETED, TransactionID: "order"}); err != nil {
+		t.Fatal(err)
+	}
+	first := receive(t, deliveries)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry is due by the time the service comes back
+	records := outbox(t, config.OutboxPath)
+	if len(records) != 1 {
+		t.Fatalf("%d records in the outbox after the restart, want 1", len(records))
+	}
+	for key, record := range records {
+		record.NextAttemptAt = time.Now()
+		putRecord(t, config.OutboxPath, key, record)
+	}
+	d, err = NewDispatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := receive(t, deliveries)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if second.header.Get(EVENT_HEADER) != first.header.Get(EVENT_HEADER) || string(second.body) != string(first.body) {
+		t.Errorf("redelivered %s, want the same event as %s", second.body, first.body)
+	}
+	if err := Verify(secret, second.header.Get(TIMESTAMP_HEADER), second.header.Get(SIGNATURE_HEADER), second.body, time.Minute); err != nil {
+		t.Errorf("redelivered event not signed: %v", err)
+	}
+	if records := outbox(t, config.OutboxPath); len(records) != 0 {
+		t.Errorf("%d records left once delivered", len(records))
+	}
+}
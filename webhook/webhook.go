@@ -0,0 +1,143 @@
+// Package webhook tells backends about the outcome of transactions with signed
+// HTTP callbacks, delivered from a persistent outbox so that events survive
+// restarts and are retried until the backend accepts them.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_HEADER     = "X-Identity-Event"
+	TIMESTAMP_HEADER = "X-Identity-Timestamp"
+	SIGNATURE_HEADER = "X-Identity-Signature"
+
+	DEFAULT_OUTBOX_PATH  = "webhooks.db"
+	DEFAULT_MAX_ATTEMPTS = 12
+	DEFAULT_TIMEOUT      = 10 * time.Second
+)
+
+var ErrInvalidSignature = errors.New("webhook: invalid signature")
+
+type Config struct {
+	Targets []Target `yaml:"targets"`
+	// Where events waiting to be delivered are kept
+	OutboxPath string `yaml:"outboxPath"`
+	// Events are dropped after that many failed deliveries
+	MaxAttempts int           `yaml:"maxAttempts"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+type Target struct {
+	URL string `yaml:"url"`
+	// Key of the HMAC in the signature header, shared with the backend
+	Secret string `yaml:"secret"`
+}
+
+func (c *Config) validate() error {
+	if len(c.Targets) == 0 {
+		return errors.New("webhook: no target configured")
+	}
+	for _, target := range c.Targets {
+		if !strings.HasPrefix(target.URL, "https://") && !strings.HasPrefix(target.URL, "http://") {
+			return fmt.Errorf("webhook: target %q is not an HTTP URL", target.URL)
+		}
+		if target.Secret == "" {
+			return fmt.Errorf("webhook: target %q has no 'secret'", target.URL)
+		}
+	}
+	if c.OutboxPath == "" {
+		c.OutboxPath = DEFAULT_OUTBOX_PATH
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DEFAULT_TIMEOUT
+	}
+	return nil
+}
+
+func (c *Config) target(url string) (Target, bool) {
+	for _, target := range c.Targets {
+		if target.URL == url {
+			return target, true
+		}
+	}
+	return Target{}, false
+}
+
+type EventType string
+
+const (
+	TRANSACTION_COMPLETED EventType = "transaction.completed"
+	TRANSACTION_FAILED    EventType = "transaction.failed"
+)
+
+// Sent as the JSON body of callbacks
+type Event struct {
+	ID            string    `json:"id"`
+	Type          EventType `json:"type"`
+	Provider      string    `json:"provider"`
+	TransactionID string    `json:"transactionId"`
+	OrderType     string    `json:"orderType"`
+	Flow          string    `json:"flow"`
+	Status        string    `json:"status"`
+	HintCode      string    `json:"hintCode,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	User          *User     `json:"user,omitempty"`
+	StartedAt     time.Time `json:"startedAt"`
+	FinishedAt    time.Time `json:"finishedAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Claims of the user, as in session tokens
+type User struct {
+	Subject        string `json:"sub"`
+	Name           string `json:"name,omitempty"`
+	GivenName      string `json:"given_name,omitempty"`
+	FamilyName     string `json:"family_name,omitempty"`
+	PersonalNumber string `json:"personalIdentityNumber,omitempty"`
+}
+
+func newEventID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// Value of the signature header: the hex HMAC-SHA256 of "<timestamp>.<body>"
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// For backends receiving callbacks: checks the signature and that the
+// callback was sent less than tolerance ago, so it cannot be replayed later
+func Verify(secret, timestampHeader, signatureHeader string, body []byte, tolerance time.Duration) error {
+	seconds, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp", ErrInvalidSignature)
+	}
+	timestamp := time.Unix(seconds, 0)
+	if age := time.Since(timestamp); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp outside of tolerance", ErrInvalidSignature)
+	}
+	if !hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signatureHeader)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"id":"event"}`)
+	now := time.Now()
+	timestamp := func(at time.Time) string {
+		return strconv.FormatInt(at.Unix(), 10)
+	}
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      []byte
+		valid     bool
+	}{
+		{"valid", timestamp(now), Sign(secret, now, body), body, true},
+		{"within tolerance", timestamp(now.Add(-4 * time.Minute)), Sign(secret, now.Add(-4*time.Minute), body), body, true},
+		{"clock ahead within tolerance", timestamp(now.Add(4 * time.Minute)), Sign(secret, now.Add(4*time.Minute), body), body, true},
+		{"replayed later", timestamp(now.Add(-6 * time.Minute)), Sign(secret, now.Add(-6*time.Minute), body), body, false},
+		{"from the future", timestamp(now.Add(6 * time.Minute)), Sign(secret, now.Add(6*time.Minute), body), body, false},
+		{"other timestamp", timestamp(now.Add(-time.Second)), Sign(secret, now, body), body, false},
+		{"other body", timestamp(now), Sign(secret, now, body), []byte(`{"id":"other"}`), false},
+		{"other secret", timestamp(now), Sign("guessed", now, body), body, false},
+		{"no signature", timestamp(now), "", body, false},
+		{"invalid timestamp", "yesterday", Sign(secret, now, body), body, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Verify(secret, test.timestamp, test.signature, test.body, 5*time.Minute)
+			if test.valid && err != nil {
+				t.Errorf("valid signature refused: %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("got %v, want an invalid signature", err)
+			}
+		})
+	}
+}